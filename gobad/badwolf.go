@@ -1,10 +1,100 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "compare":
+			os.Exit(compareMain(os.Args[2:]))
+		case "report":
+			os.Exit(reportMain(os.Args[2:]))
+		case "import":
+			os.Exit(importMain(os.Args[2:]))
+		case "export":
+			os.Exit(exportMain(os.Args[2:]))
+		case "migrate":
+			os.Exit(migrateMain(os.Args[2:]))
+		}
+	}
+
+	formats := []string{}
+	for format := range SinkFormats {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	format := flag.String("format", "json", "result format: "+strings.Join(formats, ", "))
+	out := flag.String("out", "", "result file (default benchmarkresult.<ext> for the format)")
+	flag.Int64Var(&DefaultWorkload.Seed, "seed", 0, "seed to generate the workload from, as recorded in a result to replay it (default from the clock)")
+	flag.StringVar(&DefaultWorkload.Dataset, "dataset", DefaultWorkload.Dataset, "documents to run on: "+strings.Join(Datasets, ", "))
+	imports := flag.String("import", "", "comma separated sMAP JSON dumps or CSV point lists to run on, in place of -dataset")
+	flag.IntVar(&DefaultWorkload.Documents, "documents", DefaultWorkload.Documents, "documents loaded before the phases run")
+	flag.IntVar(&DefaultWorkload.Operations, "operations", DefaultWorkload.Operations, "calls each phase makes")
+	flag.IntVar(&DefaultWorkload.Runs, "runs", DefaultWorkload.Runs, "times the workload is repeated")
+	flag.IntVar(&DefaultWorkload.Warmup, "warmup", DefaultWorkload.Warmup, "untimed operations run on each provider before its phases")
+	flag.Float64Var(&DefaultWorkload.OutlierMADs, "outlier-mads", DefaultWorkload.OutlierMADs, "median absolute deviations above the steady state that make a phase iteration an outlier")
+	sweep := flag.Bool("sweep", false, "sweep dataset sizes from -sweep-from to -sweep-to in place of -documents, and fit how each phase scales")
+	sweepFrom := flag.Int("sweep-from", 1000, "smallest dataset size of a sweep")
+	sweepTo := flag.Int("sweep-to", 10000000, "largest dataset size of a sweep")
+	sweepStep := flag.Float64("sweep-step", 10, "factor each dataset size of a sweep grows by")
+	cache := flag.Int("cache", 0, "also run each provider behind a MetadataCache of this many documents (default none)")
+	unacked := flag.Bool("unacked", false, "also run each provider with unacknowledged writes")
+	flag.Parse()
+
+	if DefaultWorkload.Documents < 1 || DefaultWorkload.Operations < 1 || DefaultWorkload.Runs < 1 {
+		log.Fatal("-documents, -operations and -runs must be at least 1")
+	}
+	if *imports != "" {
+		DefaultWorkload.Dataset = "import"
+		DefaultWorkload.Import = strings.Split(*imports, ",")
+		dump, err := LoadMetadataFiles(DefaultWorkload.Import...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ImportedMetadata = dump
+	}
+	known := false
+	for _, dataset := range Datasets {
+		known = known || dataset == DefaultWorkload.Dataset
+	}
+	if !known {
+		log.Fatalf("Unknown dataset %q", DefaultWorkload.Dataset)
+	}
+	if DefaultWorkload.Dataset == "import" && ImportedMetadata == nil {
+		log.Fatal("-dataset import needs dumps to load, given with -import")
+	}
+	if DefaultWorkload.Warmup < 0 {
+		log.Fatal("-warmup can't be negative")
+	}
+	if *cache < 0 {
+		log.Fatal("-cache can't be negative")
+	}
+	if *cache > 0 {
+		DefaultWorkload.CacheCapacities = []int{0, *cache}
+	}
+	if *unacked {
+		DefaultWorkload.WriteConcerns = []WriteConcern{SafeWrites, UnacknowledgedWrites}
+	}
+	if *sweep {
+		if *sweepFrom < 1 || *sweepTo < *sweepFrom || *sweepStep <= 1 {
+			log.Fatal("A sweep needs 1 <= -sweep-from <= -sweep-to and -sweep-step > 1")
+		}
+		DefaultWorkload.Sizes = GeometricSizes(*sweepFrom, *sweepTo, *sweepStep)
+	}
+
+	sink, err := OpenSink(*format, *out, &Report)
+	if err != nil {
+		log.Fatal(err)
+	}
+	Report.AddSink(sink)
+
 	benchmarks_entry()
 	fmt.Printf("<<done>>")
 }
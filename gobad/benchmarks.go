@@ -2,191 +2,617 @@ package main
 
 import (
 	"code.google.com/p/go-uuid/uuid"
+	"context"
 	"fmt"
+	"log"
 	"math/rand"
+	"os"
+	"strconv"
 	"time"
 )
 
 //If all benchmark constants are relative to this, accuracy can be
-//scaled arbitrarily and reproducably by editing this constant
+//scaled arbitrarily and reproducably by editing this constant. It sets
+//the defaults of DefaultWorkload, which the command line can override
 const FACTOR = 1024
 
 func benchmarks_entry() {
-	sd := time.Now().Unix()
-	rand.Seed(sd)
+	if DefaultWorkload.Seed == 0 {
+		DefaultWorkload.Seed = time.Now().UnixNano()
+	}
+	fmt.Printf("Seed %d\n", DefaultWorkload.Seed)
+	Report.VAL_Run = CollectRunInfo(DefaultWorkload.Seed, DefaultWorkload)
+	ctx := context.Background()
 
-	//TODO some reflection BS here, instead of hard coding
-	//foreach database type
-	for run := 0; run < FACTOR/10; run++ {
-		if run%10 == 0 {
-			fmt.Printf("Doing Run %d\n", run)
+	sizes := DefaultWorkload.Sizes
+	if len(sizes) == 0 {
+		sizes = []int{DefaultWorkload.Documents}
+	}
+	for _, documents := range sizes {
+		spec := DefaultWorkload
+		spec.Documents = documents
+		if len(DefaultWorkload.Sizes) > 0 {
+			fmt.Printf("Sweeping %d documents\n", documents)
 		}
-		provider := new(ProviderMongo)
-		provider.Initialize()
-		//Benchmarks
-		//BENCH_BWQ_A(provider, "mongo", run)
-		BENCH_MetadataQuery(provider, "mongo", run)
-		provider.Initialize()
-		BENCH_MetadataQuery(provider, "mongoexploded", run)
+
+		//TODO some reflection BS here, instead of hard coding
+		//foreach database type
+		for run := 0; run < spec.Runs; run++ {
+			if run%10 == 0 {
+				fmt.Printf("Doing Run %d\n", run)
+			}
+			for _, cfg := range spec.IndexConfigs {
+				for _, capacity := range spec.CacheCapacities {
+					for _, wc := range spec.WriteConcerns {
+						mongo := spec.Mongo
+						mongo.Writes = wc
+
+						provider := &ProviderMongo{Mongo: mongo, Retry: spec.Retry}
+						//Benchmarks
+						//BENCH_BWQ_A(ctx, provider, "mongo", run, spec)
+						benchProvider(ctx, provider, "mongo", run, spec, cfg, wc, capacity)
+
+						exploded := &ProviderMongoExploded{Mongo: mongo, Retry: spec.Retry}
+						benchProvider(ctx, exploded, "mongoexploded", run, spec, cfg, wc, capacity)
+					}
+				}
+			}
+		}
+	}
+	Report.VAL_Steady = AnalyzeSteadyState(Report.VAL_Metrics, Report.pauses, DefaultWorkload.OutlierMADs)
+	PrintSteadyState(os.Stdout, Report.VAL_Steady)
+	if len(DefaultWorkload.Sizes) > 1 {
+		Report.VAL_Scaling = FitScaling(Report.VAL_Metrics)
+		PrintScaling(os.Stdout, Report.VAL_Scaling)
 	}
 
 	Report.WriteOut()
 }
 
-func BWUtil_GenVk() []byte {
+// set up a provider as the index config says, run the workload on it behind
+// the decorators spec asks for, and close it. The provider must already be
+// configured with the write concern wc
+func benchProvider(ctx context.Context, mq MetadataQuery, provider string, run int, spec WorkloadSpec, cfg IndexConfig, wc WriteConcern, capacity int) {
+	Report.Check(timeoutProvider(mq, spec.Timeouts).Initialize(ctx))
+	Report.Check(applyIndexConfig(ctx, mq, provider, cfg))
+	base := mq
+	name := concernedProviderName(indexedProviderName(provider, cfg), wc)
+	faults := spec.Faults
+	faults.Retry = spec.Retry
+	mq, name = faultProvider(mq, name, faults)
+	mq, name = cacheProvider(mq, name, capacity)
+	mq = timeoutProvider(mq, spec.Timeouts)
+	if len(spec.Sizes) > 0 {
+		name = sizedProviderName(name, spec.Documents)
+	}
+	describeProvider(ctx, mq, name)
+	BENCH_MetadataQuery(ctx, mq, name, run, spec)
+	Report.Check(base.Close())
+}
+
+// the generator every random choice of a run draws from, documents and uuids
+// included. Each run has its own, derived from the seed and the run number,
+// so every provider in a run sees the same data and the same operations, and
+// a run can be replayed from the seed
+func workloadRand(seed int64, run int) *rand.Rand {
+	// mix the run into the seed with the golden ratio, so neighbouring runs
+	// don't get neighbouring seeds
+	return rand.New(rand.NewSource(seed ^ int64(uint64(run+1)*0x9e3779b97f4a7c15)))
+}
+
+func BWUtil_GenVk(rng *rand.Rand) []byte {
 	rv := make([]byte, 32)
 	for i := 0; i < 32; i++ {
-		rv[i] = byte(rand.Int())
+		rv[i] = byte(rng.Int())
 	}
 	return rv
 }
 
 //BosswaveQuery
-func BENCH_BWQ_A(p BosswaveQuery, id, provider string, run int) {
+func BENCH_BWQ_A(ctx context.Context, p BosswaveQuery, id, provider string, run int, spec WorkloadSpec) {
+	rng := workloadRand(spec.Seed, run)
 
 	recs := make([]BosswaveRecord, FACTOR)
 	for i := 0; i < FACTOR; i++ {
 		recs[i] = BosswaveRecord{
 			Key:      fmt.Sprintf("/foo/bar/%d/%d/%d/%d", run, i%100, i%10, i),
 			Allocset: int64(i % 100),
-			Owner:    rand.Int63(),
+			Owner:    rng.Int63(),
 			Value:    []byte{},
 		}
 	}
 
 	st := Report.StartTimer()
 	for _, d := range recs {
-		p.InsertRecord(d)
+		Report.Check(p.InsertRecord(ctx, d))
 	}
 	Report.DeltaMetric(id, provider, run, st)
 }
 
-func BENCH_MetadataQuery(mq MetadataQuery, provider string, run int) {
-	// generate documents
-	sg := NewStringGenerator("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_")
-	toplevelkeys := sg.GenerateNRandomStrings(10, 10) // 10 random strings with length 10
-	toplevelvalues := sg.GenerateNRandomStrings(10, 10)
-	// InsertDocument
-	recs := make([]KVList, FACTOR)
-	for i := 0; i < FACTOR; i++ {
+// generates count documents, each with a fresh uuid and every one of keys
+// set to a random choice from values. uuids are drawn from the generator set
+// with uuid.SetRand, which BENCH_MetadataQuery sets to rng
+func GenerateDocuments(rng *rand.Rand, count int, keys, values []string) []KVList {
+	recs := make([]KVList, count)
+	for i := 0; i < count; i++ {
 		record := [][2]string{[2]string{"uuid", uuid.New()}}
-		for _, tlk := range toplevelkeys {
-			record = append(record, [2]string{tlk, toplevelvalues[rand.Intn(10)]})
+		for _, tlk := range keys {
+			record = append(record, [2]string{tlk, values[rng.Intn(len(values))]})
 		}
 		recs[i] = record
 	}
+	return recs
+}
 
-	st := Report.StartTimer()
+// documents generated and loaded at a time by preloadDocuments
+const preloadChunk = 64 * 1024
+
+// load count generated documents untimed, straight into the provider under
+// any decorators but its timeouts, a chunk at a time so that large datasets
+// needn't fit in memory. Used for the documents the phases don't handle
+// themselves
+func preloadDocuments(ctx context.Context, gen DocumentGenerator, mq MetadataQuery, count int) {
+	base := untimedProvider(mq)
+	for count > 0 {
+		n := count
+		if n > preloadChunk {
+			n = preloadChunk
+		}
+		failed, err := base.BulkInsertDocument(ctx, gen.Generate(n), FACTOR)
+		Report.Check(err)
+		if len(failed) > 0 {
+			Report.Fatal("%d documents failed to preload, first: %v", len(failed), failed[0].Err)
+		}
+		count -= n
+	}
+}
+
+// run count untimed operations straight on the provider under any
+// decorators but its timeouts, so they add to no metric or decorator stats:
+// insert count documents of their own one at a time, read each back by uuid
+// and by one of its values, read the unique values of a key, and delete them
+// all again
+func warmupProvider(ctx context.Context, rng *rand.Rand, gen DocumentGenerator, mq MetadataQuery, count int) {
+	if count == 0 {
+		return
+	}
+	base := untimedProvider(mq)
+	tag := [2]string{"warmup", "1"}
+	docs := gen.Generate(count)
+	keys := gen.Keys()
+	for _, doc := range docs {
+		doc = append(doc, tag)
+		Report.Check(base.InsertDocument(ctx, []KVList{doc}))
+	}
+	for _, doc := range docs {
+		_, err := base.GetDocumentUnique(ctx, doc[0][1])
+		Report.Check(err)
+		_, err = base.GetDocumentSetWhere(ctx, KVList{doc[1+rng.Intn(len(doc)-1)], tag})
+		Report.Check(err)
+	}
+	for _, key := range keys {
+		_, err := base.GetUniqueValues(ctx, key)
+		Report.Check(err)
+	}
+	Report.Check(base.DeleteDocumentsWhere(ctx, KVList{tag}))
+}
+
+// n documents taken from recs in turn, starting over at the first once they
+// run out
+func cycleDocuments(recs []KVList, n int) []KVList {
+	if n <= len(recs) {
+		return recs[:n]
+	}
+	ret := make([]KVList, n)
+	for i := range ret {
+		ret[i] = recs[i%len(recs)]
+	}
+	return ret
+}
+
+// a where clause on one of rec's own key/value pairs, drawn from the n after
+// the first skip of its keys, which the delete phases have already removed.
+// The pair comes whole from the document, so the clause matches it and the
+// others that share the value, whatever the dataset
+func docWhere(rng *rand.Rand, rec KVList, skip, n int) KVList {
+	kvs := rec[1:]
+	if len(kvs) > skip {
+		kvs = kvs[skip:]
+	}
+	return KVList{kvs[rng.Intn(n)%len(kvs)]}
+}
+
+// explain a sample query of a phase and attach the plan to the phase's metric,
+// if the provider can explain it. Runs untimed, after the phase
+func explainPhase(ctx context.Context, mq MetadataQuery, provider, id string, run int, q Query) {
+	qe, ok := baseProvider(mq).(QueryExplainer)
+	if !ok {
+		return
+	}
+	plan, err := qe.Explain(ctx, q)
+	Report.Check(err)
+	if plan != nil {
+		Report.AttachPlan(provider, id, run, *plan)
+	}
+}
+
+func BENCH_MetadataQuery(ctx context.Context, mq MetadataQuery, provider string, run int, spec WorkloadSpec) {
+	// every phase is timed by the calls the instruments record
+	im := NewInstrumentedMetadataQuery(mq)
+	mq = im
+	rng := workloadRand(spec.Seed, run)
+	uuid.SetRand(rng)
+	defer uuid.SetRand(nil)
+
+	// generate documents
+	sg := NewStringGenerator("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_", rng)
+	gen, err := NewDocumentGenerator(spec.Dataset, rng, sg)
+	Report.Check(err)
+	toplevelkeys := gen.Keys()
+	// InsertDocument. The phases keep the documents they insert here, up to
+	// one per operation, and any more the dataset needs are preloaded first
+	kept := spec.Documents
+	if kept > spec.Operations {
+		kept = spec.Operations
+	}
+	preloadDocuments(ctx, gen, mq, spec.Documents-kept)
+	warmupProvider(ctx, rng, gen, mq, spec.Warmup)
+	recs := gen.Generate(kept)
+	ops := cycleDocuments(recs, spec.Operations)
+
+	st := Report.StartPhase(&im.Instruments)
 	for _, rec := range recs {
-		mq.InsertDocument([]KVList{rec})
+		Report.Check(mq.InsertDocument(ctx, []KVList{rec}))
 	}
-	Report.DeltaMetric(provider, "InsertDocument", run, st)
+	Report.PhaseMetric(provider, "InsertDocument", run, st)
+
+	// InsertDocument and BulkInsertDocument at each batch size.
+	// Each batch size inserts its own tagged documents, which are removed
+	// again untimed so the later phases see only recs
+	for _, bs := range spec.BatchSizes {
+		tag := KVList{[2]string{"batchsize", strconv.Itoa(bs)}}
+		extra := gen.Generate(spec.Operations)
+		for i := range extra {
+			extra[i] = append(extra[i], tag[0])
+		}
+
+		half := len(extra) / 2
+		st = Report.StartPhase(&im.Instruments)
+		for i := 0; i < half; i += bs {
+			end := i + bs
+			if end > half {
+				end = half
+			}
+			Report.Check(mq.InsertDocument(ctx, extra[i:end]))
+		}
+		Report.PhaseMetric(provider, fmt.Sprintf("InsertDocumentBatch%d", bs), run, st)
+
+		st = Report.StartPhase(&im.Instruments)
+		failed, err := mq.BulkInsertDocument(ctx, extra[half:], bs)
+		Report.Check(err)
+		if len(failed) > 0 {
+			Report.Fatal("%d documents failed to bulk insert, first: %v", len(failed), failed[0].Err)
+		}
+		Report.PhaseMetric(provider, fmt.Sprintf("BulkInsertDocumentBatch%d", bs), run, st)
+
+		Report.Check(mq.DeleteDocumentsWhere(ctx, tag))
+	}
+
+	// the queries explained for each phase, drawn from the first document
+	sample := recs[0]
+	samplewhere := KVList{sample[1]}
+	sampleglob := globOf(sample[1][1])
 
 	// GetDocumentUnique
-	st = Report.StartTimer()
-	for _, rec := range recs {
-		mq.GetDocumentUnique(rec[0][1]) // fetch uuid
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		_, err := mq.GetDocumentUnique(ctx, rec[0][1]) // fetch uuid
+		Report.Check(err)
+	}
+	Report.PhaseMetric(provider, "GetDocumentUnique", run, st)
+	explainPhase(ctx, mq, provider, "GetDocumentUnique", run, Query{Op: "GetDocumentUnique", UUID: sample[0][1]})
+
+	// GetDocumentUnique -- a dashboard's read pattern, where most reads go to
+	// a small hot set of documents
+	hot := recs[:(len(recs)+15)/16]
+	st = Report.StartPhase(&im.Instruments)
+	for i := 0; i < spec.Operations; i++ {
+		if rng.Intn(10) == 0 {
+			_, err := mq.GetDocumentUnique(ctx, recs[rng.Intn(len(recs))][0][1])
+			Report.Check(err)
+		} else {
+			_, err := mq.GetDocumentUnique(ctx, hot[rng.Intn(len(hot))][0][1])
+			Report.Check(err)
+		}
 	}
-	Report.DeltaMetric(provider, "GetDocumentUnique", run, st)
+	Report.PhaseMetric(provider, "GetDocumentUniqueHot", run, st)
 
 	// GetDocumentSetWhere -- 1 doc
-	st = Report.StartTimer()
-	for _, rec := range recs {
-		mq.GetDocumentSetWhere(rec) // fetch 1 doc
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		_, err := mq.GetDocumentSetWhere(ctx, rec) // fetch 1 doc
+		Report.Check(err)
 	}
-	Report.DeltaMetric(provider, "GetDocumentSetWhere1Doc", run, st)
+	Report.PhaseMetric(provider, "GetDocumentSetWhere1Doc", run, st)
+	explainPhase(ctx, mq, provider, "GetDocumentSetWhere1Doc", run, Query{Op: "GetDocumentSetWhere", Where: sample})
 
 	// GetDocumentSetWhere -- many doc
-	st = Report.StartTimer()
-	for _, rec := range recs {
-		mq.GetDocumentSetWhere(KVList{[2]string{toplevelkeys[rand.Intn(10)], rec[rand.Intn(10)][1]}}) // fetch 1 doc
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		_, err := mq.GetDocumentSetWhere(ctx, docWhere(rng, rec, 0, 10)) // fetch 1 doc
+		Report.Check(err)
 	}
-	Report.DeltaMetric(provider, "GetDocumentSetWhereManyDoc", run, st)
+	Report.PhaseMetric(provider, "GetDocumentSetWhereManyDoc", run, st)
+	explainPhase(ctx, mq, provider, "GetDocumentSetWhereManyDoc", run, Query{Op: "GetDocumentSetWhere", Where: samplewhere})
 
 	// GetUniqueValues
-	st = Report.StartTimer()
-	for _, rec := range recs {
-		mq.GetUniqueValues(rec[rand.Intn(10)][0])
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		_, err := mq.GetUniqueValues(ctx, rec[rng.Intn(10)%len(rec)][0])
+		Report.Check(err)
 	}
-	Report.DeltaMetric(provider, "GetUniqueValues", run, st)
+	Report.PhaseMetric(provider, "GetUniqueValues", run, st)
+	explainPhase(ctx, mq, provider, "GetUniqueValues", run, Query{Op: "GetUniqueValues", Key: sample[1][0]})
 
 	// GetDocumentSetValueGlob
-	st = Report.StartTimer()
-	for _, rec := range recs {
-		i := rand.Intn(10)
-		mq.GetDocumentSetValueGlob(rec[i][0], string(rec[i][1][0])+".*")
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		i := rng.Intn(10) % len(rec)
+		_, err := mq.GetDocumentSetValueGlob(ctx, rec[i][0], globOf(rec[i][1]))
+		Report.Check(err)
 	}
-	Report.DeltaMetric(provider, "GetDocumentSetValueGlob", run, st)
+	Report.PhaseMetric(provider, "GetDocumentSetValueGlob", run, st)
+	explainPhase(ctx, mq, provider, "GetDocumentSetValueGlob", run, Query{Op: "GetDocumentSetValueGlob", Key: sample[1][0], ValueGlob: sampleglob})
 
 	// GetKeyGlob
-	st = Report.StartTimer()
-	for _, rec := range recs {
-		i := rand.Intn(10)
-		mq.GetKeyGlob(string(rec[i][0][0]) + ".*")
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		i := rng.Intn(10) % len(rec)
+		_, err := mq.GetKeyGlob(ctx, globOf(rec[i][0]))
+		Report.Check(err)
+	}
+	Report.PhaseMetric(provider, "GetKeyGlob", run, st)
+	explainPhase(ctx, mq, provider, "GetKeyGlob", run, Query{Op: "GetKeyGlob", KeyGlob: globOf(sample[1][0])})
+
+	// CountWhere -- many doc
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		_, err := mq.CountWhere(ctx, docWhere(rng, rec, 0, 10))
+		Report.Check(err)
+	}
+	Report.PhaseMetric(provider, "CountWhere", run, st)
+	explainPhase(ctx, mq, provider, "CountWhere", run, Query{Op: "CountWhere", Where: samplewhere})
+
+	// CountValueGlob
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		i := rng.Intn(10) % len(rec)
+		_, err := mq.CountValueGlob(ctx, rec[i][0], globOf(rec[i][1]))
+		Report.Check(err)
 	}
-	Report.DeltaMetric(provider, "GetKeyGlob", run, st)
+	Report.PhaseMetric(provider, "CountValueGlob", run, st)
+	explainPhase(ctx, mq, provider, "CountValueGlob", run, Query{Op: "CountValueGlob", Key: sample[1][0], ValueGlob: sampleglob})
+
+	// ExistsWhere
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		_, err := mq.ExistsWhere(ctx, docWhere(rng, rec, 0, 10))
+		Report.Check(err)
+	}
+	Report.PhaseMetric(provider, "ExistsWhere", run, st)
+	explainPhase(ctx, mq, provider, "ExistsWhere", run, Query{Op: "ExistsWhere", Where: samplewhere})
+
+	// GetUniqueValueCounts
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		_, err := mq.GetUniqueValueCounts(ctx, rec[rng.Intn(10)%len(rec)][0])
+		Report.Check(err)
+	}
+	Report.PhaseMetric(provider, "GetUniqueValueCounts", run, st)
+	explainPhase(ctx, mq, provider, "GetUniqueValueCounts", run, Query{Op: "GetUniqueValueCounts", Key: sample[1][0]})
 
 	// SetKVDocumentUnique
-	st = Report.StartTimer()
-	for _, rec := range recs {
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
 		randomkv := KVList{[2]string{sg.RandomString(10), sg.RandomString(10)}}
-		mq.SetKVDocumentUnique(randomkv, rec[0][1])
+		Report.Check(mq.SetKVDocumentUnique(ctx, randomkv, rec[0][1]))
 	}
-	Report.DeltaMetric(provider, "SetKVDocumentUnique", run, st)
+	Report.PhaseMetric(provider, "SetKVDocumentUnique", run, st)
+	explainPhase(ctx, mq, provider, "SetKVDocumentUnique", run, Query{Op: "SetKVDocumentUnique", UUID: sample[0][1]})
 
 	// SetKVDocumentWhere
-	st = Report.StartTimer()
-	for _, rec := range recs {
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
 		randomkv := KVList{[2]string{sg.RandomString(10), sg.RandomString(10)}}
-		mq.SetKVDocumentWhere(randomkv, KVList{[2]string{toplevelkeys[rand.Intn(10)], rec[rand.Intn(10)][1]}})
+		Report.Check(mq.SetKVDocumentWhere(ctx, randomkv, docWhere(rng, rec, 0, 10)))
 	}
-	Report.DeltaMetric(provider, "SetKVDocumentWhere", run, st)
+	Report.PhaseMetric(provider, "SetKVDocumentWhere", run, st)
+	explainPhase(ctx, mq, provider, "SetKVDocumentWhere", run, Query{Op: "SetKVDocumentWhere", Where: samplewhere})
 
 	// SetKVDocumentValueGlob
-	st = Report.StartTimer()
-	for _, rec := range recs {
-		i := rand.Intn(10)
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		i := rng.Intn(10) % len(rec)
 		randomkv := KVList{[2]string{sg.RandomString(10), sg.RandomString(10)}}
-		mq.SetKVDocumentValueGlob(randomkv, rec[i][0], string(rec[i][1][0])+".*")
+		Report.Check(mq.SetKVDocumentValueGlob(ctx, randomkv, rec[i][0], globOf(rec[i][1])))
+	}
+	Report.PhaseMetric(provider, "SetKVDocumentValueGlob", run, st)
+	explainPhase(ctx, mq, provider, "SetKVDocumentValueGlob", run, Query{Op: "SetKVDocumentValueGlob", Key: sample[1][0], ValueGlob: sampleglob})
+
+	// SetKVDocumentUnique -- overwrite a key the document already has
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		i := 1 + rng.Intn(10)%(len(rec)-1)
+		Report.Check(mq.SetKVDocumentUnique(ctx, KVList{[2]string{rec[i][0], gen.Value(rec[i][0])}}, rec[0][1]))
+	}
+	Report.PhaseMetric(provider, "SetKVDocumentUniqueExisting", run, st)
+	explainPhase(ctx, mq, provider, "SetKVDocumentUniqueExisting", run, Query{Op: "SetKVDocumentUnique", UUID: sample[0][1]})
+
+	// BulkSetKVDocumentUnique -- overwrite an existing key, at each batch size
+	for _, bs := range spec.BatchSizes {
+		updates := make([]DocumentUpdate, len(ops))
+		for i, rec := range ops {
+			key := rec[1+rng.Intn(10)%(len(rec)-1)][0]
+			updates[i] = DocumentUpdate{UUID: rec[0][1], KV: KVList{[2]string{key, gen.Value(key)}}}
+		}
+		st = Report.StartPhase(&im.Instruments)
+		failed, err := mq.BulkSetKVDocumentUnique(ctx, updates, bs)
+		Report.Check(err)
+		if len(failed) > 0 {
+			Report.Fatal("%d documents failed to bulk update, first: %v", len(failed), failed[0].Err)
+		}
+		Report.PhaseMetric(provider, fmt.Sprintf("BulkSetKVDocumentUniqueBatch%d", bs), run, st)
 	}
-	Report.DeltaMetric(provider, "SetKVDocumentValueGlob", run, st)
+
+	// Retag -- drop a tag and set a new one on a group of documents, first as
+	// two independent calls and then as one atomic batch, so the difference
+	// between the two is the cost of atomicity. Providers that can't apply
+	// batches, as on a standalone mongod, skip the batch phase
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		where := docWhere(rng, rec, 0, 10)
+		Report.Check(mq.DeleteKeyDocumentWhere(ctx, []string{"tag"}, where))
+		Report.Check(mq.SetKVDocumentWhere(ctx, KVList{[2]string{"tag", sg.RandomString(10)}}, where))
+	}
+	Report.PhaseMetric(provider, "RetagSequential", run, st)
+
+	batched := true
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		where := docWhere(rng, rec, 0, 10)
+		batch := new(MetadataBatch)
+		batch.DeleteKeyDocumentWhere([]string{"tag"}, where)
+		batch.SetKVDocumentWhere(KVList{[2]string{"tag", sg.RandomString(10)}}, where)
+		applied, err := mq.ApplyBatch(ctx, batch)
+		Report.Check(err)
+		// a batch failed by an injected fault says nothing of whether the provider
+		// can apply batches
+		if !applied && err == nil {
+			batched = false
+			break
+		}
+	}
+	if batched {
+		Report.PhaseMetric(provider, "RetagBatch", run, st)
+	} else {
+		log.Printf("%s can't apply atomic batches, so RetagBatch is skipped; the Mongo providers need a replica set", provider)
+	}
+
+	// SetKVDocumentUnique with a subscriber -- against SetKVDocumentUniqueExisting
+	// this gives the write slowdown a subscriber causes. NotificationLatency is
+	// the mean time between a write finishing and its event being received,
+	// over the events that weren't dropped for the subscriber falling behind
+	sub := mq.Subscribe(ctx, KVList{})
+	latency := make(chan float64)
+	go func() {
+		total, n := 0.0, 0
+		for ev := range sub.Events {
+			total += Report.FinishTimer(ev.Time)
+			n++
+		}
+		if n > 0 {
+			total /= float64(n)
+		}
+		latency <- total
+	}()
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		i := 1 + rng.Intn(10)%(len(rec)-1)
+		Report.Check(mq.SetKVDocumentUnique(ctx, KVList{[2]string{rec[i][0], gen.Value(rec[i][0])}}, rec[0][1]))
+	}
+	Report.PhaseMetric(provider, "SetKVDocumentUniqueSubscribed", run, st)
+	Report.Metric(provider, "NotificationsDropped", run, float64(sub.Dropped()))
+	sub.Close()
+	Report.Metric(provider, "NotificationLatency", run, <-latency)
+
+	// UpsertDocument -- alternate between existing and new uuids
+	st = Report.StartPhase(&im.Instruments)
+	for i, rec := range ops {
+		randomkv := [2]string{sg.RandomString(10), sg.RandomString(10)}
+		if i%2 == 0 {
+			Report.Check(mq.UpsertDocument(ctx, KVList{rec[0], randomkv}))
+		} else {
+			Report.Check(mq.UpsertDocument(ctx, KVList{[2]string{"uuid", uuid.New()}, randomkv}))
+		}
+	}
+	Report.PhaseMetric(provider, "UpsertDocument", run, st)
 
 	// DeleteKeyDocumentUnique
-	st = Report.StartTimer()
-	for _, rec := range recs {
-		mq.DeleteKeyDocumentUnique(toplevelkeys[:2], rec[0][1])
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		Report.Check(mq.DeleteKeyDocumentUnique(ctx, toplevelkeys[:2], rec[0][1]))
 	}
-	Report.DeltaMetric(provider, "DeleteKeyDocumentUnique", run, st)
+	Report.PhaseMetric(provider, "DeleteKeyDocumentUnique", run, st)
+	explainPhase(ctx, mq, provider, "DeleteKeyDocumentUnique", run, Query{Op: "DeleteKeyDocumentUnique", UUID: sample[0][1]})
 
 	// adjust toplevel keys
 	toplevelkeys = toplevelkeys[2:]
 
 	// DeleteKeyDocumentWhere
-	st = Report.StartTimer()
-	for _, rec := range recs {
-		where := KVList{[2]string{toplevelkeys[rand.Intn(8)], rec[rand.Intn(8)][1]}}
-		mq.DeleteKeyDocumentWhere(toplevelkeys[:2], where)
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		where := docWhere(rng, rec, 2, 8)
+		Report.Check(mq.DeleteKeyDocumentWhere(ctx, toplevelkeys[:2], where))
 	}
-	Report.DeltaMetric(provider, "DeleteKeyDocumentWhere", run, st)
+	Report.PhaseMetric(provider, "DeleteKeyDocumentWhere", run, st)
+	explainPhase(ctx, mq, provider, "DeleteKeyDocumentWhere", run, Query{Op: "DeleteKeyDocumentWhere", Where: samplewhere})
 
 	// adjust toplevel keys
 	toplevelkeys = toplevelkeys[2:]
 
 	// DeleteKeyGlobDocumentUnique
-	st = Report.StartTimer()
-	for _, rec := range recs {
-		mq.DeleteKeyGlobDocumentUnique(string(toplevelkeys[0][0])+".*", rec[0][1])
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		Report.Check(mq.DeleteKeyGlobDocumentUnique(ctx, globOf(toplevelkeys[0]), rec[0][1]))
 	}
-	Report.DeltaMetric(provider, "DeleteKeyGlobDocumentUnique", run, st)
+	Report.PhaseMetric(provider, "DeleteKeyGlobDocumentUnique", run, st)
+	explainPhase(ctx, mq, provider, "DeleteKeyGlobDocumentUnique", run, Query{Op: "DeleteKeyGlobDocumentUnique", UUID: sample[0][1]})
 
 	// adjust again
 	toplevelkeys = toplevelkeys[1:]
 
 	// DeleteKeyGlobDocumentWhere
-	st = Report.StartTimer()
-	for _, rec := range recs {
-		where := KVList{[2]string{toplevelkeys[rand.Intn(5)], rec[rand.Intn(5)][1]}}
-		mq.DeleteKeyGlobDocumentWhere(string(toplevelkeys[0][0])+".*", where)
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		where := docWhere(rng, rec, 5, 5)
+		Report.Check(mq.DeleteKeyGlobDocumentWhere(ctx, globOf(toplevelkeys[0]), where))
 	}
-	Report.DeltaMetric(provider, "DeleteKeyGlobDocumentWhere", run, st)
+	Report.PhaseMetric(provider, "DeleteKeyGlobDocumentWhere", run, st)
+	explainPhase(ctx, mq, provider, "DeleteKeyGlobDocumentWhere", run, Query{Op: "DeleteKeyGlobDocumentWhere", Where: samplewhere})
+
+	// ReplaceDocumentUnique -- restores each document to its generated contents
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range ops {
+		Report.Check(mq.ReplaceDocumentUnique(ctx, rec, rec[0][1]))
+	}
+	Report.PhaseMetric(provider, "ReplaceDocumentUnique", run, st)
+	explainPhase(ctx, mq, provider, "ReplaceDocumentUnique", run, Query{Op: "ReplaceDocumentUnique", UUID: sample[0][1]})
+
+	// DeleteDocumentUnique -- first half of the documents, or half the
+	// operations if there are more documents
+	half := len(recs) / 2
+	if half > spec.Operations/2 {
+		half = spec.Operations / 2
+	}
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range recs[:half] {
+		Report.Check(mq.DeleteDocumentUnique(ctx, rec[0][1]))
+	}
+	Report.PhaseMetric(provider, "DeleteDocumentUnique", run, st)
+	explainPhase(ctx, mq, provider, "DeleteDocumentUnique", run, Query{Op: "DeleteDocumentUnique", UUID: sample[0][1]})
+
+	// DeleteDocumentsWhere -- remaining documents, many at a time, for the
+	// rest of the operations
+	rest := recs[half:]
+	if len(rest) > spec.Operations-half {
+		rest = rest[:spec.Operations-half]
+	}
+	st = Report.StartPhase(&im.Instruments)
+	for _, rec := range rest {
+		Report.Check(mq.DeleteDocumentsWhere(ctx, KVList{[2]string{rec[1][0], rec[1][1]}}))
+	}
+	Report.PhaseMetric(provider, "DeleteDocumentsWhere", run, st)
+	explainPhase(ctx, mq, provider, "DeleteDocumentsWhere", run, Query{Op: "DeleteDocumentsWhere", Where: samplewhere})
+
+	reportDecoratorStats(mq, provider, run)
 }
@@ -1,5 +1,9 @@
 package main
 
+import (
+	"context"
+)
+
 type BosswaveRecord struct {
 	Key      string
 	Allocset int64
@@ -18,25 +22,29 @@ type AllocationSet struct {
 type BosswaveQuery interface {
 
 	//Do any initial config
-	Initialize()
+	Initialize(ctx context.Context) error
+
+	// release whatever Initialize set up, such as connections. Calls made
+	// after Close fail until the provider is initialized again
+	Close() error
 
 	//Get a specific value
-	GetRecord(key string) BosswaveRecord
+	GetRecord(ctx context.Context, key string) (BosswaveRecord, error)
 
 	//Insert a record
-	InsertRecord(r BosswaveRecord)
+	InsertRecord(ctx context.Context, r BosswaveRecord) error
 
 	//Get a list of keys up to a slash
 	//so GetKeysUpToSlash(/foo/bar/) would return /foo/bar/baz
 	//but not /foo/bar/baz/box
-	GetKeysUpToSlash(keyprefix string) []string
+	GetKeysUpToSlash(ctx context.Context, keyprefix string) ([]string, error)
 
 	//Get sum(size) for all records with the given allocation set
-	SumSize(AllocSet int64) int64
+	SumSize(ctx context.Context, AllocSet int64) (int64, error)
 
 	//Create an allocation set
-	CreateAllocSet(r AllocationSet)
+	CreateAllocSet(ctx context.Context, r AllocationSet) error
 
 	//Get the allocation set ID
-	GetAllocSetID(vk VK) int64
+	GetAllocSetID(ctx context.Context, vk VK) (int64, error)
 }
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+// BuildingDocuments are points of building management systems, described the
+// way sMAP and Brick describe them: deep path keys with shared prefixes, a
+// few values such as campuses, buildings and units repeated across thousands
+// of points, and a number of keys that varies from point to point.
+//
+// Buildings are generated one at a time, all of a building's floors, rooms,
+// equipment and points together, and handed out in that order, so documents
+// next to each other usually share most of their values. Building sizes,
+// and the choice of campus and manufacturer, are skewed, as they are in
+// real portfolios
+
+const (
+	bkCampus   = "Metadata/Location/Campus"
+	bkBuilding = "Metadata/Location/Building"
+	bkFloor    = "Metadata/Location/Floor"
+	bkRoom     = "Metadata/Location/Room"
+	bkEquip    = "Metadata/Equipment/Type"
+	bkEquipId  = "Metadata/Equipment/Name"
+	bkPoint    = "Metadata/Point/Type"
+	bkMeasure  = "Metadata/Point/Measure"
+	bkUnit     = "Properties/UnitofMeasure"
+	bkPath     = "Path"
+)
+
+var buildingKeys = []string{bkCampus, bkBuilding, bkFloor, bkRoom, bkEquip, bkEquipId, bkPoint, bkMeasure, bkUnit, bkPath}
+
+var (
+	campusNames = []string{"Berkeley", "Richmond Field Station", "Oakland Medical Center", "San Francisco Mission Bay", "Davis"}
+	timezones   = []string{"America/Los_Angeles", "America/Los_Angeles", "America/Denver", "America/Chicago", "America/New_York"}
+
+	buildingFirst  = []string{"Soda", "Cory", "Sutardja Dai", "Evans", "Hearst", "Etcheverry", "Stanley", "Tan", "Latimer", "Hildebrand", "Barrows", "Dwinelle", "Wheeler", "Haviland", "Moffitt", "Doe", "Bechtel", "Jacobs", "McCone", "Valley"}
+	buildingSecond = []string{"Hall", "Hall", "Hall", "Building", "Center", "Library", "Annex", "Laboratory"}
+
+	manufacturers = []string{"Siemens", "Johnson Controls", "Honeywell", "Schneider Electric", "Automated Logic", "Trane", "Carrier", "Delta Controls"}
+	sources       = []string{"BACnet", "Modbus", "OPC UA", "LonWorks"}
+	readingTypes  = []string{"double", "double", "double", "long", "string"}
+)
+
+// a kind of point: its Brick class, what it measures and in what unit, and
+// the abbreviation in its path
+type pointKind struct {
+	Type, Measure, Unit, Brick, Abbrev string
+}
+
+// a kind of equipment and the points it has. Points past Required are each
+// present or not at random
+type equipKind struct {
+	Type, Abbrev, System string
+	Required             int
+	Points               []pointKind
+}
+
+var (
+	ptZoneTemp   = pointKind{"Sensor", "Temperature", "degF", "Zone_Air_Temperature_Sensor", "ZNT"}
+	ptZoneSp     = pointKind{"Setpoint", "Temperature", "degF", "Zone_Air_Temperature_Setpoint", "ZNT-SP"}
+	ptAirflow    = pointKind{"Sensor", "Air Flow", "cfm", "Supply_Air_Flow_Sensor", "SAF"}
+	ptAirflowSp  = pointKind{"Setpoint", "Air Flow", "cfm", "Supply_Air_Flow_Setpoint", "SAF-SP"}
+	ptDamper     = pointKind{"Command", "Position", "%", "Damper_Position_Command", "DMP"}
+	ptReheat     = pointKind{"Command", "Position", "%", "Valve_Command", "RHV"}
+	ptOccupancy  = pointKind{"Sensor", "Occupancy", "binary", "Occupancy_Sensor", "OCC"}
+	ptCO2        = pointKind{"Sensor", "CO2", "ppm", "CO2_Level_Sensor", "CO2"}
+	ptSupplyTemp = pointKind{"Sensor", "Temperature", "degF", "Supply_Air_Temperature_Sensor", "SAT"}
+	ptSupplySp   = pointKind{"Setpoint", "Temperature", "degF", "Supply_Air_Temperature_Setpoint", "SAT-SP"}
+	ptReturnTemp = pointKind{"Sensor", "Temperature", "degF", "Return_Air_Temperature_Sensor", "RAT"}
+	ptMixedTemp  = pointKind{"Sensor", "Temperature", "degF", "Mixed_Air_Temperature_Sensor", "MAT"}
+	ptOutsideAir = pointKind{"Sensor", "Temperature", "degF", "Outside_Air_Temperature_Sensor", "OAT"}
+	ptFanSpeed   = pointKind{"Command", "Speed", "%", "Fan_Speed_Command", "SF-VFD"}
+	ptFanStatus  = pointKind{"Status", "On/Off", "binary", "Fan_Status", "SF-S"}
+	ptPressure   = pointKind{"Sensor", "Pressure", "inH2O", "Supply_Air_Static_Pressure_Sensor", "SAP"}
+	ptPressureSp = pointKind{"Setpoint", "Pressure", "inH2O", "Supply_Air_Static_Pressure_Setpoint", "SAP-SP"}
+	ptWaterSup   = pointKind{"Sensor", "Temperature", "degF", "Chilled_Water_Supply_Temperature_Sensor", "CHWST"}
+	ptWaterRet   = pointKind{"Sensor", "Temperature", "degF", "Chilled_Water_Return_Temperature_Sensor", "CHWRT"}
+	ptWaterFlow  = pointKind{"Sensor", "Water Flow", "gpm", "Water_Flow_Sensor", "CHWF"}
+	ptHotSup     = pointKind{"Sensor", "Temperature", "degF", "Hot_Water_Supply_Temperature_Sensor", "HWST"}
+	ptPumpStatus = pointKind{"Status", "On/Off", "binary", "Pump_Status", "P-S"}
+	ptPumpSpeed  = pointKind{"Command", "Speed", "%", "Pump_Speed_Command", "P-VFD"}
+	ptPower      = pointKind{"Sensor", "Power", "kW", "Electric_Power_Sensor", "KW"}
+	ptEnergy     = pointKind{"Sensor", "Energy", "kWh", "Electric_Energy_Sensor", "KWH"}
+	ptVoltage    = pointKind{"Sensor", "Voltage", "V", "Voltage_Sensor", "V"}
+	ptCurrent    = pointKind{"Sensor", "Current", "A", "Current_Sensor", "A"}
+	ptLightLevel = pointKind{"Sensor", "Illuminance", "lux", "Illuminance_Sensor", "LUX"}
+	ptLightCmd   = pointKind{"Command", "On/Off", "binary", "Luminaire_Command", "LT-C"}
+)
+
+var (
+	equipVAV      = equipKind{"VAV", "VAV", "HVAC", 3, []pointKind{ptZoneTemp, ptZoneSp, ptAirflow, ptAirflowSp, ptDamper, ptReheat, ptOccupancy, ptCO2}}
+	equipFCU      = equipKind{"FCU", "FCU", "HVAC", 2, []pointKind{ptZoneTemp, ptZoneSp, ptFanStatus, ptFanSpeed, ptReheat}}
+	equipLighting = equipKind{"Lighting", "LT", "Lighting", 1, []pointKind{ptLightCmd, ptLightLevel, ptOccupancy}}
+	equipAHU      = equipKind{"AHU", "AHU", "HVAC", 5, []pointKind{ptSupplyTemp, ptSupplySp, ptReturnTemp, ptMixedTemp, ptFanSpeed, ptFanStatus, ptPressure, ptPressureSp, ptOutsideAir, ptCO2}}
+	equipChiller  = equipKind{"Chiller", "CH", "HVAC", 3, []pointKind{ptWaterSup, ptWaterRet, ptWaterFlow, ptPower, ptPumpStatus}}
+	equipBoiler   = equipKind{"Boiler", "B", "HVAC", 1, []pointKind{ptHotSup, ptPumpStatus, ptPumpSpeed}}
+	equipPump     = equipKind{"Pump", "P", "HVAC", 1, []pointKind{ptPumpStatus, ptPumpSpeed, ptWaterFlow}}
+	equipMeter    = equipKind{"Electric Meter", "EM", "Electrical", 2, []pointKind{ptPower, ptEnergy, ptVoltage, ptCurrent}}
+)
+
+// equipment each room may have, most rooms having a VAV
+var roomEquipment = []struct {
+	kind   equipKind
+	chance float64
+}{{equipVAV, 0.85}, {equipFCU, 0.1}, {equipLighting, 0.5}}
+
+// equipment serving a whole building, and how many of each at most
+var plantEquipment = []struct {
+	kind equipKind
+	max  int
+}{{equipAHU, 6}, {equipChiller, 2}, {equipBoiler, 2}, {equipPump, 4}, {equipMeter, 3}}
+
+type BuildingDocuments struct {
+	rng *rand.Rand
+	// how many campuses the buildings are spread over
+	campuses int
+	// the names and codes of the buildings generated so far
+	buildings map[string]bool
+	codes     map[string]bool
+	// the documents of the last building that haven't been handed out
+	pending []KVList
+}
+
+func NewBuildingDocuments(rng *rand.Rand) *BuildingDocuments {
+	return &BuildingDocuments{
+		rng:       rng,
+		campuses:  1 + rng.Intn(len(campusNames)),
+		buildings: map[string]bool{},
+		codes:     map[string]bool{},
+	}
+}
+
+func (g *BuildingDocuments) Keys() []string {
+	return buildingKeys
+}
+
+func (g *BuildingDocuments) Generate(count int) []KVList {
+	docs := make([]KVList, 0, count)
+	for len(docs) < count {
+		if len(g.pending) == 0 {
+			g.pending = g.building()
+		}
+		n := count - len(docs)
+		if n > len(g.pending) {
+			n = len(g.pending)
+		}
+		docs = append(docs, g.pending[:n]...)
+		g.pending = g.pending[n:]
+	}
+	return docs
+}
+
+func (g *BuildingDocuments) Value(key string) string {
+	switch key {
+	case bkCampus:
+		return campusNames[g.skewed(g.campuses)]
+	case bkBuilding:
+		return g.buildingName()
+	case bkFloor:
+		return fmt.Sprintf("Floor %d", 1+g.rng.Intn(8))
+	case bkRoom:
+		return fmt.Sprintf("%d%02d", 1+g.rng.Intn(8), 1+g.rng.Intn(40))
+	case bkEquip:
+		return plantEquipment[g.rng.Intn(len(plantEquipment))].kind.Type
+	case bkEquipId:
+		return fmt.Sprintf("VAV-%d", 1+g.rng.Intn(200))
+	case bkPath:
+		return fmt.Sprintf("/%s/VAV-%d/ZNT", initials(g.buildingName()), 1+g.rng.Intn(200))
+	}
+	p := g.anyPoint()
+	switch key {
+	case bkPoint:
+		return p.Type
+	case bkMeasure:
+		return p.Measure
+	}
+	return p.Unit
+}
+
+// an index below n, skewed towards 0 as a Zipf distribution with exponent 1
+// would be
+func (g *BuildingDocuments) skewed(n int) int {
+	// the inverse of the CDF of 1/x over [1, n+1)
+	return int(math.Exp(g.rng.Float64()*math.Log(float64(n+1)))) - 1
+}
+
+func (g *BuildingDocuments) anyPoint() pointKind {
+	kinds := []equipKind{equipVAV, equipAHU, equipMeter, equipLighting}
+	k := kinds[g.rng.Intn(len(kinds))]
+	return k.Points[g.rng.Intn(len(k.Points))]
+}
+
+func (g *BuildingDocuments) buildingName() string {
+	return buildingFirst[g.skewed(len(buildingFirst))] + " " + buildingSecond[g.rng.Intn(len(buildingSecond))]
+}
+
+func initials(name string) string {
+	code := ""
+	for _, w := range strings.Fields(name) {
+		code += strings.ToUpper(w[:1])
+	}
+	return code
+}
+
+// a short code for a new building, as its points' paths start with: the
+// initials of its name, numbered if another building has them
+func (g *BuildingDocuments) buildingCode(name string) string {
+	code := initials(name)
+	for i := 2; g.codes[code]; i++ {
+		code = fmt.Sprintf("%s%d", initials(name), i)
+	}
+	g.codes[code] = true
+	return code
+}
+
+// the documents of every point of a new building
+func (g *BuildingDocuments) building() []KVList {
+	base := g.buildingName()
+	name := base
+	for i := 2; g.buildings[name]; i++ {
+		name = fmt.Sprintf("%s %d", base, i)
+	}
+	g.buildings[name] = true
+	code := g.buildingCode(name)
+	c := g.skewed(g.campuses)
+	b := building{
+		g:        g,
+		campus:   campusNames[c],
+		timezone: timezones[c],
+		name:     name,
+		code:     code,
+		// most buildings use one vendor's controls and one protocol
+		manufacturer: manufacturers[g.skewed(len(manufacturers))],
+		source:       fmt.Sprintf("%s %s", code, sources[g.skewed(len(sources))]),
+		models:       map[string]string{},
+	}
+
+	// sizes are exponential: many small buildings, a few large ones
+	floors := 1 + int(math.Min(g.rng.ExpFloat64()*3, 11))
+	rooms := 4 + int(math.Min(g.rng.ExpFloat64()*10, 56))
+
+	plant := map[string][]string{}
+	for _, pe := range plantEquipment {
+		for i := 0; i < g.rng.Intn(pe.max+1); i++ {
+			id := fmt.Sprintf("%s-%d", pe.kind.Abbrev, i+1)
+			plant[pe.kind.Type] = append(plant[pe.kind.Type], id)
+			b.equipment(pe.kind, id, "Basement", "Mechanical Room", "")
+		}
+	}
+	vav := 0
+	for f := 1; f <= floors; f++ {
+		floor := fmt.Sprintf("Floor %d", f)
+		for r := 1; r <= rooms; r++ {
+			room := fmt.Sprintf("%d%02d", f, r)
+			for _, re := range roomEquipment {
+				if g.rng.Float64() >= re.chance {
+					continue
+				}
+				id := fmt.Sprintf("%s-%s", re.kind.Abbrev, room)
+				if re.kind.Type == "VAV" {
+					vav++
+					id = fmt.Sprintf("VAV-%d", vav)
+				}
+				// which air handler feeds the terminal unit, if the
+				// building has any
+				feeds := ""
+				if ahus := plant["AHU"]; len(ahus) > 0 && re.kind.System == "HVAC" {
+					feeds = ahus[(f-1)*len(ahus)/floors]
+				}
+				b.equipment(re.kind, id, floor, room, feeds)
+			}
+		}
+	}
+	return b.docs
+}
+
+// a building being generated
+type building struct {
+	g                            *BuildingDocuments
+	campus, timezone, name, code string
+	manufacturer, source         string
+	// the model number of each kind of equipment in the building
+	models map[string]string
+	docs   []KVList
+}
+
+// a key some points have, with the chance that a point has it
+type optionalKey struct {
+	chance float64
+	kv     [2]string
+}
+
+// add the documents of the points of one piece of equipment
+func (b *building) equipment(kind equipKind, id, floor, room, feeds string) {
+	g := b.g
+	model, found := b.models[kind.Type]
+	if !found {
+		model = fmt.Sprintf("%s-%s%d", strings.ToUpper(b.manufacturer[:2]), kind.Abbrev, 100+g.rng.Intn(900))
+		b.models[kind.Type] = model
+	}
+	for i, p := range kind.Points {
+		if i >= kind.Required && g.rng.Intn(2) == 0 {
+			continue
+		}
+		path := fmt.Sprintf("/%s/%s/%s", b.code, id, p.Abbrev)
+		doc := KVList{
+			{"uuid", uuid.New()},
+			{bkCampus, b.campus},
+			{bkBuilding, b.name},
+			{bkFloor, floor},
+			{bkRoom, room},
+			{bkEquip, kind.Type},
+			{bkEquipId, id},
+			{bkPoint, p.Type},
+			{bkMeasure, p.Measure},
+			{bkUnit, p.Unit},
+			{bkPath, path},
+		}
+		// keys only some points have, as real metadata is filled in
+		// unevenly
+		optional := []optionalKey{
+			{0.9, [2]string{"Properties/Timezone", b.timezone}},
+			{0.8, [2]string{"Properties/ReadingType", readingTypes[g.rng.Intn(len(readingTypes))]}},
+			{0.7, [2]string{"Metadata/Brick/Class", p.Brick}},
+			{0.6, [2]string{"Metadata/System", kind.System}},
+			{0.6, [2]string{"Metadata/SourceName", b.source}},
+			{0.5, [2]string{"Metadata/Instrument/Manufacturer", b.manufacturer}},
+			{0.3, [2]string{"Metadata/Instrument/Model", model}},
+			{0.2, [2]string{"Metadata/Description", fmt.Sprintf("%s %s %s", b.code, id, strings.Replace(p.Brick, "_", " ", -1))}},
+		}
+		if feeds != "" {
+			optional = append(optional, optionalKey{0.5, [2]string{"Metadata/Equipment/FedBy", feeds}})
+		}
+		for _, o := range optional {
+			if g.rng.Float64() < o.chance {
+				doc = append(doc, o.kv)
+			}
+		}
+		b.docs = append(b.docs, doc)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A ChangeFeed is an in-process event bus for metadata changes. Providers
+// embed one and report every write through it; Subscribe hands out channels of
+// the resulting events. Only writes made through the same provider value are
+// seen, so clients that need to observe each other must share a provider.
+// When nobody is subscribed and no history is recorded, tracking a write costs
+// a mutex and nothing else
+
+type ChangeKind int
+
+const (
+	ChangeInsert ChangeKind = iota
+	ChangeSet
+	ChangeDeleteKey
+	ChangeDeleteDocument
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeInsert:
+		return "insert"
+	case ChangeSet:
+		return "set"
+	case ChangeDeleteKey:
+		return "delete-key"
+	case ChangeDeleteDocument:
+		return "delete-document"
+	}
+	return "unknown"
+}
+
+type ChangeEvent struct {
+	Kind ChangeKind
+	UUID string
+	// the document before the change, nil for inserts
+	Before KVList
+	// the document after the change, nil for document deletes
+	After KVList
+	// when the write finished
+	Time time.Time
+}
+
+// how many events may queue up for a subscriber before further ones are dropped
+const subscriptionBuffer = 1024
+
+type Subscription struct {
+	// delivers the events for every changed document that matched the where
+	// clause before or after the change. Closed by Close
+	Events <-chan ChangeEvent
+
+	events chan ChangeEvent
+	where  KVList
+	feed   *ChangeFeed
+	// events dropped because the buffer was full, guarded by the feed's lock
+	dropped int
+	// closed first thing in Close, to end the goroutine watching ctx
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type ChangeFeed struct {
+	lock sync.Mutex
+	subs []*Subscription
+	// if set, called with every change whether or not anyone is subscribed
+	record func(ev ChangeEvent) error
+}
+
+// subscribe to changes of documents matching a where clause; an empty where
+// clause matches every document. Writers never wait on a subscriber: an event
+// for a subscriber whose buffer is full is dropped, and counted in Dropped.
+// The subscription is closed when ctx is done, or by Close
+func (f *ChangeFeed) Subscribe(ctx context.Context, where KVList) *Subscription {
+	events := make(chan ChangeEvent, subscriptionBuffer)
+	sub := &Subscription{Events: events, events: events, where: where, feed: f, done: make(chan struct{})}
+	f.lock.Lock()
+	f.subs = append(f.subs, sub)
+	f.lock.Unlock()
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				sub.Close()
+			case <-sub.done:
+			}
+		}()
+	}
+	return sub
+}
+
+// stop receiving events and close the Events channel
+func (s *Subscription) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+	f := s.feed
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for i, sub := range f.subs {
+		if sub == s {
+			f.subs = append(f.subs[:i], f.subs[i+1:]...)
+			close(s.events)
+			return
+		}
+	}
+}
+
+// how many events were dropped because the subscriber fell behind
+func (s *Subscription) Dropped() int {
+	s.feed.lock.Lock()
+	defer s.feed.lock.Unlock()
+	return s.dropped
+}
+
+func (f *ChangeFeed) active() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.subs) > 0 || f.record != nil
+}
+
+// deliver an event to the subscribers it concerns, without waiting for any of
+// them. A failure to record it is returned after delivery, so subscribers see
+// the change either way
+func (f *ChangeFeed) publish(ev ChangeEvent) error {
+	var err error
+	if f.record != nil {
+		err = f.record(ev)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, sub := range f.subs {
+		if kvMatches(ev.Before, sub.where) || kvMatches(ev.After, sub.where) {
+			select {
+			case sub.events <- ev:
+			default:
+				sub.dropped++
+			}
+		}
+	}
+	return err
+}
+
+// whether doc holds every k/v pair of the where clause
+func kvMatches(doc KVList, where KVList) bool {
+	if doc == nil {
+		return false
+	}
+	for _, kv := range where {
+		if val, found := doc.Get(kv[0]); !found || val != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// the reads a ChangeTracker makes to see what a write changes. They are the
+// provider's own, made from inside the write, so they run under the write's
+// context rather than taking one of their own
+type feedReader interface {
+	getDocumentSetWhere(where KVList) ([]KVList, error)
+	getDocumentSetValueGlob(key, value_glob string) ([]KVList, error)
+}
+
+// the documents a write is about to change, captured before it runs
+type ChangeTracker struct {
+	feed   *ChangeFeed
+	mq     feedReader
+	kind   ChangeKind
+	uuids  []string
+	before map[string]KVList
+	// why the documents couldn't be read before the write, if they couldn't
+	err error
+}
+
+// start tracking a write of the given kind made through mq. selected returns
+// the documents the write will change, and uuids names further documents by
+// uuid, which need not exist yet, as when they are being inserted. Returns
+// nil, which Publish ignores, when there is no one to tell
+func (f *ChangeFeed) Track(mq feedReader, kind ChangeKind, selected func() ([]KVList, error), uuids ...string) *ChangeTracker {
+	if !f.active() {
+		return nil
+	}
+	t := &ChangeTracker{feed: f, mq: mq, kind: kind, before: map[string]KVList{}}
+	if selected != nil {
+		docs, err := selected()
+		if err != nil {
+			t.err = err
+			return t
+		}
+		for _, doc := range docs {
+			t.add(documentUUIDs([]KVList{doc}), doc)
+		}
+	}
+	for _, uuid := range uuids {
+		if _, seen := t.before[uuid]; !seen {
+			doc, err := t.current(uuid)
+			if err != nil {
+				t.err = err
+				return t
+			}
+			t.add([]string{uuid}, doc)
+		}
+	}
+	return t
+}
+
+func (t *ChangeTracker) add(uuids []string, doc KVList) {
+	for _, uuid := range uuids {
+		if _, seen := t.before[uuid]; !seen {
+			t.uuids = append(t.uuids, uuid)
+			t.before[uuid] = doc
+		}
+	}
+}
+
+// the document with the given uuid, or nil if there is none
+func (t *ChangeTracker) current(uuid string) (KVList, error) {
+	docs, err := t.mq.getDocumentSetWhere(KVList{[2]string{"uuid", uuid}})
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+	return docs[0], nil
+}
+
+// publish one event per tracked document, re-reading each to find its state
+// after the write. A document that didn't exist before is reported as an
+// insert, and documents that exist neither before nor after are skipped.
+// Meant to be deferred by the write with a pointer to its error result: if
+// the write succeeded but its changes couldn't be read or recorded, that
+// becomes the write's error, since subscribers and history have missed it
+func (t *ChangeTracker) Publish(err *error) {
+	if t == nil {
+		return
+	}
+	fail := func(e error) {
+		if *err == nil {
+			*err = fmt.Errorf("Error tracking changes: %v", e)
+		}
+	}
+	if t.err != nil {
+		fail(t.err)
+		return
+	}
+	now := time.Now()
+	for _, uuid := range t.uuids {
+		ev := ChangeEvent{Kind: t.kind, UUID: uuid, Before: t.before[uuid], Time: now}
+		if t.kind != ChangeDeleteDocument {
+			after, e := t.current(uuid)
+			if e != nil {
+				fail(e)
+				return
+			}
+			ev.After = after
+		}
+		if ev.Before == nil && ev.After == nil {
+			continue
+		}
+		if ev.Before == nil {
+			ev.Kind = ChangeInsert
+		}
+		if e := t.feed.publish(ev); e != nil {
+			fail(e)
+		}
+	}
+}
+
+// the documents a batch is about to change, for Track
+func batchDocuments(mq feedReader, batch *MetadataBatch) ([]KVList, error) {
+	ret := []KVList{}
+	for _, op := range batch.Ops {
+		if op.Select.Key == "" {
+			docs, err := mq.getDocumentSetWhere(op.Select.Where)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, docs...)
+			continue
+		}
+		docs, err := mq.getDocumentSetValueGlob(op.Select.Key, op.Select.ValueGlob)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			if kvMatches(doc, op.Select.Where) {
+				ret = append(ret, doc)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// the kind of change a batch makes: a set if any of its operations sets k/v
+// pairs, otherwise a key delete
+func batchChangeKind(batch *MetadataBatch) ChangeKind {
+	for _, op := range batch.Ops {
+		if op.Kind == BatchSetKV {
+			return ChangeSet
+		}
+	}
+	return ChangeDeleteKey
+}
+
+// the uuids of a list of documents
+func documentUUIDs(docs []KVList) []string {
+	ret := []string{}
+	for _, doc := range docs {
+		if uuid, found := doc.Get("uuid"); found {
+			ret = append(ret, uuid)
+		}
+	}
+	return ret
+}
+
+// the uuids named by a list of updates
+func updateUUIDs(updates []DocumentUpdate) []string {
+	ret := []string{}
+	for _, update := range updates {
+		ret = append(ret, update.UUID)
+	}
+	return ret
+}
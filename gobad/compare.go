@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// gobad compare: compares the metrics of two results, as written by the json
+// or jsonl sinks, and exits with status 1 if any got significantly worse.
+// Metrics are matched by provider, id and iteration, and each provider's
+// metric is compared over the iterations both results have, by the change in
+// its median and a Mann-Whitney U test. Lower values are better, except for
+// cache hit counts
+
+// read a result written by the json or jsonl sink
+func LoadReport(path string) (*Reporter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := &Reporter{}
+	if !strings.HasSuffix(path, ".jsonl") {
+		if err := json.NewDecoder(f).Decode(r); err != nil {
+			return nil, fmt.Errorf("Could not read %s: %v", path, err)
+		}
+		return r, nil
+	}
+	// metrics, then the rest of the report on the last line
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var line json.RawMessage
+		if err := dec.Decode(&line); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not read %s: %v", path, err)
+		}
+		var summary struct {
+			Ok *bool `json:"ok"`
+		}
+		if err := json.Unmarshal(line, &summary); err != nil {
+			return nil, fmt.Errorf("Could not read %s: %v", path, err)
+		}
+		if summary.Ok != nil {
+			metrics := r.VAL_Metrics
+			if err := json.Unmarshal(line, r); err != nil {
+				return nil, fmt.Errorf("Could not read %s: %v", path, err)
+			}
+			r.VAL_Metrics = metrics
+			continue
+		}
+		var p BPoint
+		if err := json.Unmarshal(line, &p); err != nil {
+			return nil, fmt.Errorf("Could not read %s: %v", path, err)
+		}
+		r.VAL_Metrics = append(r.VAL_Metrics, p)
+	}
+	return r, nil
+}
+
+// a provider's metric, across iterations
+type seriesKey struct {
+	Provider string
+	Id       string
+}
+
+// the values of every metric by iteration. A metric reported twice in the
+// same iteration keeps its last value
+func seriesByIteration(r *Reporter) map[seriesKey]map[int]float64 {
+	ret := map[seriesKey]map[int]float64{}
+	for _, p := range r.VAL_Metrics {
+		k := seriesKey{p.Provider, p.Id}
+		if ret[k] == nil {
+			ret[k] = map[int]float64{}
+		}
+		ret[k][p.Iteration] = p.Value
+	}
+	return ret
+}
+
+// whether a bigger value of a metric is an improvement
+func higherIsBetter(id string) bool {
+	return strings.HasSuffix(id, "Hits")
+}
+
+type Comparison struct {
+	seriesKey
+	// iterations in both results
+	N        int
+	Old, New float64 // medians
+	// (New - Old) / Old, signed so that a positive change is always worse
+	Change float64
+	P      float64
+}
+
+func (c Comparison) Regression() bool {
+	return c.Change > 0
+}
+
+// compare every metric the two results share. Metrics with no iterations in
+// common are left out, and counted in the second and third results
+func CompareReports(before, after *Reporter) (comparisons []Comparison, onlyOld, onlyNew int) {
+	olds, news := seriesByIteration(before), seriesByIteration(after)
+	for k, ov := range olds {
+		nv, found := news[k]
+		if !found {
+			onlyOld++
+			continue
+		}
+		a, b := []float64{}, []float64{}
+		for it, v := range ov {
+			if w, found := nv[it]; found {
+				a = append(a, v)
+				b = append(b, w)
+			}
+		}
+		if len(a) == 0 {
+			onlyOld++
+			continue
+		}
+		c := Comparison{seriesKey: k, N: len(a), Old: median(a), New: median(b), P: mannWhitney(a, b)}
+		switch {
+		case c.Old != 0:
+			c.Change = (c.New - c.Old) / math.Abs(c.Old)
+		case c.New != 0:
+			c.Change = math.Copysign(math.Inf(1), c.New)
+		}
+		if higherIsBetter(k.Id) {
+			c.Change = -c.Change
+		}
+		comparisons = append(comparisons, c)
+	}
+	for k := range news {
+		if _, found := olds[k]; !found {
+			onlyNew++
+		}
+	}
+	sort.Slice(comparisons, func(i, j int) bool {
+		if comparisons[i].Change != comparisons[j].Change {
+			return comparisons[i].Change > comparisons[j].Change
+		}
+		if comparisons[i].Provider != comparisons[j].Provider {
+			return comparisons[i].Provider < comparisons[j].Provider
+		}
+		return comparisons[i].Id < comparisons[j].Id
+	})
+	return
+}
+
+// run gobad compare with the arguments after "compare", returning the exit status
+func compareMain(args []string) int {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	threshold := fs.Float64("threshold", 0.05, "smallest relative change of a median to report")
+	alpha := fs.Float64("alpha", 0.05, "significance level of the Mann-Whitney test")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: gobad compare [flags] old.json new.json\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	before, err := LoadReport(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	after, err := LoadReport(fs.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	for _, r := range []struct {
+		path string
+		rep  *Reporter
+	}{{fs.Arg(0), before}, {fs.Arg(1), after}} {
+		if !r.rep.VAL_Ok {
+			fmt.Fprintf(os.Stderr, "warning: %s is from a run that failed: %s\n", r.path, r.rep.VAL_FatalMsg)
+		}
+	}
+
+	comparisons, onlyOld, onlyNew := CompareReports(before, after)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "\tprovider\tid\tn\told\tnew\tchange\tp")
+	regressions, improvements := 0, 0
+	for _, c := range comparisons {
+		if math.Abs(c.Change) < *threshold || c.P >= *alpha {
+			continue
+		}
+		verdict := "improvement"
+		if c.Regression() {
+			verdict = "REGRESSION"
+			regressions++
+		} else {
+			improvements++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%.4g\t%.4g\t%+.1f%%\t%.3g\n", verdict, c.Provider, c.Id, c.N, c.Old, c.New, 100*c.Change, c.P)
+	}
+	w.Flush()
+	fmt.Printf("\n%d metrics compared: %d regressions, %d improvements at least %.1f%% with p < %g\n",
+		len(comparisons), regressions, improvements, 100**threshold, *alpha)
+	if onlyOld > 0 || onlyNew > 0 {
+		fmt.Printf("%d metrics only in %s, %d only in %s\n", onlyOld, fs.Arg(0), onlyNew, fs.Arg(1))
+	}
+	if regressions > 0 {
+		return 1
+	}
+	return 0
+}
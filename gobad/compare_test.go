@@ -0,0 +1,135 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// a report with one value per iteration of each provider's metric
+func testReport(series map[seriesKey][]float64) *Reporter {
+	r := &Reporter{VAL_Ok: true}
+	for k, vs := range series {
+		for i, v := range vs {
+			r.VAL_Metrics = append(r.VAL_Metrics, BPoint{Id: k.Id, Provider: k.Provider, Iteration: i, Value: v})
+		}
+	}
+	return r
+}
+
+func TestCompareReports(t *testing.T) {
+	slower := seriesKey{"mongo", "GetDocumentsWhere"}
+	same := seriesKey{"mongo", "InsertDocument"}
+	hits := seriesKey{"mongo", "CacheHits"}
+	gone := seriesKey{"mongo", "DeleteDocumentWhere"}
+	added := seriesKey{"exploded", "InsertDocument"}
+	before := testReport(map[seriesKey][]float64{
+		slower: {10, 11, 12, 13, 14, 15, 16, 17},
+		same:   {5, 5, 5, 5},
+		hits:   {100, 100},
+		gone:   {1},
+	})
+	after := testReport(map[seriesKey][]float64{
+		slower: {20, 21, 22, 23, 24, 25, 26, 27},
+		same:   {5, 5, 5, 5, 9},
+		hits:   {50, 50},
+		added:  {1},
+	})
+	cs, onlyOld, onlyNew := CompareReports(before, after)
+	if onlyOld != 1 || onlyNew != 1 {
+		t.Errorf("got %d only in old and %d only in new, want 1 and 1", onlyOld, onlyNew)
+	}
+	got := map[seriesKey]Comparison{}
+	order := []seriesKey{}
+	for _, c := range cs {
+		got[c.seriesKey] = c
+		order = append(order, c.seriesKey)
+	}
+	// the worst change first
+	if want := []seriesKey{slower, hits, same}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("got comparisons in order %v, want %v", order, want)
+	}
+
+	c := got[slower]
+	if c.N != 8 || c.Old != 13.5 || c.New != 23.5 || !c.Regression() || c.P > 0.01 {
+		t.Errorf("slower metric: got %+v", c)
+	}
+	if math.Abs(c.Change-10/13.5) > 1e-9 {
+		t.Errorf("slower metric: got change %v, want %v", c.Change, 10/13.5)
+	}
+	// fewer cache hits is worse
+	if c := got[hits]; c.Change != 0.5 || !c.Regression() {
+		t.Errorf("cache hits: got %+v", c)
+	}
+	// only iterations in both are compared, so the extra slow one is left out
+	if c := got[same]; c.N != 4 || c.Change != 0 || c.Regression() || c.P != 1 {
+		t.Errorf("unchanged metric: got %+v", c)
+	}
+}
+
+func TestCompareReportsFromZero(t *testing.T) {
+	k := seriesKey{"mongo", "Faults.GaveUp"}
+	cs, _, _ := CompareReports(
+		testReport(map[seriesKey][]float64{k: {0, 0}}),
+		testReport(map[seriesKey][]float64{k: {0, 3}}))
+	if len(cs) != 1 || !math.IsInf(cs[0].Change, 1) {
+		t.Errorf("got %+v, want an infinite regression", cs)
+	}
+}
+
+// both result formats read back as the report that was written
+func TestLoadReport(t *testing.T) {
+	points := []BPoint{
+		{Id: "InsertDocument", Provider: "mongo", Iteration: 0, Value: 1.5},
+		{Id: "InsertDocument", Provider: "mongo", Iteration: 1, Value: 2.5},
+	}
+	dir := t.TempDir()
+	for _, name := range []string{"result.json", "result.jsonl"} {
+		path := filepath.Join(dir, name)
+		r := &Reporter{VAL_Ok: true, VAL_Start: 1, VAL_End: 2}
+		s, err := OpenSink(name[len("result."):], path, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range points {
+			r.VAL_Metrics = append(r.VAL_Metrics, p)
+			if err := s.WriteMetrics([]BPoint{p}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Close(r); err != nil {
+			t.Fatal(err)
+		}
+		got, err := LoadReport(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.VAL_Ok || got.VAL_Start != 1 || got.VAL_End != 2 || !reflect.DeepEqual(got.VAL_Metrics, points) {
+			t.Errorf("%s: got %+v", name, got)
+		}
+	}
+}
+
+// a run that dies between phases still leaves its metrics and what it was
+// running in a json result
+func TestLoadReportUnfinished(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "result.json")
+	p := BPoint{Id: "InsertDocument", Provider: "mongo", Value: 1.5}
+	r := &Reporter{VAL_Ok: true, VAL_Start: 1, VAL_Metrics: []BPoint{p}, VAL_Run: RunInfo{Hostname: "bench"}}
+	if err := NewJSONSink(path, r).WriteMetrics([]BPoint{p}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadReport(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.VAL_Ok || got.VAL_FatalMsg == "" || got.VAL_Start != 1 || got.VAL_Run.Hostname != "bench" ||
+		!reflect.DeepEqual(got.VAL_Metrics, []BPoint{p}) {
+		t.Errorf("got %+v", got)
+	}
+	// the run itself goes on as it was
+	if !r.VAL_Ok || r.VAL_FatalMsg != "" {
+		t.Errorf("the report was changed: %+v", r)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"unicode/utf8"
+)
+
+// A DocumentGenerator makes the documents a workload runs on. Every document
+// starts with its uuid, followed by at least one key. The phases pick keys
+// from the first ten of a document by position, so documents should put the
+// keys of Keys they have first, in order
+type DocumentGenerator interface {
+	// the keys most documents have, which the phases build where clauses
+	// from. There must be at least ten, though they needn't all differ
+	Keys() []string
+
+	// count new documents, each with a fresh uuid
+	Generate(count int) []KVList
+
+	// a value that key could be set to, for the phases that overwrite values
+	Value(key string) string
+}
+
+// the datasets NewDocumentGenerator knows
+var Datasets = []string{"random", "building", "import"}
+
+// a generator of the named dataset, drawing from rng. sg is the generator the
+// workload takes its own random strings from, so that a dataset made of
+// random strings can keep clear of them
+func NewDocumentGenerator(dataset string, rng *rand.Rand, sg *StringGenerator) (DocumentGenerator, error) {
+	switch dataset {
+	case "random":
+		return NewRandomDocuments(rng, sg), nil
+	case "building":
+		return NewBuildingDocuments(rng), nil
+	case "import":
+		if ImportedMetadata == nil {
+			return nil, fmt.Errorf("The import dataset needs dumps to load")
+		}
+		return NewImportedDocuments(ImportedMetadata, rng), nil
+	}
+	return nil, fmt.Errorf("Unknown dataset %q", dataset)
+}
+
+// a glob that matches s and others like it: everything up to and including
+// the last / of a path, or else the first character. Imported values can hold
+// anything, so the part kept is escaped
+func globOf(s string) string {
+	if i := strings.LastIndex(s, "/"); i >= 0 {
+		return escapeGlob(s[:i+1]) + "*"
+	}
+	_, size := utf8.DecodeRuneInString(s)
+	return escapeGlob(s[:size]) + "*"
+}
+
+//== random
+
+// RandomDocuments are the original benchmark documents: ten random 10
+// character keys, each set to one of ten random 10 character values
+type RandomDocuments struct {
+	rng    *rand.Rand
+	keys   []string
+	values []string
+}
+
+func NewRandomDocuments(rng *rand.Rand, sg *StringGenerator) *RandomDocuments {
+	return &RandomDocuments{
+		rng:    rng,
+		keys:   sg.GenerateNRandomStrings(10, 10), // 10 random strings with length 10
+		values: sg.GenerateNRandomStrings(10, 10),
+	}
+}
+
+func (g *RandomDocuments) Keys() []string {
+	return g.keys
+}
+
+func (g *RandomDocuments) Generate(count int) []KVList {
+	return GenerateDocuments(g.rng, count, g.keys, g.values)
+}
+
+func (g *RandomDocuments) Value(key string) string {
+	return g.values[g.rng.Intn(len(g.values))]
+}
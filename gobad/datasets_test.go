@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+// imported values can hold anything, and the glob made from one has to parse
+// and match it
+func TestGlobOf(t *testing.T) {
+	for _, tc := range []struct {
+		s, glob string
+		// a string like s that the glob should match too
+		like string
+	}{
+		{"/soda/1/temp", "/soda/1/*", "/soda/1/hum"},
+		{"/", "/*", "/x"},
+		{"Sensor", "S*", "Setpoint"},
+		{"", "*", "x"},
+		{"[1]", "\\[*", "[2]"},
+		{"*x", "\\**", "*y"},
+		{"?", "\\?*", "?!"},
+		{"\\x", "\\\\*", "\\y"},
+		{"°F", "°*", "°C"},
+		{"é/[a]*/b", "é/\\[a]\\*/*", "é/[a]*/c"},
+	} {
+		glob := globOf(tc.s)
+		if glob != tc.glob {
+			t.Errorf("globOf(%q): got %q, want %q", tc.s, glob, tc.glob)
+		}
+		g, err := ParseGlob(glob)
+		if err != nil {
+			t.Errorf("globOf(%q) = %q: %v", tc.s, glob, err)
+			continue
+		}
+		if !g.Match(tc.s) || !g.Match(tc.like) {
+			t.Errorf("globOf(%q) = %q should match %q and %q", tc.s, glob, tc.s, tc.like)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"context"
+)
+
+// A DocumentScanner can read every document it holds in one pass over its
+// store, rather than a query per document, for exports of the whole store
+type DocumentScanner interface {
+
+	// call fn with every document, in an order of the provider's choosing,
+	// stopping at the first error fn returns. Documents written during the
+	// scan may or may not be seen, but no uuid is seen twice
+	ScanDocuments(ctx context.Context, fn func(doc KVList) error) error
+}
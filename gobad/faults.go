@@ -0,0 +1,780 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FaultyMetadataQuery and FaultyBosswaveQuery wrap a provider and make it
+// misbehave: calls are slowed down, fail, time out or return only part of
+// their results, at the rates a FaultPolicy sets. The faults are drawn from a
+// random source seeded by the policy, so a run with the same seed and the same
+// sequence of calls sees the same faults.
+//
+// The wrappers sit above the providers, so the providers' own retries never
+// see an injected fault. A failed call is retried by the wrapper instead, as
+// the policy's Retry says the provider retries a transient error. The call
+// was never passed on, so writes are retried too
+
+var (
+	// returned by a call the wrapper failed without passing it on
+	ErrInjectedFault = errors.New("Injected fault")
+	// returned by a call the wrapper timed out. The call was passed on, so a
+	// write may have been applied even though it reports failure
+	ErrInjectedTimeout = errors.New("Injected timeout")
+)
+
+// the faults injected into calls of one method
+type FaultRates struct {
+	// every call is delayed by Latency plus a uniformly random part of
+	// LatencyJitter before it is made
+	Latency       time.Duration
+	LatencyJitter time.Duration
+
+	// the fraction of calls failed with ErrInjectedFault
+	ErrorRate float64
+
+	// the fraction of calls that hang for Timeout after they return and then
+	// fail with ErrInjectedTimeout
+	TimeoutRate float64
+	Timeout     time.Duration
+
+	// the fraction of calls returning a list, document or map that return
+	// only a random part of it, with no error
+	PartialRate float64
+}
+
+// the zero FaultRates injects nothing
+func (r FaultRates) active() bool {
+	return r.Latency > 0 || r.LatencyJitter > 0 || r.ErrorRate > 0 || r.TimeoutRate > 0 || r.PartialRate > 0
+}
+
+type FaultPolicy struct {
+	// seeds the random source faults are drawn from
+	Seed int64
+
+	// the rates for every method without its own entry in Methods
+	FaultRates
+
+	// rates by method name, such as "GetDocumentUnique"
+	Methods map[string]FaultRates
+
+	// how failed calls are retried, as the provider under the wrapper retries
+	Retry RetryPolicy
+}
+
+// whether the policy injects any faults at all
+func (p FaultPolicy) Active() bool {
+	if p.FaultRates.active() {
+		return true
+	}
+	for _, r := range p.Methods {
+		if r.active() {
+			return true
+		}
+	}
+	return false
+}
+
+func (p FaultPolicy) rates(method string) FaultRates {
+	if r, ok := p.Methods[method]; ok {
+		return r
+	}
+	return p.FaultRates
+}
+
+// the fate of one call
+type fault struct {
+	// fail the call with this instead of making it
+	fail error
+	// make the call, then hang this long and fail it
+	timeout time.Duration
+	// the fraction of the result to return
+	keep float64
+	// seeds the choice of the entries of a map result to return
+	seed int64
+}
+
+func (f fault) timedOut(ctx context.Context) error {
+	if f.timeout == 0 {
+		return nil
+	}
+	if err := sleepContext(ctx, f.timeout); err != nil {
+		return err
+	}
+	return ErrInjectedTimeout
+}
+
+// how many of n results to return
+func (f fault) cut(n int) int {
+	return int(f.keep * float64(n))
+}
+
+// keep as many of a map's entries as f.cut says. They are picked at random by
+// the fault's seed from the keys in order, so the same seed keeps the same
+// entries, whatever order the map iterates in
+func cutMap(m map[string]int, f fault) map[string]int {
+	keep := f.cut(len(m))
+	if keep == len(m) {
+		return m
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	rand.New(rand.NewSource(f.seed)).Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	for _, k := range keys[keep:] {
+		delete(m, k)
+	}
+	return m
+}
+
+// a count of the faults injected so far, by kind
+type FaultStats struct {
+	Delayed   int
+	Failed    int
+	TimedOut  int
+	Truncated int
+	// failed calls tried again, and those that failed every try
+	Retried int
+	GaveUp  int
+}
+
+type faultInjector struct {
+	policy FaultPolicy
+
+	lock  sync.Mutex
+	rng   *rand.Rand
+	stats FaultStats
+}
+
+func newFaultInjector(policy FaultPolicy) faultInjector {
+	return faultInjector{policy: policy, rng: rand.New(rand.NewSource(policy.Seed))}
+}
+
+// decide the fate of a call to method, retrying it as the policy says while it
+// is failed, and sleep through its latency and backoff, failing the call with
+// ctx's error if ctx is done first
+func (in *faultInjector) inject(ctx context.Context, method string) fault {
+	retry := in.policy.Retry
+	wait := retry.waits()
+	for attempt := 1; ; attempt++ {
+		f := in.draw(ctx, method)
+		if f.fail != ErrInjectedFault {
+			return f
+		}
+		in.lock.Lock()
+		if attempt >= retry.Attempts {
+			in.stats.GaveUp++
+			in.lock.Unlock()
+			return f
+		}
+		in.stats.Retried++
+		in.lock.Unlock()
+		if err := wait.next(ctx); err != nil {
+			f.fail = err
+			return f
+		}
+	}
+}
+
+// decide the fate of one try of a call to method and sleep through its
+// latency, failing the call with ctx's error if ctx is done first. Every
+// call draws the same number of values from the random source, whatever its
+// rates, so changing the rates of one method doesn't shift the faults of
+// the others
+func (in *faultInjector) draw(ctx context.Context, method string) fault {
+	r := in.policy.rates(method)
+	in.lock.Lock()
+	jitter, fail, timeout, partial, keep := in.rng.Float64(), in.rng.Float64(), in.rng.Float64(), in.rng.Float64(), in.rng.Float64()
+	f := fault{keep: 1, seed: in.rng.Int63()}
+	delay := r.Latency + time.Duration(jitter*float64(r.LatencyJitter))
+	if delay > 0 {
+		in.stats.Delayed++
+	}
+	switch {
+	case fail < r.ErrorRate:
+		f.fail = ErrInjectedFault
+		in.stats.Failed++
+	case timeout < r.TimeoutRate:
+		f.timeout = r.Timeout
+		if f.timeout == 0 {
+			f.timeout = time.Nanosecond
+		}
+		in.stats.TimedOut++
+	case partial < r.PartialRate:
+		f.keep = keep
+		in.stats.Truncated++
+	}
+	in.lock.Unlock()
+	if err := sleepContext(ctx, delay); err != nil {
+		f.fail = err
+	}
+	return f
+}
+
+func (in *faultInjector) Stats() FaultStats {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	return in.stats
+}
+
+// report the faults injected since the last call as metrics, and reset the count
+func (in *faultInjector) ReportStats(provider string, run int) {
+	in.lock.Lock()
+	s := in.stats
+	in.stats = FaultStats{}
+	in.lock.Unlock()
+	Report.Metric(provider, "Faults.Delayed", run, float64(s.Delayed))
+	Report.Metric(provider, "Faults.Failed", run, float64(s.Failed))
+	Report.Metric(provider, "Faults.TimedOut", run, float64(s.TimedOut))
+	Report.Metric(provider, "Faults.Truncated", run, float64(s.Truncated))
+	Report.Metric(provider, "Faults.Retried", run, float64(s.Retried))
+	Report.Metric(provider, "Faults.GaveUp", run, float64(s.GaveUp))
+}
+
+//== FaultyMetadataQuery
+
+type FaultyMetadataQuery struct {
+	faultInjector
+	mq MetadataQuery
+}
+
+func NewFaultyMetadataQuery(mq MetadataQuery, policy FaultPolicy) *FaultyMetadataQuery {
+	return &FaultyMetadataQuery{faultInjector: newFaultInjector(policy), mq: mq}
+}
+
+// the provider faults are injected into
+func (f *FaultyMetadataQuery) Unwrap() MetadataQuery {
+	return f.mq
+}
+
+// setting up and closing the provider are never faulted
+func (f *FaultyMetadataQuery) Initialize(ctx context.Context) error {
+	return f.mq.Initialize(ctx)
+}
+
+func (f *FaultyMetadataQuery) Close() error {
+	return f.mq.Close()
+}
+
+func (f *FaultyMetadataQuery) Subscribe(ctx context.Context, where KVList) *Subscription {
+	return f.mq.Subscribe(ctx, where)
+}
+
+func (f *FaultyMetadataQuery) GetDocumentUnique(ctx context.Context, uuid string) (KVList, error) {
+	fault := f.inject(ctx, "GetDocumentUnique")
+	if fault.fail != nil {
+		return nil, fault.fail
+	}
+	r, err := f.mq.GetDocumentUnique(ctx, uuid)
+	if err := fault.timedOut(ctx); err != nil {
+		return nil, err
+	}
+	return r[:fault.cut(len(r))], err
+}
+
+func (f *FaultyMetadataQuery) GetDocumentSetWhere(ctx context.Context, where KVList) ([]KVList, error) {
+	fault := f.inject(ctx, "GetDocumentSetWhere")
+	if fault.fail != nil {
+		return nil, fault.fail
+	}
+	r, err := f.mq.GetDocumentSetWhere(ctx, where)
+	if err := fault.timedOut(ctx); err != nil {
+		return nil, err
+	}
+	return r[:fault.cut(len(r))], err
+}
+
+func (f *FaultyMetadataQuery) GetUniqueValues(ctx context.Context, key string) ([]interface{}, error) {
+	fault := f.inject(ctx, "GetUniqueValues")
+	if fault.fail != nil {
+		return nil, fault.fail
+	}
+	r, err := f.mq.GetUniqueValues(ctx, key)
+	if err := fault.timedOut(ctx); err != nil {
+		return nil, err
+	}
+	return r[:fault.cut(len(r))], err
+}
+
+func (f *FaultyMetadataQuery) GetDocumentSetValueGlob(ctx context.Context, key, value_glob string) ([]KVList, error) {
+	fault := f.inject(ctx, "GetDocumentSetValueGlob")
+	if fault.fail != nil {
+		return nil, fault.fail
+	}
+	r, err := f.mq.GetDocumentSetValueGlob(ctx, key, value_glob)
+	if err := fault.timedOut(ctx); err != nil {
+		return nil, err
+	}
+	return r[:fault.cut(len(r))], err
+}
+
+func (f *FaultyMetadataQuery) GetKeyGlob(ctx context.Context, key_glob string) ([]string, error) {
+	fault := f.inject(ctx, "GetKeyGlob")
+	if fault.fail != nil {
+		return nil, fault.fail
+	}
+	r, err := f.mq.GetKeyGlob(ctx, key_glob)
+	if err := fault.timedOut(ctx); err != nil {
+		return nil, err
+	}
+	return r[:fault.cut(len(r))], err
+}
+
+func (f *FaultyMetadataQuery) CountWhere(ctx context.Context, where KVList) (int, error) {
+	fault := f.inject(ctx, "CountWhere")
+	if fault.fail != nil {
+		return 0, fault.fail
+	}
+	r, err := f.mq.CountWhere(ctx, where)
+	if err := fault.timedOut(ctx); err != nil {
+		return 0, err
+	}
+	return r, err
+}
+
+func (f *FaultyMetadataQuery) CountValueGlob(ctx context.Context, key, value_glob string) (int, error) {
+	fault := f.inject(ctx, "CountValueGlob")
+	if fault.fail != nil {
+		return 0, fault.fail
+	}
+	r, err := f.mq.CountValueGlob(ctx, key, value_glob)
+	if err := fault.timedOut(ctx); err != nil {
+		return 0, err
+	}
+	return r, err
+}
+
+func (f *FaultyMetadataQuery) ExistsWhere(ctx context.Context, where KVList) (bool, error) {
+	fault := f.inject(ctx, "ExistsWhere")
+	if fault.fail != nil {
+		return false, fault.fail
+	}
+	r, err := f.mq.ExistsWhere(ctx, where)
+	if err := fault.timedOut(ctx); err != nil {
+		return false, err
+	}
+	return r, err
+}
+
+func (f *FaultyMetadataQuery) GetUniqueValueCounts(ctx context.Context, key string) (map[string]int, error) {
+	fault := f.inject(ctx, "GetUniqueValueCounts")
+	if fault.fail != nil {
+		return nil, fault.fail
+	}
+	r, err := f.mq.GetUniqueValueCounts(ctx, key)
+	if err := fault.timedOut(ctx); err != nil {
+		return nil, err
+	}
+	return cutMap(r, fault), err
+}
+
+func (f *FaultyMetadataQuery) InsertDocument(ctx context.Context, docs []KVList) error {
+	fault := f.inject(ctx, "InsertDocument")
+	if fault.fail != nil {
+		return fault.fail
+	}
+	err := f.mq.InsertDocument(ctx, docs)
+	if err := fault.timedOut(ctx); err != nil {
+		return err
+	}
+	return err
+}
+
+func (f *FaultyMetadataQuery) BulkInsertDocument(ctx context.Context, docs []KVList, batchsize int) ([]DocumentError, error) {
+	fault := f.inject(ctx, "BulkInsertDocument")
+	if fault.fail != nil {
+		return nil, fault.fail
+	}
+	r, err := f.mq.BulkInsertDocument(ctx, docs, batchsize)
+	if err := fault.timedOut(ctx); err != nil {
+		return nil, err
+	}
+	return r, err
+}
+
+func (f *FaultyMetadataQuery) BulkSetKVDocumentUnique(ctx context.Context, updates []DocumentUpdate, batchsize int) ([]DocumentError, error) {
+	fault := f.inject(ctx, "BulkSetKVDocumentUnique")
+	if fault.fail != nil {
+		return nil, fault.fail
+	}
+	r, err := f.mq.BulkSetKVDocumentUnique(ctx, updates, batchsize)
+	if err := fault.timedOut(ctx); err != nil {
+		return nil, err
+	}
+	return r, err
+}
+
+func (f *FaultyMetadataQuery) UpsertDocument(ctx context.Context, doc KVList) error {
+	fault := f.inject(ctx, "UpsertDocument")
+	if fault.fail != nil {
+		return fault.fail
+	}
+	err := f.mq.UpsertDocument(ctx, doc)
+	if err := fault.timedOut(ctx); err != nil {
+		return err
+	}
+	return err
+}
+
+func (f *FaultyMetadataQuery) SetKVDocumentUnique(ctx context.Context, kv KVList, uuid string) error {
+	fault := f.inject(ctx, "SetKVDocumentUnique")
+	if fault.fail != nil {
+		return fault.fail
+	}
+	err := f.mq.SetKVDocumentUnique(ctx, kv, uuid)
+	if err := fault.timedOut(ctx); err != nil {
+		return err
+	}
+	return err
+}
+
+func (f *FaultyMetadataQuery) SetKVDocumentWhere(ctx context.Context, kv, where KVList) error {
+	fault := f.inject(ctx, "SetKVDocumentWhere")
+	if fault.fail != nil {
+		return fault.fail
+	}
+	err := f.mq.SetKVDocumentWhere(ctx, kv, where)
+	if err := fault.timedOut(ctx); err != nil {
+		return err
+	}
+	return err
+}
+
+func (f *FaultyMetadataQuery) SetKVDocumentValueGlob(ctx context.Context, kv KVList, key, value_glob string) error {
+	fault := f.inject(ctx, "SetKVDocumentValueGlob")
+	if fault.fail != nil {
+		return fault.fail
+	}
+	err := f.mq.SetKVDocumentValueGlob(ctx, kv, key, value_glob)
+	if err := fault.timedOut(ctx); err != nil {
+		return err
+	}
+	return err
+}
+
+func (f *FaultyMetadataQuery) ReplaceDocumentUnique(ctx context.Context, doc KVList, uuid string) error {
+	fault := f.inject(ctx, "ReplaceDocumentUnique")
+	if fault.fail != nil {
+		return fault.fail
+	}
+	err := f.mq.ReplaceDocumentUnique(ctx, doc, uuid)
+	if err := fault.timedOut(ctx); err != nil {
+		return err
+	}
+	return err
+}
+
+func (f *FaultyMetadataQuery) DeleteKeyDocumentUnique(ctx context.Context, keys []string, uuid string) error {
+	fault := f.inject(ctx, "DeleteKeyDocumentUnique")
+	if fault.fail != nil {
+		return fault.fail
+	}
+	err := f.mq.DeleteKeyDocumentUnique(ctx, keys, uuid)
+	if err := fault.timedOut(ctx); err != nil {
+		return err
+	}
+	return err
+}
+
+func (f *FaultyMetadataQuery) DeleteKeyDocumentWhere(ctx context.Context, keys []string, where KVList) error {
+	fault := f.inject(ctx, "DeleteKeyDocumentWhere")
+	if fault.fail != nil {
+		return fault.fail
+	}
+	err := f.mq.DeleteKeyDocumentWhere(ctx, keys, where)
+	if err := fault.timedOut(ctx); err != nil {
+		return err
+	}
+	return err
+}
+
+func (f *FaultyMetadataQuery) DeleteKeyGlobDocumentUnique(ctx context.Context, key_glob, uuid string) error {
+	fault := f.inject(ctx, "DeleteKeyGlobDocumentUnique")
+	if fault.fail != nil {
+		return fault.fail
+	}
+	err := f.mq.DeleteKeyGlobDocumentUnique(ctx, key_glob, uuid)
+	if err := fault.timedOut(ctx); err != nil {
+		return err
+	}
+	return err
+}
+
+func (f *FaultyMetadataQuery) DeleteKeyGlobDocumentWhere(ctx context.Context, key_glob string, where KVList) error {
+	fault := f.inject(ctx, "DeleteKeyGlobDocumentWhere")
+	if fault.fail != nil {
+		return fault.fail
+	}
+	err := f.mq.DeleteKeyGlobDocumentWhere(ctx, key_glob, where)
+	if err := fault.timedOut(ctx); err != nil {
+		return err
+	}
+	return err
+}
+
+func (f *FaultyMetadataQuery) DeleteDocumentUnique(ctx context.Context, uuid string) error {
+	fault := f.inject(ctx, "DeleteDocumentUnique")
+	if fault.fail != nil {
+		return fault.fail
+	}
+	err := f.mq.DeleteDocumentUnique(ctx, uuid)
+	if err := fault.timedOut(ctx); err != nil {
+		return err
+	}
+	return err
+}
+
+func (f *FaultyMetadataQuery) DeleteDocumentsWhere(ctx context.Context, where KVList) error {
+	fault := f.inject(ctx, "DeleteDocumentsWhere")
+	if fault.fail != nil {
+		return fault.fail
+	}
+	err := f.mq.DeleteDocumentsWhere(ctx, where)
+	if err := fault.timedOut(ctx); err != nil {
+		return err
+	}
+	return err
+}
+
+func (f *FaultyMetadataQuery) ApplyBatch(ctx context.Context, batch *MetadataBatch) (bool, error) {
+	fault := f.inject(ctx, "ApplyBatch")
+	if fault.fail != nil {
+		return false, fault.fail
+	}
+	r, err := f.mq.ApplyBatch(ctx, batch)
+	if err := fault.timedOut(ctx); err != nil {
+		return false, err
+	}
+	return r, err
+}
+
+func (f *FaultyMetadataQuery) GetDocumentUniqueAsOf(ctx context.Context, uuid string, t time.Time) (KVList, error) {
+	fault := f.inject(ctx, "GetDocumentUniqueAsOf")
+	if fault.fail != nil {
+		return nil, fault.fail
+	}
+	r, err := f.mq.GetDocumentUniqueAsOf(ctx, uuid, t)
+	if err := fault.timedOut(ctx); err != nil {
+		return nil, err
+	}
+	return r[:fault.cut(len(r))], err
+}
+
+func (f *FaultyMetadataQuery) GetDocumentSetWhereAsOf(ctx context.Context, where KVList, t time.Time) ([]KVList, error) {
+	fault := f.inject(ctx, "GetDocumentSetWhereAsOf")
+	if fault.fail != nil {
+		return nil, fault.fail
+	}
+	r, err := f.mq.GetDocumentSetWhereAsOf(ctx, where, t)
+	if err := fault.timedOut(ctx); err != nil {
+		return nil, err
+	}
+	return r[:fault.cut(len(r))], err
+}
+
+func (f *FaultyMetadataQuery) GetUniqueValuesAsOf(ctx context.Context, key string, t time.Time) ([]interface{}, error) {
+	fault := f.inject(ctx, "GetUniqueValuesAsOf")
+	if fault.fail != nil {
+		return nil, fault.fail
+	}
+	r, err := f.mq.GetUniqueValuesAsOf(ctx, key, t)
+	if err := fault.timedOut(ctx); err != nil {
+		return nil, err
+	}
+	return r[:fault.cut(len(r))], err
+}
+
+func (f *FaultyMetadataQuery) GetDocumentSetValueGlobAsOf(ctx context.Context, key, value_glob string, t time.Time) ([]KVList, error) {
+	fault := f.inject(ctx, "GetDocumentSetValueGlobAsOf")
+	if fault.fail != nil {
+		return nil, fault.fail
+	}
+	r, err := f.mq.GetDocumentSetValueGlobAsOf(ctx, key, value_glob, t)
+	if err := fault.timedOut(ctx); err != nil {
+		return nil, err
+	}
+	return r[:fault.cut(len(r))], err
+}
+
+func (f *FaultyMetadataQuery) GetKeyGlobAsOf(ctx context.Context, key_glob string, t time.Time) ([]string, error) {
+	fault := f.inject(ctx, "GetKeyGlobAsOf")
+	if fault.fail != nil {
+		return nil, fault.fail
+	}
+	r, err := f.mq.GetKeyGlobAsOf(ctx, key_glob, t)
+	if err := fault.timedOut(ctx); err != nil {
+		return nil, err
+	}
+	return r[:fault.cut(len(r))], err
+}
+
+func (f *FaultyMetadataQuery) CountWhereAsOf(ctx context.Context, where KVList, t time.Time) (int, error) {
+	fault := f.inject(ctx, "CountWhereAsOf")
+	if fault.fail != nil {
+		return 0, fault.fail
+	}
+	r, err := f.mq.CountWhereAsOf(ctx, where, t)
+	if err := fault.timedOut(ctx); err != nil {
+		return 0, err
+	}
+	return r, err
+}
+
+func (f *FaultyMetadataQuery) CountValueGlobAsOf(ctx context.Context, key, value_glob string, t time.Time) (int, error) {
+	fault := f.inject(ctx, "CountValueGlobAsOf")
+	if fault.fail != nil {
+		return 0, fault.fail
+	}
+	r, err := f.mq.CountValueGlobAsOf(ctx, key, value_glob, t)
+	if err := fault.timedOut(ctx); err != nil {
+		return 0, err
+	}
+	return r, err
+}
+
+func (f *FaultyMetadataQuery) ExistsWhereAsOf(ctx context.Context, where KVList, t time.Time) (bool, error) {
+	fault := f.inject(ctx, "ExistsWhereAsOf")
+	if fault.fail != nil {
+		return false, fault.fail
+	}
+	r, err := f.mq.ExistsWhereAsOf(ctx, where, t)
+	if err := fault.timedOut(ctx); err != nil {
+		return false, err
+	}
+	return r, err
+}
+
+func (f *FaultyMetadataQuery) GetUniqueValueCountsAsOf(ctx context.Context, key string, t time.Time) (map[string]int, error) {
+	fault := f.inject(ctx, "GetUniqueValueCountsAsOf")
+	if fault.fail != nil {
+		return nil, fault.fail
+	}
+	r, err := f.mq.GetUniqueValueCountsAsOf(ctx, key, t)
+	if err := fault.timedOut(ctx); err != nil {
+		return nil, err
+	}
+	return cutMap(r, fault), err
+}
+
+func (f *FaultyMetadataQuery) GetDocumentHistory(ctx context.Context, uuid string) ([]ChangeEvent, error) {
+	fault := f.inject(ctx, "GetDocumentHistory")
+	if fault.fail != nil {
+		return nil, fault.fail
+	}
+	r, err := f.mq.GetDocumentHistory(ctx, uuid)
+	if err := fault.timedOut(ctx); err != nil {
+		return nil, err
+	}
+	return r[:fault.cut(len(r))], err
+}
+
+func (f *FaultyMetadataQuery) CompactHistory(ctx context.Context) error {
+	fault := f.inject(ctx, "CompactHistory")
+	if fault.fail != nil {
+		return fault.fail
+	}
+	err := f.mq.CompactHistory(ctx)
+	if err := fault.timedOut(ctx); err != nil {
+		return err
+	}
+	return err
+}
+
+//== FaultyBosswaveQuery
+
+type FaultyBosswaveQuery struct {
+	faultInjector
+	bq BosswaveQuery
+}
+
+func NewFaultyBosswaveQuery(bq BosswaveQuery, policy FaultPolicy) *FaultyBosswaveQuery {
+	return &FaultyBosswaveQuery{faultInjector: newFaultInjector(policy), bq: bq}
+}
+
+// setting up and closing the provider are never faulted
+func (f *FaultyBosswaveQuery) Initialize(ctx context.Context) error {
+	return f.bq.Initialize(ctx)
+}
+
+func (f *FaultyBosswaveQuery) Close() error {
+	return f.bq.Close()
+}
+
+func (f *FaultyBosswaveQuery) GetRecord(ctx context.Context, key string) (BosswaveRecord, error) {
+	fault := f.inject(ctx, "GetRecord")
+	if fault.fail != nil {
+		return BosswaveRecord{}, fault.fail
+	}
+	r, err := f.bq.GetRecord(ctx, key)
+	if err := fault.timedOut(ctx); err != nil {
+		return BosswaveRecord{}, err
+	}
+	return r, err
+}
+
+func (f *FaultyBosswaveQuery) InsertRecord(ctx context.Context, r BosswaveRecord) error {
+	fault := f.inject(ctx, "InsertRecord")
+	if fault.fail != nil {
+		return fault.fail
+	}
+	err := f.bq.InsertRecord(ctx, r)
+	if err := fault.timedOut(ctx); err != nil {
+		return err
+	}
+	return err
+}
+
+func (f *FaultyBosswaveQuery) GetKeysUpToSlash(ctx context.Context, keyprefix string) ([]string, error) {
+	fault := f.inject(ctx, "GetKeysUpToSlash")
+	if fault.fail != nil {
+		return nil, fault.fail
+	}
+	r, err := f.bq.GetKeysUpToSlash(ctx, keyprefix)
+	if err := fault.timedOut(ctx); err != nil {
+		return nil, err
+	}
+	return r[:fault.cut(len(r))], err
+}
+
+func (f *FaultyBosswaveQuery) SumSize(ctx context.Context, AllocSet int64) (int64, error) {
+	fault := f.inject(ctx, "SumSize")
+	if fault.fail != nil {
+		return 0, fault.fail
+	}
+	r, err := f.bq.SumSize(ctx, AllocSet)
+	if err := fault.timedOut(ctx); err != nil {
+		return 0, err
+	}
+	return r, err
+}
+
+func (f *FaultyBosswaveQuery) CreateAllocSet(ctx context.Context, r AllocationSet) error {
+	fault := f.inject(ctx, "CreateAllocSet")
+	if fault.fail != nil {
+		return fault.fail
+	}
+	err := f.bq.CreateAllocSet(ctx, r)
+	if err := fault.timedOut(ctx); err != nil {
+		return err
+	}
+	return err
+}
+
+func (f *FaultyBosswaveQuery) GetAllocSetID(ctx context.Context, vk VK) (int64, error) {
+	fault := f.inject(ctx, "GetAllocSetID")
+	if fault.fail != nil {
+		return 0, fault.fail
+	}
+	r, err := f.bq.GetAllocSetID(ctx, vk)
+	if err := fault.timedOut(ctx); err != nil {
+		return 0, err
+	}
+	return r, err
+}
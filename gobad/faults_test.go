@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// the same seed keeps the same entries of a partial map, however the map
+// happens to iterate
+func TestCutMapReproducible(t *testing.T) {
+	counts := func() map[string]int {
+		m := map[string]int{}
+		for _, k := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+			m[k] = len(k)
+		}
+		return m
+	}
+	f := fault{keep: 0.5, seed: 42}
+	want := cutMap(counts(), f)
+	if len(want) != 4 {
+		t.Fatalf("kept %d of 8 entries, want 4", len(want))
+	}
+	for i := 0; i < 20; i++ {
+		if got := cutMap(counts(), f); !reflect.DeepEqual(got, want) {
+			t.Fatalf("kept %v, then %v", want, got)
+		}
+	}
+	if got := cutMap(counts(), fault{keep: 1}); len(got) != 8 {
+		t.Errorf("kept %d of 8 entries with nothing to cut", len(got))
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Globs, as taken by the *Glob operations of MetadataQuery. Keys are
+// /-separated paths, so the wildcards stop at a slash unless doubled:
+//
+//	*      any run of characters other than /
+//	**     any run of characters, including /
+//	?      any single character other than /
+//	[abc]  any one of the listed characters; ranges such as [a-z] and
+//	       negation with [!abc] are allowed, and a negated class never matches /
+//	\x     the character x, literally
+//
+// A glob always matches the whole string. ParseGlob validates a pattern, and
+// the resulting Glob translates into whatever the backend can run best: an
+// anchored regex, a SQL LIKE pattern, or a literal prefix for a range scan
+
+type globTokenKind int
+
+const (
+	globLiteral globTokenKind = iota
+	globStar
+	globDoubleStar
+	globAny
+	globClass
+)
+
+type globToken struct {
+	kind globTokenKind
+	// the text of a literal
+	text string
+	// the ranges of a class; single characters are ranges of one
+	ranges  [][2]rune
+	negated bool
+}
+
+type Glob struct {
+	pattern string
+	tokens  []globToken
+	re      *regexp.Regexp
+}
+
+func ParseGlob(pattern string) (*Glob, error) {
+	g := &Glob{pattern: pattern}
+	rs := []rune(pattern)
+	lit := []rune{}
+	flush := func() {
+		if len(lit) > 0 {
+			g.tokens = append(g.tokens, globToken{kind: globLiteral, text: string(lit)})
+			lit = []rune{}
+		}
+	}
+	for i := 0; i < len(rs); i++ {
+		switch rs[i] {
+		case '\\':
+			if i+1 == len(rs) {
+				return nil, fmt.Errorf("trailing backslash in glob %q", pattern)
+			}
+			i++
+			lit = append(lit, rs[i])
+		case '*':
+			flush()
+			kind := globStar
+			for i+1 < len(rs) && rs[i+1] == '*' {
+				kind = globDoubleStar
+				i++
+			}
+			g.tokens = append(g.tokens, globToken{kind: kind})
+		case '?':
+			flush()
+			g.tokens = append(g.tokens, globToken{kind: globAny})
+		case '[':
+			flush()
+			tok, end, err := parseGlobClass(rs, i)
+			if err != nil {
+				return nil, fmt.Errorf("%v in glob %q", err, pattern)
+			}
+			g.tokens = append(g.tokens, tok)
+			i = end
+		default:
+			lit = append(lit, rs[i])
+		}
+	}
+	flush()
+	g.re = regexp.MustCompile(g.Regex())
+	return g, nil
+}
+
+// parses the class opening at rs[start], returning it and the index of its ']'.
+// A ']' straight after the opening '[' or '[!' is taken literally
+func parseGlobClass(rs []rune, start int) (globToken, int, error) {
+	tok := globToken{kind: globClass}
+	i := start + 1
+	if i < len(rs) && (rs[i] == '!' || rs[i] == '^') {
+		tok.negated = true
+		i++
+	}
+	first := i
+	for ; i < len(rs); i++ {
+		if rs[i] == ']' && i > first {
+			return tok, i, nil
+		}
+		lo := rs[i]
+		if lo == '\\' {
+			if i+1 == len(rs) {
+				break
+			}
+			i++
+			lo = rs[i]
+		}
+		hi := lo
+		if i+2 < len(rs) && rs[i+1] == '-' && rs[i+2] != ']' {
+			i += 2
+			hi = rs[i]
+			if hi == '\\' {
+				if i+1 == len(rs) {
+					break
+				}
+				i++
+				hi = rs[i]
+			}
+			if hi < lo {
+				return tok, 0, fmt.Errorf("invalid range %c-%c", lo, hi)
+			}
+		}
+		tok.ranges = append(tok.ranges, [2]rune{lo, hi})
+	}
+	return tok, 0, fmt.Errorf("unterminated character class")
+}
+
+// a glob matching just s, with its wildcards and backslashes escaped. They are
+// all ASCII, so s is escaped byte by byte and kept as it is otherwise
+func escapeGlob(s string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(`\*?[`, s[i]) >= 0 {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func (g *Glob) String() string {
+	return g.pattern
+}
+
+// whether s matches the glob
+func (g *Glob) Match(s string) bool {
+	return g.re.MatchString(s)
+}
+
+// the glob as an anchored regex, in the syntax shared by Go and PCRE. The
+// pattern starts with ^ so that Mongo can bound an index scan by its prefix
+func (g *Glob) Regex() string {
+	var b bytes.Buffer
+	b.WriteString("^")
+	for _, tok := range g.tokens {
+		switch tok.kind {
+		case globLiteral:
+			b.WriteString(regexp.QuoteMeta(tok.text))
+		case globStar:
+			b.WriteString("[^/]*")
+		case globDoubleStar:
+			b.WriteString("(?s:.*)")
+		case globAny:
+			b.WriteString("[^/]")
+		case globClass:
+			b.WriteString("[")
+			if tok.negated {
+				b.WriteString("^/")
+			}
+			for _, r := range tok.ranges {
+				b.WriteString(regexClassChar(r[0]))
+				if r[1] != r[0] {
+					b.WriteString("-" + regexClassChar(r[1]))
+				}
+			}
+			b.WriteString("]")
+		}
+	}
+	b.WriteString(`\z`)
+	return b.String()
+}
+
+func regexClassChar(r rune) string {
+	if strings.ContainsRune(`\]-^[`, r) {
+		return `\` + string(r)
+	}
+	return string(r)
+}
+
+// the glob as a SQL LIKE pattern, using \ as the escape character. LIKE has
+// no wildcard that stops at / and no character classes, so when exact is
+// false the pattern matches a superset and results must be checked with Match
+func (g *Glob) Like() (pattern string, exact bool) {
+	var b bytes.Buffer
+	exact = true
+	for _, tok := range g.tokens {
+		switch tok.kind {
+		case globLiteral:
+			for _, r := range tok.text {
+				if r == '%' || r == '_' || r == '\\' {
+					b.WriteRune('\\')
+				}
+				b.WriteRune(r)
+			}
+		case globStar:
+			b.WriteString("%")
+			exact = false
+		case globDoubleStar:
+			b.WriteString("%")
+		case globAny, globClass:
+			b.WriteString("_")
+			exact = false
+		}
+	}
+	return b.String(), exact
+}
+
+// if the glob has no wildcards, the one string it matches
+func (g *Glob) Literal() (string, bool) {
+	switch {
+	case len(g.tokens) == 0:
+		return "", true
+	case len(g.tokens) == 1 && g.tokens[0].kind == globLiteral:
+		return g.tokens[0].text, true
+	}
+	return "", false
+}
+
+// if the glob is a literal prefix followed by a lone **, that prefix. Every
+// string with the prefix matches, so a range scan from the prefix up to
+// PrefixUpperBound(prefix) answers the glob exactly
+func (g *Glob) Prefix() (string, bool) {
+	n := len(g.tokens)
+	if n == 0 || n > 2 || g.tokens[n-1].kind != globDoubleStar {
+		return "", false
+	}
+	if n == 1 {
+		return "", true
+	}
+	if g.tokens[0].kind != globLiteral {
+		return "", false
+	}
+	return g.tokens[0].text, true
+}
+
+// the least string greater than every string starting with prefix, found by
+// incrementing its last character. Returns false if there is no such string
+// that is still valid UTF-8
+func PrefixUpperBound(prefix string) (string, bool) {
+	for len(prefix) > 0 {
+		r, size := utf8.DecodeLastRuneInString(prefix)
+		prefix = prefix[:len(prefix)-size]
+		next := r + 1
+		if next == 0xD800 {
+			next = 0xE000
+		}
+		if r != utf8.RuneError && next <= utf8.MaxRune {
+			return prefix + string(next), true
+		}
+	}
+	return "", false
+}
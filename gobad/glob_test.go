@@ -0,0 +1,200 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	for _, tc := range []struct {
+		glob, s string
+		want    bool
+	}{
+		{"/soda/1", "/soda/1", true},
+		{"/soda/1", "/soda/12", false},
+		{"", "", true},
+		{"", "a", false},
+
+		{"*", "", true},
+		{"*", "soda", true},
+		{"*", "/soda", false},
+		{"*/1", "soda/1", true},
+		{"*/1", "/soda/1", false},
+		{"*/1", "soda/2", false},
+		{"/soda/*", "/soda/", true},
+		{"/soda/*", "/soda/12", true},
+		{"/soda/*", "/soda/1/2", false},
+		{"*da*", "soda", true},
+		{"*da*", "da", true},
+		{"*da*", "sod", false},
+		{"**", "/soda/1/2", true},
+		{"/soda/**", "/soda/1/2", true},
+		{"/soda/**", "/sod", false},
+		{"**/2", "/soda/1/2", true},
+		{"**/2", "/soda/1/3", false},
+		{"/soda/**", "/soda/1\n2", true},
+
+		{"/soda/?", "/soda/1", true},
+		{"/soda/?", "/soda/12", false},
+		{"/soda/?", "/soda//", false},
+		{"?", "é", true},
+
+		{"[abc]", "b", true},
+		{"[abc]", "d", false},
+		{"[a-c]x", "cx", true},
+		{"[a-c]x", "dx", false},
+		{"[!a-c]", "d", true},
+		{"[!a-c]", "b", false},
+		{"[!a-c]", "/", false},
+		{"[^a]", "b", true},
+		{"[]a]", "]", true},
+		{"[]a]", "a", true},
+		{"[!]]", "]", false},
+		{"[!]]", "x", true},
+		{"[a-]", "-", true},
+		{"[\\]]", "]", true},
+		{"[\\-x]", "-", true},
+		{"[\\-x]", "a", false},
+		{"[\\^]", "^", true},
+		{"[\\^]", "a", false},
+		{"[/]", "/", true},
+
+		{"\\*", "*", true},
+		{"\\*", "a", false},
+		{"\\?", "?", true},
+		{"\\?", "a", false},
+		{"\\[a]", "[a]", true},
+		{"\\[a]", "a", false},
+		{"a\\\\b", "a\\b", true},
+		{"a.b", "a.b", true},
+		{"a.b", "axb", false},
+		{"(a|b)+$", "(a|b)+$", true},
+		{"(a|b)+$", "a", false},
+		{"100%_", "100%_", true},
+	} {
+		g, err := ParseGlob(tc.glob)
+		if err != nil {
+			t.Errorf("ParseGlob(%q): %v", tc.glob, err)
+			continue
+		}
+		if got := g.Match(tc.s); got != tc.want {
+			t.Errorf("%q matching %q: got %v, want %v", tc.glob, tc.s, got, tc.want)
+		}
+		// backends run the regex themselves, without Match
+		if got := regexp.MustCompile(g.Regex()).MatchString(tc.s); got != tc.want {
+			t.Errorf("%q as regex %q matching %q: got %v, want %v", tc.glob, g.Regex(), tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestGlobErrors(t *testing.T) {
+	for _, glob := range []string{
+		"a\\",
+		"[abc",
+		"[",
+		"[!",
+		"[]",
+		"[a\\",
+		"[z-a]",
+		"[a-\\",
+	} {
+		if _, err := ParseGlob(glob); err == nil {
+			t.Errorf("ParseGlob(%q) should fail", glob)
+		}
+	}
+}
+
+func TestGlobLike(t *testing.T) {
+	for _, tc := range []struct {
+		glob  string
+		like  string
+		exact bool
+	}{
+		{"/soda/1", "/soda/1", true},
+		{"/soda/**", "/soda/%", true},
+		{"**/1", "%/1", true},
+		{"/soda/*", "/soda/%", false},
+		{"*/1", "%/1", false},
+		{"/soda/?", "/soda/_", false},
+		{"/soda/[12]", "/soda/_", false},
+		{"100%_\\\\", "100\\%\\_\\\\", true},
+		{"\\*\\?", "*?", true},
+	} {
+		g, err := ParseGlob(tc.glob)
+		if err != nil {
+			t.Fatalf("ParseGlob(%q): %v", tc.glob, err)
+		}
+		if like, exact := g.Like(); like != tc.like || exact != tc.exact {
+			t.Errorf("%q as LIKE: got %q %v, want %q %v", tc.glob, like, exact, tc.like, tc.exact)
+		}
+	}
+}
+
+func TestGlobLiteralAndPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		glob      string
+		literal   string
+		isLiteral bool
+		prefix    string
+		isPrefix  bool
+	}{
+		{"", "", true, "", false},
+		{"/soda/1", "/soda/1", true, "", false},
+		{"/soda/\\*", "/soda/*", true, "", false},
+		{"**", "", false, "", true},
+		{"/soda/**", "", false, "/soda/", true},
+		{"/soda/\\***", "", false, "/soda/*", true},
+		{"/soda/*", "", false, "", false},
+		{"*/soda/**", "", false, "", false},
+		{"/soda/**/1", "", false, "", false},
+		{"/soda/?**", "", false, "", false},
+	} {
+		g, err := ParseGlob(tc.glob)
+		if err != nil {
+			t.Fatalf("ParseGlob(%q): %v", tc.glob, err)
+		}
+		if literal, ok := g.Literal(); literal != tc.literal || ok != tc.isLiteral {
+			t.Errorf("%q literal: got %q %v, want %q %v", tc.glob, literal, ok, tc.literal, tc.isLiteral)
+		}
+		if prefix, ok := g.Prefix(); prefix != tc.prefix || ok != tc.isPrefix {
+			t.Errorf("%q prefix: got %q %v, want %q %v", tc.glob, prefix, ok, tc.prefix, tc.isPrefix)
+		}
+	}
+}
+
+func TestPrefixUpperBound(t *testing.T) {
+	for _, tc := range []struct {
+		prefix string
+		upper  string
+		ok     bool
+	}{
+		{"/soda/", "/soda0", true},
+		{"a", "b", true},
+		{"az", "a{", true},
+		{"a\x7f", "a\u0080", true},
+		{"a\uffff", "a\U00010000", true},
+		{"a\ud7ff", "a\ue000", true},
+		{"a\U0010ffff", "b", true},
+		{"\U0010ffff\U0010ffff", "", false},
+		{"", "", false},
+	} {
+		upper, ok := PrefixUpperBound(tc.prefix)
+		if upper != tc.upper || ok != tc.ok {
+			t.Errorf("PrefixUpperBound(%q): got %q %v, want %q %v", tc.prefix, upper, ok, tc.upper, tc.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		// every string with the prefix sorts below the bound, and the bound
+		// itself doesn't have the prefix
+		for _, s := range []string{tc.prefix, tc.prefix + "\x00", tc.prefix + "zzz", tc.prefix + "\U0010ffff"} {
+			if s >= upper {
+				t.Errorf("PrefixUpperBound(%q) = %q is not above %q", tc.prefix, upper, s)
+			}
+		}
+		if len(upper) >= len(tc.prefix) && upper[:len(tc.prefix)] == tc.prefix {
+			t.Errorf("PrefixUpperBound(%q) = %q has the prefix", tc.prefix, upper)
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Metadata history for the Mongo providers.
+// When enabled, every change the provider's ChangeFeed sees is also written to
+// a "history" collection as {uuid, kind, time, seq, before, after}, where
+// before and after are full snapshots of the document. The state of the store
+// at any time t is then the latest "after" of each uuid recorded at or before
+// t. The AsOf getters first find the uuids with some snapshot that matches
+// their query, since a document's state at t is one of its snapshots, and
+// then evaluate the query over the state of just those uuids in memory
+
+// what a provider keeps of its history
+type HistoryPolicy struct {
+	Enabled bool
+
+	// changes older than this are dropped, keeping only what is needed to
+	// reconstruct the state at the retention horizon. Zero keeps everything
+	Retention time.Duration
+
+	// changes older than CompactAfter are thinned to the last change per
+	// document in each CompactInterval, so point-in-time queries into that
+	// range are only accurate to the interval. Zero disables compaction
+	CompactAfter    time.Duration
+	CompactInterval time.Duration
+}
+
+// how many uuids the state as of a time is read for at once
+const historyBatch = 1000
+
+// orders changes recorded within the same millisecond, which is as fine as
+// Mongo stores times
+var historySeq int64
+
+type historyPair struct {
+	Key   string `bson:"k"`
+	Value string `bson:"v"`
+}
+
+// Before and After are left out when there is no snapshot, so that a missing
+// document reads back from Mongo as nil rather than as an empty one
+type historyEntry struct {
+	Id     bson.ObjectId `bson:"_id,omitempty"`
+	UUID   string        `bson:"uuid"`
+	Kind   ChangeKind    `bson:"kind"`
+	Time   time.Time     `bson:"time"`
+	Seq    int64         `bson:"seq"`
+	Before []historyPair `bson:"before,omitempty"`
+	After  []historyPair `bson:"after,omitempty"`
+}
+
+func kvList2HistoryPairs(list KVList) []historyPair {
+	if list == nil {
+		return nil
+	}
+	ret := []historyPair{}
+	for _, kv := range list {
+		// ProviderMongo hands back its internal _id as part of the document
+		if kv[0] == "_id" {
+			continue
+		}
+		ret = append(ret, historyPair{kv[0], kv[1]})
+	}
+	return ret
+}
+
+func historyPairs2KVList(pairs []historyPair) KVList {
+	// a document always holds its uuid, so no pairs means no document
+	if len(pairs) == 0 {
+		return nil
+	}
+	ret := KVList{}
+	for _, pair := range pairs {
+		ret = append(ret, [2]string{pair.Key, pair.Value})
+	}
+	return ret
+}
+
+// the history of one provider. Embedded in the providers, so its exported
+// methods are theirs
+type mongoHistory struct {
+	c      *mgo.Collection
+	policy HistoryPolicy
+}
+
+// the same history, read and written through another session
+func (h mongoHistory) with(ses *mgo.Session) mongoHistory {
+	if h.c != nil {
+		h.c = h.c.With(ses)
+	}
+	return h
+}
+
+// set up the history collection and start recording the feed's changes,
+// if the policy enables history
+func (h *mongoHistory) init(c *mgo.Collection, policy HistoryPolicy, feed *ChangeFeed) error {
+	h.c = c
+	h.policy = policy
+	if !policy.Enabled {
+		feed.record = nil
+		return nil
+	}
+	if err := h.c.EnsureIndex(mgo.Index{Key: []string{"uuid", "time", "seq"}}); err != nil {
+		return fmt.Errorf("Error indexing history: %v", err)
+	}
+	if err := h.c.EnsureIndex(mgo.Index{Key: []string{"time"}}); err != nil {
+		return fmt.Errorf("Error indexing history: %v", err)
+	}
+	if err := h.c.EnsureIndex(mgo.Index{Key: []string{"after.k", "after.v"}}); err != nil {
+		return fmt.Errorf("Error indexing history: %v", err)
+	}
+	feed.record = h.record
+	return nil
+}
+
+func (h *mongoHistory) record(ev ChangeEvent) error {
+	entry := historyEntry{
+		UUID:   ev.UUID,
+		Kind:   ev.Kind,
+		Time:   ev.Time,
+		Seq:    atomic.AddInt64(&historySeq, 1),
+		Before: kvList2HistoryPairs(ev.Before),
+		After:  kvList2HistoryPairs(ev.After),
+	}
+	if err := h.c.Insert(entry); err != nil {
+		return fmt.Errorf("Error recording history: %v", err)
+	}
+	return nil
+}
+
+func (h *mongoHistory) checkEnabled() error {
+	if !h.policy.Enabled {
+		return fmt.Errorf("History is not enabled for this provider")
+	}
+	return nil
+}
+
+// the entries whose snapshot holds every pair of a where clause, or nil to
+// select every entry if the clause is empty
+func historyWhereBson(where KVList) bson.M {
+	if len(where) == 0 {
+		return nil
+	}
+	conds := []bson.M{}
+	for _, kv := range where {
+		conds = append(conds, bson.M{"after": bson.M{"$elemMatch": bson.M{"k": kv[0], "v": kv[1]}}})
+	}
+	return bson.M{"$and": conds}
+}
+
+// the documents as they were at time t of the uuids with an entry selected by
+// cond, or of every uuid if cond is nil. Any document whose state at t
+// matches a query has an entry matching it, so with cond selecting such
+// entries only those uuids are grouped; the caller still checks their state
+func (h *mongoHistory) documentsAsOf(t time.Time, cond bson.M) ([]KVList, error) {
+	if err := h.checkEnabled(); err != nil {
+		return nil, err
+	}
+	if cond == nil {
+		return h.latestAsOf(bson.M{"time": bson.M{"$lte": t}})
+	}
+	match := bson.M{"time": bson.M{"$lte": t}}
+	for k, v := range cond {
+		match[k] = v
+	}
+	pipe := []bson.M{
+		bson.M{"$match": match},
+		bson.M{"$group": bson.M{"_id": "$uuid"}},
+	}
+	it := h.c.Pipe(pipe).AllowDiskUse().Iter()
+	uuids := []string{}
+	val := struct {
+		UUID string `bson:"_id"`
+	}{}
+	for it.Next(&val) {
+		uuids = append(uuids, val.UUID)
+	}
+	if err := it.Close(); err != nil {
+		return nil, fmt.Errorf("Error reading history: %v", err)
+	}
+	ret := []KVList{}
+	for len(uuids) > 0 {
+		n := historyBatch
+		if n > len(uuids) {
+			n = len(uuids)
+		}
+		docs, err := h.latestAsOf(bson.M{"uuid": bson.M{"$in": uuids[:n]}, "time": bson.M{"$lte": t}})
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, docs...)
+		uuids = uuids[n:]
+	}
+	return ret, nil
+}
+
+// the latest snapshot of each uuid among the entries match selects, leaving
+// out the documents that were deleted by then
+func (h *mongoHistory) latestAsOf(match bson.M) ([]KVList, error) {
+	pipe := []bson.M{
+		bson.M{"$match": match},
+		bson.M{"$sort": bson.D{{Name: "uuid", Value: 1}, {Name: "time", Value: -1}, {Name: "seq", Value: -1}}},
+		bson.M{"$group": bson.M{"_id": "$uuid", "after": bson.M{"$first": "$after"}}},
+	}
+	it := h.c.Pipe(pipe).AllowDiskUse().Iter()
+	ret := []KVList{}
+	val := struct {
+		After []historyPair `bson:"after"`
+	}{}
+	for it.Next(&val) {
+		if len(val.After) > 0 {
+			ret = append(ret, historyPairs2KVList(val.After))
+		}
+		val.After = nil
+	}
+	if err := it.Close(); err != nil {
+		return nil, fmt.Errorf("Error reading history: %v", err)
+	}
+	return ret, nil
+}
+
+// the documents as of time t that match a where clause
+func (h *mongoHistory) whereAsOf(where KVList, t time.Time) ([]KVList, error) {
+	docs, err := h.documentsAsOf(t, historyWhereBson(where))
+	if err != nil {
+		return nil, err
+	}
+	ret := []KVList{}
+	for _, doc := range docs {
+		if kvMatches(doc, where) {
+			ret = append(ret, doc)
+		}
+	}
+	return ret, nil
+}
+
+// the documents as of time t with a value for key that matches a glob
+func (h *mongoHistory) valueGlobAsOf(key, value_glob string, t time.Time) ([]KVList, error) {
+	g, err := ParseGlob(value_glob)
+	if err != nil {
+		return nil, err
+	}
+	cond := bson.M{"after": bson.M{"$elemMatch": bson.M{"k": key, "v": Glob2Bson(g)}}}
+	docs, err := h.documentsAsOf(t, cond)
+	if err != nil {
+		return nil, err
+	}
+	ret := []KVList{}
+	for _, doc := range docs {
+		if val, found := doc.Get(key); found && g.Match(val) {
+			ret = append(ret, doc)
+		}
+	}
+	return ret, nil
+}
+
+// get a single document by using a unique identifier, as it was at time t.
+// Its latest change at or before t is found by the (uuid, time, seq) index
+func (h *mongoHistory) getDocumentUniqueAsOf(uuid string, t time.Time) (KVList, error) {
+	if err := h.checkEnabled(); err != nil {
+		return nil, err
+	}
+	var entry historyEntry
+	err := h.c.Find(bson.M{"uuid": uuid, "time": bson.M{"$lte": t}}).Sort("-time", "-seq").One(&entry)
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, fmt.Errorf("Error reading history: %v", err)
+	}
+	// never recorded by then, or deleted
+	if err == mgo.ErrNotFound || len(entry.After) == 0 {
+		return nil, fmt.Errorf("Error finding unique document as of %v: %v", t, uuid)
+	}
+	return historyPairs2KVList(entry.After), nil
+}
+
+// get a set of documents using a where clause, as of time t
+func (h *mongoHistory) getDocumentSetWhereAsOf(where KVList, t time.Time) ([]KVList, error) {
+	return h.whereAsOf(where, t)
+}
+
+// get list of unique values for a given key, as of time t
+func (h *mongoHistory) getUniqueValuesAsOf(key string, t time.Time) ([]interface{}, error) {
+	counts, err := h.getUniqueValueCountsAsOf(key, t)
+	if err != nil {
+		return nil, err
+	}
+	ret := []interface{}{}
+	for value := range counts {
+		ret = append(ret, value)
+	}
+	return ret, nil
+}
+
+// get a set of documents with a key/value matching a glob, as of time t
+func (h *mongoHistory) getDocumentSetValueGlobAsOf(key, value_glob string, t time.Time) ([]KVList, error) {
+	return h.valueGlobAsOf(key, value_glob, t)
+}
+
+// get a set of keys that match a glob, as of time t
+func (h *mongoHistory) getKeyGlobAsOf(key_glob string, t time.Time) ([]string, error) {
+	g, err := ParseGlob(key_glob)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := h.documentsAsOf(t, bson.M{"after.k": Glob2Bson(g)})
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	ret := []string{}
+	for _, doc := range docs {
+		for _, kv := range doc {
+			if !seen[kv[0]] && g.Match(kv[0]) {
+				seen[kv[0]] = true
+				ret = append(ret, kv[0])
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// get the number of documents matching a where clause, as of time t
+func (h *mongoHistory) countWhereAsOf(where KVList, t time.Time) (int, error) {
+	docs, err := h.whereAsOf(where, t)
+	return len(docs), err
+}
+
+// get the number of documents with a key/value matching a glob, as of time t
+func (h *mongoHistory) countValueGlobAsOf(key, value_glob string, t time.Time) (int, error) {
+	docs, err := h.valueGlobAsOf(key, value_glob, t)
+	return len(docs), err
+}
+
+// check whether any document matched a where clause at time t
+func (h *mongoHistory) existsWhereAsOf(where KVList, t time.Time) (bool, error) {
+	docs, err := h.whereAsOf(where, t)
+	return len(docs) > 0, err
+}
+
+// get the number of documents holding each unique value for a given key, as of time t
+func (h *mongoHistory) getUniqueValueCountsAsOf(key string, t time.Time) (map[string]int, error) {
+	docs, err := h.documentsAsOf(t, bson.M{"after.k": key})
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]int{}
+	for _, doc := range docs {
+		if val, found := doc.Get(key); found {
+			ret[val]++
+		}
+	}
+	return ret, nil
+}
+
+// get every recorded change to a document, oldest first
+func (h *mongoHistory) getDocumentHistory(uuid string) ([]ChangeEvent, error) {
+	if err := h.checkEnabled(); err != nil {
+		return nil, err
+	}
+	var entries []historyEntry
+	err := h.c.Find(bson.M{"uuid": uuid}).Sort("time", "seq").All(&entries)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading document history: %v", err)
+	}
+	ret := []ChangeEvent{}
+	for _, entry := range entries {
+		ret = append(ret, ChangeEvent{
+			Kind:   entry.Kind,
+			UUID:   entry.UUID,
+			Before: historyPairs2KVList(entry.Before),
+			After:  historyPairs2KVList(entry.After),
+			Time:   entry.Time,
+		})
+	}
+	return ret, nil
+}
+
+// apply the retention and compaction policy to the recorded history.
+// Changes are grouped per document into buckets: everything before the
+// retention horizon is one bucket, and between the horizon and CompactAfter
+// each CompactInterval is a bucket. Only the last change in a bucket is kept,
+// since its snapshot is the document's state at the end of the bucket, and a
+// kept change before the horizon is dropped too if it was a delete
+func (h *mongoHistory) compactHistory() error {
+	if err := h.checkEnabled(); err != nil {
+		return err
+	}
+	now := time.Now()
+	var horizon, compactBefore time.Time
+	if h.policy.Retention > 0 {
+		horizon = now.Add(-h.policy.Retention)
+	}
+	if h.policy.CompactAfter > 0 && h.policy.CompactInterval > 0 {
+		compactBefore = now.Add(-h.policy.CompactAfter)
+	}
+	oldest := horizon
+	if compactBefore.After(oldest) {
+		oldest = compactBefore
+	}
+	if oldest.IsZero() {
+		return nil
+	}
+
+	it := h.c.Find(bson.M{"time": bson.M{"$lt": oldest}}).Sort("uuid", "time", "seq").Select(bson.M{"uuid": 1, "time": 1, "after": 1}).Iter()
+	remove := []interface{}{}
+	var last historyEntry
+	var lastBucket time.Time
+	entry := historyEntry{}
+	for it.Next(&entry) {
+		var bucket time.Time
+		if entry.Time.Before(horizon) {
+			bucket = horizon
+		} else {
+			bucket = entry.Time.Truncate(h.policy.CompactInterval)
+		}
+		if last.Id != "" {
+			if last.UUID == entry.UUID && lastBucket.Equal(bucket) {
+				remove = append(remove, last.Id)
+			} else if lastBucket.Equal(horizon) && len(last.After) == 0 {
+				remove = append(remove, last.Id)
+			}
+		}
+		last, lastBucket = entry, bucket
+		entry = historyEntry{}
+	}
+	if last.Id != "" && lastBucket.Equal(horizon) && len(last.After) == 0 {
+		remove = append(remove, last.Id)
+	}
+	if err := it.Close(); err != nil {
+		return fmt.Errorf("Error reading history for compaction: %v", err)
+	}
+	if len(remove) == 0 {
+		return nil
+	}
+	if _, err := h.c.RemoveAll(bson.M{"_id": bson.M{"$in": remove}}); err != nil {
+		return fmt.Errorf("Error compacting history: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// entries have to come back from Mongo as they went in, with a missing
+// snapshot still missing, or deleted documents would come back to life
+func TestHistoryEntryRoundTrip(t *testing.T) {
+	doc := KVList{{"_id", "\x01\x02"}, {"uuid", "a"}, {"Path", "/soda/1"}}
+	kept := KVList{{"uuid", "a"}, {"Path", "/soda/1"}}
+	for _, tc := range []struct {
+		kind          ChangeKind
+		before, after KVList
+		wantBefore    KVList
+		wantAfter     KVList
+	}{
+		{ChangeInsert, nil, doc, nil, kept},
+		{ChangeSet, doc, doc, kept, kept},
+		{ChangeDeleteDocument, doc, nil, kept, nil},
+	} {
+		in := historyEntry{
+			UUID:   "a",
+			Kind:   tc.kind,
+			Time:   time.Unix(1500000000, 0).UTC(),
+			Before: kvList2HistoryPairs(tc.before),
+			After:  kvList2HistoryPairs(tc.after),
+		}
+		raw, err := bson.Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out historyEntry
+		if err := bson.Unmarshal(raw, &out); err != nil {
+			t.Fatal(err)
+		}
+		before, after := historyPairs2KVList(out.Before), historyPairs2KVList(out.After)
+		if !reflect.DeepEqual(before, tc.wantBefore) || !reflect.DeepEqual(after, tc.wantAfter) {
+			t.Errorf("%v: got before %v after %v, want %v and %v", tc.kind, before, after, tc.wantBefore, tc.wantAfter)
+		}
+		if (tc.after == nil) != (out.After == nil) {
+			t.Errorf("%v: after stored as %#v", tc.kind, out.After)
+		}
+	}
+}
+
+// a document in the history state only while its last change has a snapshot
+func TestHistoryPairsEmpty(t *testing.T) {
+	if historyPairs2KVList([]historyPair{}) != nil {
+		t.Error("empty pairs should read as no document")
+	}
+	if kvList2HistoryPairs(nil) != nil {
+		t.Error("no document should have no pairs")
+	}
+}
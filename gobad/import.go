@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"code.google.com/p/go-uuid/uuid"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Loading real metadata, to benchmark on it or to fill a provider with it.
+//
+// sMAP-style JSON dumps hold one object per point, either as an array, as one
+// object after another, or as an object of points by path. Nested objects are
+// flattened to path keys, so {"Metadata": {"Location": {"Building": "Soda"}}}
+// becomes Metadata/Location/Building = Soda, and array elements are keyed by
+// their index. Time series under Readings are left out. CSV point lists have
+// a header of keys and a row per point, with empty cells left out.
+//
+// Points keep their uuid, if they have one that no point before them has.
+// The others get a fresh one whenever they are handed out
+
+// metadata loaded from dumps
+type MetadataDump struct {
+	// the points, each starting with its uuid, or "" if it has none of its
+	// own, then the keys of Keys it has, in that order, then the rest
+	Docs []KVList
+	// the ten keys most points have, most common first, repeated if there
+	// are fewer than ten
+	Keys []string
+	// every value of each key
+	Values map[string][]string
+}
+
+// load every file, each as JSON or CSV by its extension
+func LoadMetadataFiles(paths ...string) (*MetadataDump, error) {
+	docs := []KVList{}
+	for _, path := range paths {
+		var loaded []KVList
+		var err error
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".json", ".jsonl":
+			loaded, err = loadJSONMetadata(path)
+		case ".csv":
+			loaded, err = loadCSVMetadata(path)
+		default:
+			err = fmt.Errorf("Can't tell the format of %s: expected .json, .jsonl or .csv", path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, loaded...)
+	}
+	return newMetadataDump(docs)
+}
+
+// order the points' keys and index their values
+func newMetadataDump(docs []KVList) (*MetadataDump, error) {
+	d := &MetadataDump{Values: map[string][]string{}}
+	counts := map[string]int{}
+	seen := map[string]bool{}
+	for _, doc := range docs {
+		// a point with nothing but a uuid can't be queried for
+		if len(doc) < 2 {
+			continue
+		}
+		if seen[doc[0][1]] {
+			doc[0][1] = ""
+		} else if doc[0][1] != "" {
+			seen[doc[0][1]] = true
+		}
+		for _, kv := range doc[1:] {
+			counts[kv[0]]++
+			d.Values[kv[0]] = append(d.Values[kv[0]], kv[1])
+		}
+		d.Docs = append(d.Docs, doc)
+	}
+	if len(d.Docs) == 0 {
+		return nil, fmt.Errorf("No points with metadata found")
+	}
+
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > 10 {
+		keys = keys[:10]
+	}
+	for i := 0; len(d.Keys) < 10; i++ {
+		d.Keys = append(d.Keys, keys[i%len(keys)])
+	}
+
+	rank := map[string]int{}
+	for i, k := range keys {
+		rank[k] = i + 1
+	}
+	for _, doc := range d.Docs {
+		kvs := doc[1:]
+		sort.SliceStable(kvs, func(i, j int) bool {
+			ri, rj := rank[kvs[i][0]], rank[kvs[j][0]]
+			if ri == 0 || rj == 0 {
+				return ri != 0 && rj == 0
+			}
+			return ri < rj
+		})
+	}
+	return d, nil
+}
+
+// the uuid of a point: its "uuid" value, taken out of kvs
+func takeUUID(kvs KVList) (string, KVList) {
+	for i, kv := range kvs {
+		if kv[0] == "uuid" {
+			return kv[1], append(kvs[:i:i], kvs[i+1:]...)
+		}
+	}
+	return "", kvs
+}
+
+// a point from its key/value pairs, with its uuid first
+func newPoint(kvs KVList) KVList {
+	id, kvs := takeUUID(kvs)
+	return append(KVList{{"uuid", id}}, kvs...)
+}
+
+//== JSON
+
+func loadJSONMetadata(path string) ([]KVList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	dec.UseNumber()
+	docs := []KVList{}
+	for {
+		var v interface{}
+		if err := dec.Decode(&v); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not read %s: %v", path, err)
+		}
+		switch v := v.(type) {
+		case []interface{}:
+			for _, e := range v {
+				if obj, ok := e.(map[string]interface{}); ok {
+					docs = append(docs, jsonPoint(obj))
+				}
+			}
+		case map[string]interface{}:
+			if pointsByPath(v) {
+				paths := make([]string, 0, len(v))
+				for p := range v {
+					paths = append(paths, p)
+				}
+				sort.Strings(paths)
+				for _, p := range paths {
+					obj := v[p].(map[string]interface{})
+					if _, found := obj["Path"]; !found {
+						obj["Path"] = p
+					}
+					docs = append(docs, jsonPoint(obj))
+				}
+			} else {
+				docs = append(docs, jsonPoint(v))
+			}
+		}
+	}
+	return docs, nil
+}
+
+// whether an object is of points by their paths, rather than one point:
+// every key is a path and every value an object
+func pointsByPath(obj map[string]interface{}) bool {
+	if len(obj) == 0 {
+		return false
+	}
+	for k, v := range obj {
+		if _, ok := v.(map[string]interface{}); !ok || !strings.HasPrefix(k, "/") {
+			return false
+		}
+	}
+	return true
+}
+
+func jsonPoint(obj map[string]interface{}) KVList {
+	delete(obj, "Readings")
+	kvs := KVList{}
+	flatten("", obj, &kvs)
+	return newPoint(kvs)
+}
+
+// add the leaves of v to kvs, keyed by their path from prefix
+func flatten(prefix string, v interface{}, kvs *KVList) {
+	join := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "/" + k
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			flatten(join(k), v[k], kvs)
+		}
+	case []interface{}:
+		for i, e := range v {
+			flatten(join(fmt.Sprint(i)), e, kvs)
+		}
+	case nil:
+	default:
+		*kvs = append(*kvs, [2]string{prefix, fmt.Sprint(v)})
+	}
+}
+
+//== CSV
+
+func loadCSVMetadata(path string) ([]KVList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(bufio.NewReader(f))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the header of %s: %v", path, err)
+	}
+	for i, k := range header {
+		header[i] = strings.TrimSpace(k)
+		if strings.EqualFold(header[i], "uuid") {
+			header[i] = "uuid"
+		}
+	}
+	docs := []KVList{}
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not read %s: %v", path, err)
+		}
+		kvs := KVList{}
+		for i, cell := range row {
+			if cell = strings.TrimSpace(cell); cell != "" && i < len(header) && header[i] != "" {
+				kvs = append(kvs, [2]string{header[i], cell})
+			}
+		}
+		docs = append(docs, newPoint(kvs))
+	}
+	return docs, nil
+}
+
+//== as a dataset
+
+// the dump the import dataset runs on, loaded by main from -import
+var ImportedMetadata *MetadataDump
+
+// ImportedDocuments hands out the points of a dump in turn, starting over
+// when they run out. A point keeps its own uuid the first time round, and
+// gets a fresh one after that, so no two documents handed out share one
+type ImportedDocuments struct {
+	dump *MetadataDump
+	rng  *rand.Rand
+	next int
+}
+
+func NewImportedDocuments(dump *MetadataDump, rng *rand.Rand) *ImportedDocuments {
+	return &ImportedDocuments{dump: dump, rng: rng}
+}
+
+func (g *ImportedDocuments) Keys() []string {
+	return g.dump.Keys
+}
+
+func (g *ImportedDocuments) Generate(count int) []KVList {
+	docs := make([]KVList, count)
+	for i := range docs {
+		doc := append(KVList(nil), g.dump.Docs[g.next%len(g.dump.Docs)]...)
+		if doc[0][1] == "" || g.next >= len(g.dump.Docs) {
+			doc[0][1] = uuid.New()
+		}
+		g.next++
+		docs[i] = doc
+	}
+	return docs
+}
+
+// one of the values the dump has for key, or for any key if it has none
+func (g *ImportedDocuments) Value(key string) string {
+	values := g.dump.Values[key]
+	if len(values) == 0 {
+		values = g.dump.Values[g.dump.Keys[0]]
+	}
+	return values[g.rng.Intn(len(values))]
+}
+
+//== gobad import
+
+// load every point of the dump into a provider, batch at a time
+func BulkLoad(ctx context.Context, mq MetadataQuery, dump *MetadataDump, batch int) error {
+	docs := NewImportedDocuments(dump, nil).Generate(len(dump.Docs))
+	failed, err := mq.BulkInsertDocument(ctx, docs, batch)
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d points failed to load, first: %v", len(failed), failed[0].Err)
+	}
+	return nil
+}
+
+// run gobad import with the arguments after "import", returning the exit status
+func importMain(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	provider := fs.String("provider", "mongo", "provider to load into: "+strings.Join(Providers, ", "))
+	url := fs.String("mongo", "", "MongoDB URL (default $MONGODB_SERVER)")
+	prefix := fs.String("prefix", "", "prefix of the provider's database names")
+	batch := fs.Int("batch", FACTOR, "points inserted per batch")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: gobad import [flags] dump.json|points.csv...|export.jsonl\n"+
+			"Replaces what the provider holds with the points of the dumps, or with\n"+
+			"the documents of a gobad export.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 || *batch < 1 {
+		fs.Usage()
+		return 2
+	}
+	// an export from gobad export or migrate is loaded as it is, uuids and all
+	export := false
+	if fs.NArg() == 1 {
+		var err error
+		if export, err = isExportFile(fs.Arg(0)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	var dump *MetadataDump
+	if !export {
+		var err error
+		if dump, err = LoadMetadataFiles(fs.Args()...); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	spec := DefaultWorkload
+	spec.Mongo.URL = *url
+	spec.Mongo.DBPrefix = *prefix
+	mq, err := NewProvider(*provider, spec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	ctx := context.Background()
+	if err := mq.Initialize(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer mq.Close()
+	if export {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		hashes, err := ImportDocuments(ctx, mq, f, *batch)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("loaded %d documents into %s\n", len(hashes), *provider)
+		return 0
+	}
+	if err := BulkLoad(ctx, mq, dump, *batch); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("loaded %d points into %s; most common keys: %s\n", len(dump.Docs), *provider, strings.Join(dump.Keys, ", "))
+	return 0
+}
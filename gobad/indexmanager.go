@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+)
+
+// An IndexManager lets a benchmark choose the indexes a provider's metadata is
+// stored with. Index keys name fields of the provider's physical layout: for
+// ProviderMongo these are metadata keys such as "uuid", for
+// ProviderMongoExploded they are the row fields "key", "value" and "docid".
+// A list of several keys is a compound index, in that order
+type IndexManager interface {
+
+	// create an index on the given keys, unless it exists already
+	EnsureIndex(ctx context.Context, keys ...string) error
+
+	// drop the index on exactly the given keys
+	DropIndex(ctx context.Context, keys ...string) error
+
+	// list the keys of every index that can be dropped
+	ListIndexes(ctx context.Context) ([][]string, error)
+}
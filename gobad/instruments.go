@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Instruments record every call made through an instrumented provider: per
+// method, how many calls there were, how many failed, how long they took and
+// how big their results were. InstrumentedMetadataQuery and
+// InstrumentedBosswaveQuery wrap any provider with them, so code built on a
+// provider gets the same telemetry the benchmarks do
+
+// latency histogram buckets, by powers of two microseconds. The last bucket
+// holds everything from about half an hour up
+const latencyBuckets = 32
+
+type CallStats struct {
+	Calls  int
+	Errors int
+
+	// Latency[i] counts the calls that took less than 2^i µs but at least
+	// 2^(i-1) µs, so Latency[0] counts those under 1 µs
+	Latency [latencyBuckets]int
+	// total time spent in calls, in µs
+	TotalLatency float64
+
+	// total size of the results of successful calls: the number of documents,
+	// keys or values returned, the k/v pairs of a single document, or the
+	// number counted. Writes return nothing
+	Results int
+}
+
+// the latency in µs below which a fraction q of the calls finished, to the
+// resolution of the histogram
+func (s CallStats) Percentile(q float64) float64 {
+	need := int(q*float64(s.Calls) + 0.5)
+	if need < 1 {
+		need = 1
+	}
+	seen := 0
+	for i, n := range s.Latency {
+		seen += n
+		if seen >= need {
+			return float64(uint64(1) << uint(i))
+		}
+	}
+	return float64(uint64(1) << uint(latencyBuckets-1))
+}
+
+type Instruments struct {
+	lock  sync.Mutex
+	calls map[string]*CallStats
+	// µs spent in every call so far, kept through Reset
+	elapsed float64
+}
+
+func (in *Instruments) observe(method string, start time.Time, results int, err error) {
+	us := Report.FinishTimer(start)
+	bucket := 0
+	for bucket < latencyBuckets-1 && float64(uint64(1)<<uint(bucket)) <= us {
+		bucket++
+	}
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	if in.calls == nil {
+		in.calls = map[string]*CallStats{}
+	}
+	s, found := in.calls[method]
+	if !found {
+		s = &CallStats{}
+		in.calls[method] = s
+	}
+	in.elapsed += us
+	s.Calls++
+	s.Latency[bucket]++
+	s.TotalLatency += us
+	if err != nil {
+		s.Errors++
+	} else {
+		s.Results += results
+	}
+}
+
+// the stats of every method called since the last Reset
+func (in *Instruments) Stats() map[string]CallStats {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	ret := map[string]CallStats{}
+	for method, s := range in.calls {
+		ret[method] = *s
+	}
+	return ret
+}
+
+// the time spent in every call recorded so far, in µs. Reset leaves it be, so
+// the time spent in a stretch of calls is the difference over it
+func (in *Instruments) Elapsed() float64 {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	return in.elapsed
+}
+
+func (in *Instruments) Reset() {
+	in.lock.Lock()
+	in.calls = nil
+	in.lock.Unlock()
+}
+
+// report the stats since the last call as metrics, one set per method, and reset them
+func (in *Instruments) ReportStats(provider string, run int) {
+	stats := in.Stats()
+	in.Reset()
+	methods := []string{}
+	for method := range stats {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		s := stats[method]
+		Report.Metric(provider, method+".Calls", run, float64(s.Calls))
+		Report.Metric(provider, method+".Errors", run, float64(s.Errors))
+		Report.Metric(provider, method+".Results", run, float64(s.Results))
+		Report.Metric(provider, method+".MeanLatency", run, s.TotalLatency/float64(s.Calls))
+		Report.Metric(provider, method+".P50Latency", run, s.Percentile(0.5))
+		Report.Metric(provider, method+".P99Latency", run, s.Percentile(0.99))
+	}
+}
+
+func boolSize(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+//== InstrumentedMetadataQuery
+
+type InstrumentedMetadataQuery struct {
+	Instruments
+	mq MetadataQuery
+}
+
+func NewInstrumentedMetadataQuery(mq MetadataQuery) *InstrumentedMetadataQuery {
+	return &InstrumentedMetadataQuery{mq: mq}
+}
+
+// the provider being instrumented
+func (i *InstrumentedMetadataQuery) Unwrap() MetadataQuery {
+	return i.mq
+}
+
+func (i *InstrumentedMetadataQuery) Initialize(ctx context.Context) error {
+	st := time.Now()
+	err := i.mq.Initialize(ctx)
+	i.observe("Initialize", st, 0, err)
+	return err
+}
+
+func (i *InstrumentedMetadataQuery) Close() error {
+	st := time.Now()
+	err := i.mq.Close()
+	i.observe("Close", st, 0, err)
+	return err
+}
+
+func (i *InstrumentedMetadataQuery) Subscribe(ctx context.Context, where KVList) *Subscription {
+	st := time.Now()
+	sub := i.mq.Subscribe(ctx, where)
+	i.observe("Subscribe", st, 0, nil)
+	return sub
+}
+
+func (i *InstrumentedMetadataQuery) GetDocumentUnique(ctx context.Context, uuid string) (KVList, error) {
+	st := time.Now()
+	r, err := i.mq.GetDocumentUnique(ctx, uuid)
+	i.observe("GetDocumentUnique", st, len(r), err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) GetDocumentSetWhere(ctx context.Context, where KVList) ([]KVList, error) {
+	st := time.Now()
+	r, err := i.mq.GetDocumentSetWhere(ctx, where)
+	i.observe("GetDocumentSetWhere", st, len(r), err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) GetUniqueValues(ctx context.Context, key string) ([]interface{}, error) {
+	st := time.Now()
+	r, err := i.mq.GetUniqueValues(ctx, key)
+	i.observe("GetUniqueValues", st, len(r), err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) GetDocumentSetValueGlob(ctx context.Context, key, value_glob string) ([]KVList, error) {
+	st := time.Now()
+	r, err := i.mq.GetDocumentSetValueGlob(ctx, key, value_glob)
+	i.observe("GetDocumentSetValueGlob", st, len(r), err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) GetKeyGlob(ctx context.Context, key_glob string) ([]string, error) {
+	st := time.Now()
+	r, err := i.mq.GetKeyGlob(ctx, key_glob)
+	i.observe("GetKeyGlob", st, len(r), err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) CountWhere(ctx context.Context, where KVList) (int, error) {
+	st := time.Now()
+	r, err := i.mq.CountWhere(ctx, where)
+	i.observe("CountWhere", st, r, err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) CountValueGlob(ctx context.Context, key, value_glob string) (int, error) {
+	st := time.Now()
+	r, err := i.mq.CountValueGlob(ctx, key, value_glob)
+	i.observe("CountValueGlob", st, r, err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) ExistsWhere(ctx context.Context, where KVList) (bool, error) {
+	st := time.Now()
+	r, err := i.mq.ExistsWhere(ctx, where)
+	i.observe("ExistsWhere", st, boolSize(r), err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) GetUniqueValueCounts(ctx context.Context, key string) (map[string]int, error) {
+	st := time.Now()
+	r, err := i.mq.GetUniqueValueCounts(ctx, key)
+	i.observe("GetUniqueValueCounts", st, len(r), err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) InsertDocument(ctx context.Context, docs []KVList) error {
+	st := time.Now()
+	err := i.mq.InsertDocument(ctx, docs)
+	i.observe("InsertDocument", st, 0, err)
+	return err
+}
+
+func (i *InstrumentedMetadataQuery) BulkInsertDocument(ctx context.Context, docs []KVList, batchsize int) ([]DocumentError, error) {
+	st := time.Now()
+	r, err := i.mq.BulkInsertDocument(ctx, docs, batchsize)
+	i.observe("BulkInsertDocument", st, 0, err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) BulkSetKVDocumentUnique(ctx context.Context, updates []DocumentUpdate, batchsize int) ([]DocumentError, error) {
+	st := time.Now()
+	r, err := i.mq.BulkSetKVDocumentUnique(ctx, updates, batchsize)
+	i.observe("BulkSetKVDocumentUnique", st, 0, err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) UpsertDocument(ctx context.Context, doc KVList) error {
+	st := time.Now()
+	err := i.mq.UpsertDocument(ctx, doc)
+	i.observe("UpsertDocument", st, 0, err)
+	return err
+}
+
+func (i *InstrumentedMetadataQuery) SetKVDocumentUnique(ctx context.Context, kv KVList, uuid string) error {
+	st := time.Now()
+	err := i.mq.SetKVDocumentUnique(ctx, kv, uuid)
+	i.observe("SetKVDocumentUnique", st, 0, err)
+	return err
+}
+
+func (i *InstrumentedMetadataQuery) SetKVDocumentWhere(ctx context.Context, kv, where KVList) error {
+	st := time.Now()
+	err := i.mq.SetKVDocumentWhere(ctx, kv, where)
+	i.observe("SetKVDocumentWhere", st, 0, err)
+	return err
+}
+
+func (i *InstrumentedMetadataQuery) SetKVDocumentValueGlob(ctx context.Context, kv KVList, key, value_glob string) error {
+	st := time.Now()
+	err := i.mq.SetKVDocumentValueGlob(ctx, kv, key, value_glob)
+	i.observe("SetKVDocumentValueGlob", st, 0, err)
+	return err
+}
+
+func (i *InstrumentedMetadataQuery) ReplaceDocumentUnique(ctx context.Context, doc KVList, uuid string) error {
+	st := time.Now()
+	err := i.mq.ReplaceDocumentUnique(ctx, doc, uuid)
+	i.observe("ReplaceDocumentUnique", st, 0, err)
+	return err
+}
+
+func (i *InstrumentedMetadataQuery) DeleteKeyDocumentUnique(ctx context.Context, keys []string, uuid string) error {
+	st := time.Now()
+	err := i.mq.DeleteKeyDocumentUnique(ctx, keys, uuid)
+	i.observe("DeleteKeyDocumentUnique", st, 0, err)
+	return err
+}
+
+func (i *InstrumentedMetadataQuery) DeleteKeyDocumentWhere(ctx context.Context, keys []string, where KVList) error {
+	st := time.Now()
+	err := i.mq.DeleteKeyDocumentWhere(ctx, keys, where)
+	i.observe("DeleteKeyDocumentWhere", st, 0, err)
+	return err
+}
+
+func (i *InstrumentedMetadataQuery) DeleteKeyGlobDocumentUnique(ctx context.Context, key_glob, uuid string) error {
+	st := time.Now()
+	err := i.mq.DeleteKeyGlobDocumentUnique(ctx, key_glob, uuid)
+	i.observe("DeleteKeyGlobDocumentUnique", st, 0, err)
+	return err
+}
+
+func (i *InstrumentedMetadataQuery) DeleteKeyGlobDocumentWhere(ctx context.Context, key_glob string, where KVList) error {
+	st := time.Now()
+	err := i.mq.DeleteKeyGlobDocumentWhere(ctx, key_glob, where)
+	i.observe("DeleteKeyGlobDocumentWhere", st, 0, err)
+	return err
+}
+
+func (i *InstrumentedMetadataQuery) DeleteDocumentUnique(ctx context.Context, uuid string) error {
+	st := time.Now()
+	err := i.mq.DeleteDocumentUnique(ctx, uuid)
+	i.observe("DeleteDocumentUnique", st, 0, err)
+	return err
+}
+
+func (i *InstrumentedMetadataQuery) DeleteDocumentsWhere(ctx context.Context, where KVList) error {
+	st := time.Now()
+	err := i.mq.DeleteDocumentsWhere(ctx, where)
+	i.observe("DeleteDocumentsWhere", st, 0, err)
+	return err
+}
+
+func (i *InstrumentedMetadataQuery) ApplyBatch(ctx context.Context, batch *MetadataBatch) (bool, error) {
+	st := time.Now()
+	r, err := i.mq.ApplyBatch(ctx, batch)
+	i.observe("ApplyBatch", st, 0, err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) GetDocumentUniqueAsOf(ctx context.Context, uuid string, t time.Time) (KVList, error) {
+	st := time.Now()
+	r, err := i.mq.GetDocumentUniqueAsOf(ctx, uuid, t)
+	i.observe("GetDocumentUniqueAsOf", st, len(r), err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) GetDocumentSetWhereAsOf(ctx context.Context, where KVList, t time.Time) ([]KVList, error) {
+	st := time.Now()
+	r, err := i.mq.GetDocumentSetWhereAsOf(ctx, where, t)
+	i.observe("GetDocumentSetWhereAsOf", st, len(r), err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) GetUniqueValuesAsOf(ctx context.Context, key string, t time.Time) ([]interface{}, error) {
+	st := time.Now()
+	r, err := i.mq.GetUniqueValuesAsOf(ctx, key, t)
+	i.observe("GetUniqueValuesAsOf", st, len(r), err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) GetDocumentSetValueGlobAsOf(ctx context.Context, key, value_glob string, t time.Time) ([]KVList, error) {
+	st := time.Now()
+	r, err := i.mq.GetDocumentSetValueGlobAsOf(ctx, key, value_glob, t)
+	i.observe("GetDocumentSetValueGlobAsOf", st, len(r), err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) GetKeyGlobAsOf(ctx context.Context, key_glob string, t time.Time) ([]string, error) {
+	st := time.Now()
+	r, err := i.mq.GetKeyGlobAsOf(ctx, key_glob, t)
+	i.observe("GetKeyGlobAsOf", st, len(r), err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) CountWhereAsOf(ctx context.Context, where KVList, t time.Time) (int, error) {
+	st := time.Now()
+	r, err := i.mq.CountWhereAsOf(ctx, where, t)
+	i.observe("CountWhereAsOf", st, r, err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) CountValueGlobAsOf(ctx context.Context, key, value_glob string, t time.Time) (int, error) {
+	st := time.Now()
+	r, err := i.mq.CountValueGlobAsOf(ctx, key, value_glob, t)
+	i.observe("CountValueGlobAsOf", st, r, err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) ExistsWhereAsOf(ctx context.Context, where KVList, t time.Time) (bool, error) {
+	st := time.Now()
+	r, err := i.mq.ExistsWhereAsOf(ctx, where, t)
+	i.observe("ExistsWhereAsOf", st, boolSize(r), err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) GetUniqueValueCountsAsOf(ctx context.Context, key string, t time.Time) (map[string]int, error) {
+	st := time.Now()
+	r, err := i.mq.GetUniqueValueCountsAsOf(ctx, key, t)
+	i.observe("GetUniqueValueCountsAsOf", st, len(r), err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) GetDocumentHistory(ctx context.Context, uuid string) ([]ChangeEvent, error) {
+	st := time.Now()
+	r, err := i.mq.GetDocumentHistory(ctx, uuid)
+	i.observe("GetDocumentHistory", st, len(r), err)
+	return r, err
+}
+
+func (i *InstrumentedMetadataQuery) CompactHistory(ctx context.Context) error {
+	st := time.Now()
+	err := i.mq.CompactHistory(ctx)
+	i.observe("CompactHistory", st, 0, err)
+	return err
+}
+
+//== InstrumentedBosswaveQuery
+
+type InstrumentedBosswaveQuery struct {
+	Instruments
+	bq BosswaveQuery
+}
+
+func NewInstrumentedBosswaveQuery(bq BosswaveQuery) *InstrumentedBosswaveQuery {
+	return &InstrumentedBosswaveQuery{bq: bq}
+}
+
+func (i *InstrumentedBosswaveQuery) Initialize(ctx context.Context) error {
+	st := time.Now()
+	err := i.bq.Initialize(ctx)
+	i.observe("Initialize", st, 0, err)
+	return err
+}
+
+func (i *InstrumentedBosswaveQuery) Close() error {
+	st := time.Now()
+	err := i.bq.Close()
+	i.observe("Close", st, 0, err)
+	return err
+}
+
+func (i *InstrumentedBosswaveQuery) GetRecord(ctx context.Context, key string) (BosswaveRecord, error) {
+	st := time.Now()
+	r, err := i.bq.GetRecord(ctx, key)
+	i.observe("GetRecord", st, 1, err)
+	return r, err
+}
+
+func (i *InstrumentedBosswaveQuery) InsertRecord(ctx context.Context, r BosswaveRecord) error {
+	st := time.Now()
+	err := i.bq.InsertRecord(ctx, r)
+	i.observe("InsertRecord", st, 0, err)
+	return err
+}
+
+func (i *InstrumentedBosswaveQuery) GetKeysUpToSlash(ctx context.Context, keyprefix string) ([]string, error) {
+	st := time.Now()
+	r, err := i.bq.GetKeysUpToSlash(ctx, keyprefix)
+	i.observe("GetKeysUpToSlash", st, len(r), err)
+	return r, err
+}
+
+func (i *InstrumentedBosswaveQuery) SumSize(ctx context.Context, AllocSet int64) (int64, error) {
+	st := time.Now()
+	r, err := i.bq.SumSize(ctx, AllocSet)
+	i.observe("SumSize", st, 1, err)
+	return r, err
+}
+
+func (i *InstrumentedBosswaveQuery) CreateAllocSet(ctx context.Context, r AllocationSet) error {
+	st := time.Now()
+	err := i.bq.CreateAllocSet(ctx, r)
+	i.observe("CreateAllocSet", st, 0, err)
+	return err
+}
+
+func (i *InstrumentedBosswaveQuery) GetAllocSetID(ctx context.Context, vk VK) (int64, error) {
+	st := time.Now()
+	r, err := i.bq.GetAllocSetID(ctx, vk)
+	i.observe("GetAllocSetID", st, 1, err)
+	return r, err
+}
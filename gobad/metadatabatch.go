@@ -0,0 +1,77 @@
+package main
+
+// A MetadataBatch collects set and delete operations so that a provider can
+// apply them all at once with MetadataQuery.ApplyBatch. Operations are applied
+// in the order they were added, and each sees the effect of the ones before it.
+// The methods mirror the MetadataQuery operations of the same name
+
+type BatchOpKind int
+
+const (
+	BatchSetKV BatchOpKind = iota
+	BatchDeleteKeys
+	BatchDeleteKeyGlob
+)
+
+// the documents a batch operation applies to: those matching Where and,
+// if Key is set, having a value for Key that matches ValueGlob
+type BatchSelector struct {
+	Where     KVList
+	Key       string
+	ValueGlob string
+}
+
+type BatchOp struct {
+	Kind   BatchOpKind
+	Select BatchSelector
+
+	// k/v pairs to set, for BatchSetKV
+	KV KVList
+	// keys to delete, for BatchDeleteKeys
+	Keys []string
+	// glob of keys to delete, for BatchDeleteKeyGlob
+	KeyGlob string
+}
+
+type MetadataBatch struct {
+	Ops []BatchOp
+}
+
+func whereUUID(uuid string) BatchSelector {
+	return BatchSelector{Where: KVList{[2]string{"uuid", uuid}}}
+}
+
+// set k/v pairs in unique document
+func (b *MetadataBatch) SetKVDocumentUnique(kv KVList, uuid string) {
+	b.Ops = append(b.Ops, BatchOp{Kind: BatchSetKV, Select: whereUUID(uuid), KV: kv})
+}
+
+// set k/v pairs in set of documents using where clause
+func (b *MetadataBatch) SetKVDocumentWhere(kv, where KVList) {
+	b.Ops = append(b.Ops, BatchOp{Kind: BatchSetKV, Select: BatchSelector{Where: where}, KV: kv})
+}
+
+// set k/v pairs for set of documents with k/v matching glob
+func (b *MetadataBatch) SetKVDocumentValueGlob(kv KVList, key, value_glob string) {
+	b.Ops = append(b.Ops, BatchOp{Kind: BatchSetKV, Select: BatchSelector{Key: key, ValueGlob: value_glob}, KV: kv})
+}
+
+// delete list of keys in unique document
+func (b *MetadataBatch) DeleteKeyDocumentUnique(keys []string, uuid string) {
+	b.Ops = append(b.Ops, BatchOp{Kind: BatchDeleteKeys, Select: whereUUID(uuid), Keys: keys})
+}
+
+// delete list of keys in set of documents using where clause
+func (b *MetadataBatch) DeleteKeyDocumentWhere(keys []string, where KVList) {
+	b.Ops = append(b.Ops, BatchOp{Kind: BatchDeleteKeys, Select: BatchSelector{Where: where}, Keys: keys})
+}
+
+// delete keys that match glob in unique document
+func (b *MetadataBatch) DeleteKeyGlobDocumentUnique(key_glob, uuid string) {
+	b.Ops = append(b.Ops, BatchOp{Kind: BatchDeleteKeyGlob, Select: whereUUID(uuid), KeyGlob: key_glob})
+}
+
+// delete keys that match glob in set of documents using where clause
+func (b *MetadataBatch) DeleteKeyGlobDocumentWhere(key_glob string, where KVList) {
+	b.Ops = append(b.Ops, BatchOp{Kind: BatchDeleteKeyGlob, Select: BatchSelector{Where: where}, KeyGlob: key_glob})
+}
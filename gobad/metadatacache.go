@@ -0,0 +1,398 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// A MetadataCache wraps any MetadataQuery provider with a cache. Documents
+// fetched by GetDocumentUnique are kept in an LRU by uuid, and the results of
+// GetUniqueValues are memoised per key. Every write goes through to the
+// provider and invalidates what it may have changed: the cached documents it
+// selects, which the cache can test itself since they are current, and the
+// unique values of the keys it sets or deletes. All other operations pass
+// straight through. Writes made to the store other than through the cache
+// are not seen, so a cache must be the only writer of its provider
+type MetadataCache struct {
+	MetadataQuery
+
+	lock     sync.Mutex
+	capacity int
+	// most recently used first; each element holds a *cachedDocument
+	lru    *list.List
+	byUUID map[string]*list.Element
+	values map[string][]interface{}
+	// bumped on every invalidation, so a read that raced with a write can
+	// tell not to cache its now stale result
+	generation uint64
+
+	docHits, docMisses     int
+	valueHits, valueMisses int
+}
+
+type cachedDocument struct {
+	uuid string
+	doc  KVList
+}
+
+// wrap mq in a cache of up to capacity documents
+func NewMetadataCache(mq MetadataQuery, capacity int) *MetadataCache {
+	c := &MetadataCache{MetadataQuery: mq, capacity: capacity}
+	c.clear()
+	return c
+}
+
+// the provider behind the cache
+func (c *MetadataCache) Unwrap() MetadataQuery {
+	return c.MetadataQuery
+}
+
+func (c *MetadataCache) clear() {
+	c.lru = list.New()
+	c.byUUID = map[string]*list.Element{}
+	c.values = map[string][]interface{}{}
+	c.generation++
+}
+
+// report the hit and miss counts since the last call as metrics, and reset them
+func (c *MetadataCache) ReportStats(provider string, run int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	Report.Metric(provider, "CacheDocumentHits", run, float64(c.docHits))
+	Report.Metric(provider, "CacheDocumentMisses", run, float64(c.docMisses))
+	Report.Metric(provider, "CacheUniqueValuesHits", run, float64(c.valueHits))
+	Report.Metric(provider, "CacheUniqueValuesMisses", run, float64(c.valueMisses))
+	c.docHits, c.docMisses, c.valueHits, c.valueMisses = 0, 0, 0, 0
+}
+
+//== invalidation, with c.lock held
+
+func (c *MetadataCache) dropUUID(uuid string) {
+	if el, found := c.byUUID[uuid]; found {
+		c.lru.Remove(el)
+		delete(c.byUUID, uuid)
+	}
+	c.generation++
+}
+
+// drop the cached documents that match sel. An invalid glob fails the write
+// before it changes anything, so it has nothing to drop
+func (c *MetadataCache) dropSelected(sel BatchSelector) {
+	var g *Glob
+	if sel.Key != "" {
+		var err error
+		if g, err = ParseGlob(sel.ValueGlob); err != nil {
+			return
+		}
+	}
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		cd := el.Value.(*cachedDocument)
+		if kvMatches(cd.doc, sel.Where) {
+			if g == nil {
+				c.dropUUID(cd.uuid)
+			} else if val, found := cd.doc.Get(sel.Key); found && g.Match(val) {
+				c.dropUUID(cd.uuid)
+			}
+		}
+		el = next
+	}
+	c.generation++
+}
+
+func (c *MetadataCache) dropValues(keys ...string) {
+	for _, key := range keys {
+		delete(c.values, key)
+	}
+	c.generation++
+}
+
+func (c *MetadataCache) dropValuesKV(kv KVList) {
+	for _, pair := range kv {
+		c.dropValues(pair[0])
+	}
+}
+
+func (c *MetadataCache) dropValuesGlob(key_glob string) {
+	g, err := ParseGlob(key_glob)
+	if err != nil {
+		return
+	}
+	for key := range c.values {
+		if g.Match(key) {
+			delete(c.values, key)
+		}
+	}
+	c.generation++
+}
+
+// drop the unique values of every key of a document. If the document isn't
+// cached its keys are unknown, and all unique values go
+func (c *MetadataCache) dropDocumentValues(uuid string) {
+	if el, found := c.byUUID[uuid]; found {
+		c.dropValuesKV(el.Value.(*cachedDocument).doc)
+	} else {
+		c.values = map[string][]interface{}{}
+		c.generation++
+	}
+}
+
+// Do any initial config. The provider starts over empty, and so does the cache
+func (c *MetadataCache) Initialize(ctx context.Context) error {
+	err := c.MetadataQuery.Initialize(ctx)
+	c.lock.Lock()
+	c.clear()
+	c.lock.Unlock()
+	return err
+}
+
+// Get Operations
+
+// get a single document by using a unique identifier
+func (c *MetadataCache) GetDocumentUnique(ctx context.Context, uuid string) (KVList, error) {
+	c.lock.Lock()
+	if el, found := c.byUUID[uuid]; found {
+		c.lru.MoveToFront(el)
+		c.docHits++
+		doc := el.Value.(*cachedDocument).doc
+		c.lock.Unlock()
+		return doc, nil
+	}
+	c.docMisses++
+	gen := c.generation
+	c.lock.Unlock()
+
+	doc, err := c.MetadataQuery.GetDocumentUnique(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.generation != gen || c.capacity <= 0 {
+		return doc, nil
+	}
+	if _, found := c.byUUID[uuid]; !found {
+		c.byUUID[uuid] = c.lru.PushFront(&cachedDocument{uuid: uuid, doc: doc})
+		if c.lru.Len() > c.capacity {
+			oldest := c.lru.Back()
+			c.lru.Remove(oldest)
+			delete(c.byUUID, oldest.Value.(*cachedDocument).uuid)
+		}
+	}
+	return doc, nil
+}
+
+// get list of unique values for a given key
+func (c *MetadataCache) GetUniqueValues(ctx context.Context, key string) ([]interface{}, error) {
+	c.lock.Lock()
+	if res, found := c.values[key]; found {
+		c.valueHits++
+		c.lock.Unlock()
+		return res, nil
+	}
+	c.valueMisses++
+	gen := c.generation
+	c.lock.Unlock()
+
+	res, err := c.MetadataQuery.GetUniqueValues(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.generation == gen {
+		c.values[key] = res
+	}
+	return res, nil
+}
+
+// Set Operations
+// The write goes to the provider first and the cache is invalidated after,
+// so a read between the two can't cache the old state for long: its
+// generation check fails. A failed write may still have changed some
+// documents, so the cache is invalidated either way
+
+// insert list of documents
+func (c *MetadataCache) InsertDocument(ctx context.Context, docs []KVList) error {
+	err := c.MetadataQuery.InsertDocument(ctx, docs)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, doc := range docs {
+		if uuid, found := doc.Get("uuid"); found {
+			c.dropUUID(uuid)
+		}
+		c.dropValuesKV(doc)
+	}
+	return err
+}
+
+// insert or merge a document by its uuid
+func (c *MetadataCache) UpsertDocument(ctx context.Context, doc KVList) error {
+	err := c.MetadataQuery.UpsertDocument(ctx, doc)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if uuid, found := doc.Get("uuid"); found {
+		c.dropUUID(uuid)
+	}
+	c.dropValuesKV(doc)
+	return err
+}
+
+// insert documents in batches of batchsize
+func (c *MetadataCache) BulkInsertDocument(ctx context.Context, docs []KVList, batchsize int) ([]DocumentError, error) {
+	failed, err := c.MetadataQuery.BulkInsertDocument(ctx, docs, batchsize)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, doc := range docs {
+		if uuid, found := doc.Get("uuid"); found {
+			c.dropUUID(uuid)
+		}
+		c.dropValuesKV(doc)
+	}
+	return failed, err
+}
+
+// set k/v pairs in many unique documents, in batches of batchsize
+func (c *MetadataCache) BulkSetKVDocumentUnique(ctx context.Context, updates []DocumentUpdate, batchsize int) ([]DocumentError, error) {
+	failed, err := c.MetadataQuery.BulkSetKVDocumentUnique(ctx, updates, batchsize)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, update := range updates {
+		c.dropUUID(update.UUID)
+		c.dropValuesKV(update.KV)
+	}
+	return failed, err
+}
+
+// set k/v pairs in unique document
+func (c *MetadataCache) SetKVDocumentUnique(ctx context.Context, kv KVList, uuid string) error {
+	err := c.MetadataQuery.SetKVDocumentUnique(ctx, kv, uuid)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dropUUID(uuid)
+	c.dropValuesKV(kv)
+	return err
+}
+
+// set k/v pairs in set of documents using where clause
+func (c *MetadataCache) SetKVDocumentWhere(ctx context.Context, kv, where KVList) error {
+	err := c.MetadataQuery.SetKVDocumentWhere(ctx, kv, where)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dropSelected(BatchSelector{Where: where})
+	c.dropValuesKV(kv)
+	return err
+}
+
+// set k/v pairs for set of documents with k/v matching glob
+func (c *MetadataCache) SetKVDocumentValueGlob(ctx context.Context, kv KVList, key, value_glob string) error {
+	err := c.MetadataQuery.SetKVDocumentValueGlob(ctx, kv, key, value_glob)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dropSelected(BatchSelector{Key: key, ValueGlob: value_glob})
+	c.dropValuesKV(kv)
+	return err
+}
+
+// replace the whole of a unique document
+func (c *MetadataCache) ReplaceDocumentUnique(ctx context.Context, doc KVList, uuid string) error {
+	err := c.MetadataQuery.ReplaceDocumentUnique(ctx, doc, uuid)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dropDocumentValues(uuid)
+	c.dropValuesKV(doc)
+	c.dropUUID(uuid)
+	return err
+}
+
+// Delete Operations
+
+// delete list of keys in unique document
+func (c *MetadataCache) DeleteKeyDocumentUnique(ctx context.Context, keys []string, uuid string) error {
+	err := c.MetadataQuery.DeleteKeyDocumentUnique(ctx, keys, uuid)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dropUUID(uuid)
+	c.dropValues(keys...)
+	return err
+}
+
+// delete list of keys in set of documents using where clause
+func (c *MetadataCache) DeleteKeyDocumentWhere(ctx context.Context, keys []string, where KVList) error {
+	err := c.MetadataQuery.DeleteKeyDocumentWhere(ctx, keys, where)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dropSelected(BatchSelector{Where: where})
+	c.dropValues(keys...)
+	return err
+}
+
+// delete keys that match glob in unique document
+func (c *MetadataCache) DeleteKeyGlobDocumentUnique(ctx context.Context, key_glob, uuid string) error {
+	err := c.MetadataQuery.DeleteKeyGlobDocumentUnique(ctx, key_glob, uuid)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dropUUID(uuid)
+	c.dropValuesGlob(key_glob)
+	return err
+}
+
+// delete keys that match glob in set of documents using where clause
+func (c *MetadataCache) DeleteKeyGlobDocumentWhere(ctx context.Context, key_glob string, where KVList) error {
+	err := c.MetadataQuery.DeleteKeyGlobDocumentWhere(ctx, key_glob, where)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dropSelected(BatchSelector{Where: where})
+	c.dropValuesGlob(key_glob)
+	return err
+}
+
+// delete a unique document
+func (c *MetadataCache) DeleteDocumentUnique(ctx context.Context, uuid string) error {
+	err := c.MetadataQuery.DeleteDocumentUnique(ctx, uuid)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dropDocumentValues(uuid)
+	c.dropUUID(uuid)
+	return err
+}
+
+// delete set of documents using where clause. The deleted documents' keys
+// are unknown, so all unique values go
+func (c *MetadataCache) DeleteDocumentsWhere(ctx context.Context, where KVList) error {
+	err := c.MetadataQuery.DeleteDocumentsWhere(ctx, where)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dropSelected(BatchSelector{Where: where})
+	c.values = map[string][]interface{}{}
+	c.generation++
+	return err
+}
+
+// Batch Operations
+
+// apply every operation in the batch atomically. A batch that failed
+// changed nothing, so only an applied batch invalidates
+func (c *MetadataCache) ApplyBatch(ctx context.Context, batch *MetadataBatch) (bool, error) {
+	applied, err := c.MetadataQuery.ApplyBatch(ctx, batch)
+	if !applied {
+		return applied, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, op := range batch.Ops {
+		c.dropSelected(op.Select)
+		switch op.Kind {
+		case BatchSetKV:
+			c.dropValuesKV(op.KV)
+		case BatchDeleteKeys:
+			c.dropValues(op.Keys...)
+		case BatchDeleteKeyGlob:
+			c.dropValuesGlob(op.KeyGlob)
+		}
+	}
+	return applied, err
+}
@@ -1,55 +1,186 @@
 package main
 
+import (
+	"context"
+	"time"
+)
+
 // a document is a list of key/value pairs
 type KVList [][2]string
 
+// get the value for a key in a document
+func (list KVList) Get(key string) (string, bool) {
+	for _, kv := range list {
+		if kv[0] == key {
+			return kv[1], true
+		}
+	}
+	return "", false
+}
+
+// a document that failed to be written by a bulk operation
+type DocumentError struct {
+	// position of the document in the slice given to the bulk call
+	Index int
+	Err   error
+}
+
+// a set of k/v pairs to apply to the document with the given uuid
+type DocumentUpdate struct {
+	UUID string
+	KV   KVList
+}
+
+// Every operation returns an error if the backend failed it; what to do
+// about that is up to the caller. The benchmarks stop the run with Report.Fatal.
+// Every operation also takes a context, and gives up with the context's error
+// once it is cancelled or its deadline passes. A write given up on this way
+// may still be applied
 type MetadataQuery interface {
 
 	//Do any initial config
-	Initialize()
+	Initialize(ctx context.Context) error
+
+	// release whatever Initialize set up, such as connections. Calls made
+	// after Close fail until the provider is initialized again
+	Close() error
 
 	// Get Operations
 
 	// get a single document by using a unique identifier
-	GetDocumentUnique(uuid string) KVList
+	GetDocumentUnique(ctx context.Context, uuid string) (KVList, error)
 
 	// get a set of documents using a where clause
-	GetDocumentSetWhere(where KVList) []KVList
+	GetDocumentSetWhere(ctx context.Context, where KVList) ([]KVList, error)
 
 	// get list of unique values for a given key
-	GetUniqueValues(key string) []interface{}
+	GetUniqueValues(ctx context.Context, key string) ([]interface{}, error)
 
-	// get a set of documents with a key/value matching a glob (anchored regex)
-	GetDocumentSetValueGlob(key, value_glob string) []KVList
+	// get a set of documents with a key/value matching a glob (see glob.go)
+	GetDocumentSetValueGlob(ctx context.Context, key, value_glob string) ([]KVList, error)
 
 	// get a set of keys that match a glob
-	GetKeyGlob(key_glob string) []string
+	GetKeyGlob(ctx context.Context, key_glob string) ([]string, error)
+
+	// Count Operations
+
+	// get the number of documents matching a where clause
+	CountWhere(ctx context.Context, where KVList) (int, error)
+
+	// get the number of documents with a key/value matching a glob
+	CountValueGlob(ctx context.Context, key, value_glob string) (int, error)
+
+	// check whether any document matches a where clause
+	ExistsWhere(ctx context.Context, where KVList) (bool, error)
+
+	// get the number of documents holding each unique value for a given key
+	GetUniqueValueCounts(ctx context.Context, key string) (map[string]int, error)
 
 	// Set Operations
+	// Every SetKV* call has upsert-per-key semantics: each key in kv ends up
+	// holding exactly one value, the new one, whether or not it was present
+	// before. Keys not in kv are left alone, and a "uuid" pair in kv is ignored
+	// so that a document's identity can't change underneath it
 
 	// insert list of documents
-	InsertDocument(docs []KVList)
+	InsertDocument(ctx context.Context, docs []KVList) error
+
+	// insert list of documents using unordered bulk writes of batchsize
+	// documents each. A failing document doesn't stop the others; the
+	// failures are returned, one per document, and the error is only for
+	// failures that are not down to any one document
+	BulkInsertDocument(ctx context.Context, docs []KVList, batchsize int) ([]DocumentError, error)
+
+	// apply each update as SetKVDocumentUnique would, using unordered bulk
+	// writes of batchsize updates each. Failures are returned as for
+	// BulkInsertDocument, indexed into updates
+	BulkSetKVDocumentUnique(ctx context.Context, updates []DocumentUpdate, batchsize int) ([]DocumentError, error)
+
+	// set k/v pairs in the document with the doc's uuid, creating the
+	// document if no document has that uuid
+	UpsertDocument(ctx context.Context, doc KVList) error
 
 	// set k/v pairs in unique document
-	SetKVDocumentUnique(kv KVList, uuid string)
+	SetKVDocumentUnique(ctx context.Context, kv KVList, uuid string) error
 
 	// set k/v pairs in set of documents using where clause
-	SetKVDocumentWhere(kv, where KVList)
+	SetKVDocumentWhere(ctx context.Context, kv, where KVList) error
 
 	// set k/v pairs for set of documents with k/v matching glob
-	SetKVDocumentValueGlob(kv KVList, key, value_glob string)
+	SetKVDocumentValueGlob(ctx context.Context, kv KVList, key, value_glob string) error
+
+	// replace all k/v pairs of a unique document, keeping its uuid.
+	// readers see either the old or the new document, never a mix
+	ReplaceDocumentUnique(ctx context.Context, doc KVList, uuid string) error
 
 	// Delete Operations
 
 	// delete list of keys in unique document
-	DeleteKeyDocumentUnique(keys []string, uuid string)
+	DeleteKeyDocumentUnique(ctx context.Context, keys []string, uuid string) error
 
 	// delete list of keys in set of documents using where clause
-	DeleteKeyDocumentWhere(keys []string, where KVList)
+	DeleteKeyDocumentWhere(ctx context.Context, keys []string, where KVList) error
 
 	// delete keys that match glob in unique document
-	DeleteKeyGlobDocumentUnique(key_glob, uuid string)
+	DeleteKeyGlobDocumentUnique(ctx context.Context, key_glob, uuid string) error
 
 	// delete keys that match glob in set of documents using where clause
-	DeleteKeyGlobDocumentWhere(key_glob string, where KVList)
+	DeleteKeyGlobDocumentWhere(ctx context.Context, key_glob string, where KVList) error
+
+	// delete a unique document entirely
+	DeleteDocumentUnique(ctx context.Context, uuid string) error
+
+	// delete every document matching a where clause
+	DeleteDocumentsWhere(ctx context.Context, where KVList) error
+
+	// Batch Operations
+
+	// apply every operation in the batch atomically: other clients see either
+	// none or all of them. Returns false without applying anything if the
+	// backend has no way to do this. On error none of the batch was applied
+	ApplyBatch(ctx context.Context, batch *MetadataBatch) (bool, error)
+
+	// Subscriptions
+
+	// subscribe to changes of documents matching a where clause, as made
+	// through this provider. The subscription is closed when ctx is done
+	Subscribe(ctx context.Context, where KVList) *Subscription
+
+	// History Operations
+	// A provider records the history of its documents when its HistoryPolicy
+	// enables it. Each AsOf getter answers as the plain getter would have at
+	// time t
+
+	// get a single document by using a unique identifier, as it was at time t
+	GetDocumentUniqueAsOf(ctx context.Context, uuid string, t time.Time) (KVList, error)
+
+	// get a set of documents using a where clause, as of time t
+	GetDocumentSetWhereAsOf(ctx context.Context, where KVList, t time.Time) ([]KVList, error)
+
+	// get list of unique values for a given key, as of time t
+	GetUniqueValuesAsOf(ctx context.Context, key string, t time.Time) ([]interface{}, error)
+
+	// get a set of documents with a key/value matching a glob, as of time t
+	GetDocumentSetValueGlobAsOf(ctx context.Context, key, value_glob string, t time.Time) ([]KVList, error)
+
+	// get a set of keys that match a glob, as of time t
+	GetKeyGlobAsOf(ctx context.Context, key_glob string, t time.Time) ([]string, error)
+
+	// get the number of documents matching a where clause, as of time t
+	CountWhereAsOf(ctx context.Context, where KVList, t time.Time) (int, error)
+
+	// get the number of documents with a key/value matching a glob, as of time t
+	CountValueGlobAsOf(ctx context.Context, key, value_glob string, t time.Time) (int, error)
+
+	// check whether any document matched a where clause at time t
+	ExistsWhereAsOf(ctx context.Context, where KVList, t time.Time) (bool, error)
+
+	// get the number of documents holding each unique value for a given key, as of time t
+	GetUniqueValueCountsAsOf(ctx context.Context, key string, t time.Time) (map[string]int, error)
+
+	// get every recorded change to a document, oldest first
+	GetDocumentHistory(ctx context.Context, uuid string) ([]ChangeEvent, error)
+
+	// apply the HistoryPolicy's retention and compaction to the recorded history
+	CompactHistory(ctx context.Context) error
 }
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Moving metadata between providers through a portable export: a JSONL file
+// with a line per document, each the JSON array of its [key, value] pairs,
+// uuid first, such as [["uuid","7c3e..."],["Path","/soda/a/temp"]]. Documents
+// are streamed from a DocumentScanner, or else read through the MetadataQuery
+// interface, so any provider can be exported, and written with
+// BulkInsertDocument, so any can be imported into.
+// Only documents move; their change history stays behind.
+//
+// A migration is verified by hashing every document, independently of the
+// order of its pairs, which providers don't keep, and checking that the
+// destination holds the same uuids with the same hashes as the source
+
+// keys a provider adds to the documents it stores, which aren't metadata
+var storageKeys = map[string]bool{"_id": true}
+
+// the hash of each document, by uuid
+type DocumentHashes map[string]string
+
+// the hash of a document's pairs in key and value order, leaving out storage
+// keys
+func DocumentHash(doc KVList) string {
+	pairs := make([][2]string, 0, len(doc))
+	for _, kv := range doc {
+		if !storageKeys[kv[0]] {
+			pairs = append(pairs, kv)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	h := sha256.New()
+	for _, kv := range pairs {
+		// lengths first, so no two lists of pairs hash the same bytes
+		fmt.Fprintf(h, "%d:%s%d:%s", len(kv[0]), kv[0], len(kv[1]), kv[1])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// a document as it is exported: without storage keys, and its uuid first
+func portableDocument(doc KVList) KVList {
+	ret := KVList{}
+	for _, kv := range doc {
+		switch {
+		case storageKeys[kv[0]]:
+		case kv[0] == "uuid":
+			ret = append(KVList{kv}, ret...)
+		default:
+			ret = append(ret, kv)
+		}
+	}
+	return ret
+}
+
+// call fn with every document of a provider, in one pass over its store if it
+// is a DocumentScanner. Other providers are read a document at a time, by the
+// uuids GetUniqueValues gives, which are all held in memory
+func ScanDocuments(ctx context.Context, mq MetadataQuery, fn func(doc KVList) error) error {
+	if s, ok := baseProvider(mq).(DocumentScanner); ok {
+		return s.ScanDocuments(ctx, func(doc KVList) error { return fn(portableDocument(doc)) })
+	}
+	values, err := mq.GetUniqueValues(ctx, "uuid")
+	if err != nil {
+		return err
+	}
+	uuids := make([]string, 0, len(values))
+	for _, v := range values {
+		uuids = append(uuids, fmt.Sprint(v))
+	}
+	sort.Strings(uuids)
+	for _, id := range uuids {
+		doc, err := mq.GetDocumentUnique(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := fn(portableDocument(doc)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write every document of a provider to w, returning their hashes
+func ExportDocuments(ctx context.Context, mq MetadataQuery, w io.Writer) (DocumentHashes, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	hashes := DocumentHashes{}
+	err := ScanDocuments(ctx, mq, func(doc KVList) error {
+		id, _ := doc.Get("uuid")
+		if _, dup := hashes[id]; dup {
+			return fmt.Errorf("Document %s was read twice", id)
+		}
+		hashes[id] = DocumentHash(doc)
+		return enc.Encode(doc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hashes, bw.Flush()
+}
+
+// write the documents of an export into a provider, batch at a time,
+// returning their hashes
+func ImportDocuments(ctx context.Context, mq MetadataQuery, r io.Reader, batch int) (DocumentHashes, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	hashes := DocumentHashes{}
+	docs := []KVList{}
+	flush := func() error {
+		failed, err := mq.BulkInsertDocument(ctx, docs, batch)
+		if err != nil {
+			return err
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("%d documents failed to import, first: %v", len(failed), failed[0].Err)
+		}
+		docs = docs[:0]
+		return nil
+	}
+	for line := 1; ; line++ {
+		var doc KVList
+		if err := dec.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not read document %d: %v", line, err)
+		}
+		id, found := doc.Get("uuid")
+		if !found {
+			return nil, fmt.Errorf("Document %d has no uuid", line)
+		}
+		if _, dup := hashes[id]; dup {
+			return nil, fmt.Errorf("Document %d repeats uuid %s", line, id)
+		}
+		hashes[id] = DocumentHash(doc)
+		docs = append(docs, doc)
+		if len(docs) == batch {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(docs) > 0 {
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+// whether a file is an export, rather than a metadata dump: its first line
+// is an array of [key, value] pairs
+func isExportFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var first json.RawMessage
+	if err := json.NewDecoder(bufio.NewReader(f)).Decode(&first); err != nil {
+		return false, nil
+	}
+	var doc KVList
+	return json.Unmarshal(first, &doc) == nil, nil
+}
+
+// how the documents of a provider compare to the hashes they should have
+type Verification struct {
+	Expected, Found int
+	// uuids not in the provider, in the provider but not expected, and with
+	// the wrong hash
+	Missing, Extra, Changed []string
+}
+
+func (v Verification) Ok() bool {
+	return v.Expected == v.Found && len(v.Missing) == 0 && len(v.Extra) == 0 && len(v.Changed) == 0
+}
+
+func (v Verification) String() string {
+	s := fmt.Sprintf("%d documents expected, %d found: %d missing, %d unexpected, %d changed",
+		v.Expected, v.Found, len(v.Missing), len(v.Extra), len(v.Changed))
+	for _, l := range []struct {
+		name  string
+		uuids []string
+	}{{"missing", v.Missing}, {"unexpected", v.Extra}, {"changed", v.Changed}} {
+		if len(l.uuids) > 0 {
+			s += fmt.Sprintf("\nfirst %s: %s", l.name, l.uuids[0])
+		}
+	}
+	return s
+}
+
+// check that a provider holds exactly the documents with the given hashes
+func VerifyDocuments(ctx context.Context, mq MetadataQuery, want DocumentHashes) (Verification, error) {
+	v := Verification{Expected: len(want)}
+	seen := map[string]bool{}
+	err := ScanDocuments(ctx, mq, func(doc KVList) error {
+		v.Found++
+		id, _ := doc.Get("uuid")
+		seen[id] = true
+		switch h, found := want[id]; {
+		case !found:
+			v.Extra = append(v.Extra, id)
+		case h != DocumentHash(doc):
+			v.Changed = append(v.Changed, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return v, err
+	}
+	for id := range want {
+		if !seen[id] {
+			v.Missing = append(v.Missing, id)
+		}
+	}
+	sort.Strings(v.Missing)
+	return v, nil
+}
+
+// connect to a provider, keeping or dropping its data as cfg says
+func openProvider(ctx context.Context, name string, cfg MongoConfig) (MetadataQuery, error) {
+	spec := DefaultWorkload
+	spec.Mongo = cfg
+	mq, err := NewProvider(name, spec)
+	if err != nil {
+		return nil, err
+	}
+	if err := mq.Initialize(ctx); err != nil {
+		return nil, err
+	}
+	return mq, nil
+}
+
+// whether two configs reach the same server, by asking the servers, since
+// different URLs can name one server
+func sameMongoServer(ctx context.Context, a, b MongoConfig) (bool, error) {
+	ids := []string{}
+	for _, cfg := range []MongoConfig{a, b} {
+		ses, err := dialMongo(ctx, cfg)
+		if err != nil {
+			return false, err
+		}
+		id, err := mongoServerId(ses)
+		ses.Close()
+		if err != nil {
+			return false, err
+		}
+		ids = append(ids, id)
+	}
+	return ids[0] == ids[1], nil
+}
+
+//== gobad export
+
+// run gobad export with the arguments after "export", returning the exit status
+func exportMain(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	provider := fs.String("provider", "mongo", "provider to export: "+strings.Join(Providers, ", "))
+	url := fs.String("mongo", "", "MongoDB URL (default $MONGODB_SERVER)")
+	prefix := fs.String("prefix", "", "prefix of the provider's database names")
+	out := fs.String("out", "-", "file to write, or - for standard output")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: gobad export [flags]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	ctx := context.Background()
+	mq, err := openProvider(ctx, *provider, MongoConfig{URL: *url, DBPrefix: *prefix, KeepData: true})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer mq.Close()
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	hashes, err := ExportDocuments(ctx, mq, w)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "exported %d documents from %s\n", len(hashes), *provider)
+	return 0
+}
+
+//== gobad migrate
+
+// run gobad migrate with the arguments after "migrate", returning the exit status
+func migrateMain(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := fs.String("from", "mongo", "provider to migrate from: "+strings.Join(Providers, ", "))
+	fromURL := fs.String("from-mongo", "", "MongoDB URL of the source (default $MONGODB_SERVER)")
+	fromPrefix := fs.String("from-prefix", "", "prefix of the source's database names")
+	to := fs.String("to", "mongoexploded", "provider to migrate to")
+	toURL := fs.String("to-mongo", "", "MongoDB URL of the destination (default $MONGODB_SERVER)")
+	toPrefix := fs.String("to-prefix", "", "prefix of the destination's database names")
+	file := fs.String("file", "migration.jsonl", "where the export is kept")
+	batch := fs.Int("batch", FACTOR, "documents inserted per batch")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: gobad migrate [flags]\n"+
+			"Exports the source to -file, replaces what the destination holds with it,\n"+
+			"and checks the destination has every document unchanged.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 || *batch < 1 {
+		fs.Usage()
+		return 2
+	}
+	ctx := context.Background()
+	// each provider has databases of its own, so only a provider of the same
+	// kind and prefix on the same server would drop the source
+	src := MongoConfig{URL: *fromURL, DBPrefix: *fromPrefix, KeepData: true}
+	dst := MongoConfig{URL: *toURL, DBPrefix: *toPrefix}
+	if *from == *to && *fromPrefix == *toPrefix {
+		same, err := sameMongoServer(ctx, src, dst)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if same {
+			fmt.Fprintln(os.Stderr, "The source and destination are the same databases; give the destination another -to-prefix or -to-mongo")
+			return 2
+		}
+	}
+
+	source, err := openProvider(ctx, *from, src)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	f, err := os.Create(*file)
+	if err != nil {
+		source.Close()
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	exported, err := ExportDocuments(ctx, source, f)
+	source.Close()
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Export failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("exported %d documents from %s to %s\n", len(exported), *from, *file)
+
+	dest, err := openProvider(ctx, *to, dst)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer dest.Close()
+	f, err = os.Open(*file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	imported, err := ImportDocuments(ctx, dest, f, *batch)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Import failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("imported %d documents into %s\n", len(imported), *to)
+
+	// the export as read back must be what was written, and the destination
+	// must hold it
+	for id, h := range exported {
+		if imported[id] != h {
+			fmt.Fprintf(os.Stderr, "The export changed on disk: document %s\n", id)
+			return 1
+		}
+	}
+	v, err := VerifyDocuments(ctx, dest, exported)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Verification failed: %v\n", err)
+		return 1
+	}
+	fmt.Println(v)
+	if !v.Ok() {
+		return 1
+	}
+	fmt.Println("migration verified")
+	return 0
+}
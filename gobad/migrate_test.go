@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// a provider holding documents in memory, with just the calls an export,
+// import and verification make. A memScanner is the same with ScanDocuments
+type memProvider struct {
+	MetadataQuery
+	docs map[string]KVList
+}
+
+func newMemProvider(docs ...KVList) *memProvider {
+	p := &memProvider{docs: map[string]KVList{}}
+	for _, doc := range docs {
+		id, _ := doc.Get("uuid")
+		p.docs[id] = doc
+	}
+	return p
+}
+
+func (p *memProvider) GetUniqueValues(ctx context.Context, key string) ([]interface{}, error) {
+	ret := []interface{}{}
+	for id := range p.docs {
+		ret = append(ret, id)
+	}
+	return ret, nil
+}
+
+func (p *memProvider) GetDocumentUnique(ctx context.Context, uuid string) (KVList, error) {
+	// as stored, with the storage keys a provider adds
+	return append(KVList{{"_id", "\x01" + uuid}}, p.docs[uuid]...), nil
+}
+
+func (p *memProvider) BulkInsertDocument(ctx context.Context, docs []KVList, batchsize int) ([]DocumentError, error) {
+	for _, doc := range docs {
+		id, _ := doc.Get("uuid")
+		p.docs[id] = append(KVList(nil), doc...)
+	}
+	return nil, nil
+}
+
+type memScanner struct {
+	*memProvider
+}
+
+func (p memScanner) ScanDocuments(ctx context.Context, fn func(doc KVList) error) error {
+	ids := []string{}
+	for id := range p.docs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		// pairs in no particular order, as a provider may give them
+		doc := KVList{}
+		for _, kv := range p.docs[id] {
+			doc = append(KVList{kv}, doc...)
+		}
+		if err := fn(doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestDocumentHash(t *testing.T) {
+	doc := KVList{{"uuid", "a"}, {"Path", "/soda/1"}, {"Point/UnitofMeasure", "F"}}
+	h := DocumentHash(doc)
+	for _, same := range []KVList{
+		{{"Point/UnitofMeasure", "F"}, {"uuid", "a"}, {"Path", "/soda/1"}},
+		{{"_id", "\x01\x02"}, {"uuid", "a"}, {"Path", "/soda/1"}, {"Point/UnitofMeasure", "F"}},
+	} {
+		if DocumentHash(same) != h {
+			t.Errorf("%v should hash as %v", same, doc)
+		}
+	}
+	for _, other := range []KVList{
+		{{"uuid", "a"}, {"Path", "/soda/1"}},
+		{{"uuid", "a"}, {"Path", "/soda/2"}, {"Point/UnitofMeasure", "F"}},
+		{{"uuid", "b"}, {"Path", "/soda/1"}, {"Point/UnitofMeasure", "F"}},
+		{{"uuid", "a"}, {"Path", "/soda/1"}, {"Point/UnitofMeasure", "F"}, {"Point/UnitofMeasure", "C"}},
+	} {
+		if DocumentHash(other) == h {
+			t.Errorf("%v should not hash as %v", other, doc)
+		}
+	}
+	// pairs whose concatenations are the same
+	if DocumentHash(KVList{{"ab", "c"}}) == DocumentHash(KVList{{"a", "bc"}}) {
+		t.Error("pairs should hash by their parts")
+	}
+}
+
+func TestExportImportVerify(t *testing.T) {
+	docs := []KVList{
+		{{"uuid", "a"}, {"Path", "/soda/1"}},
+		{{"Path", "/soda/2"}, {"uuid", "b"}, {"Point/Type", "Sensor"}},
+		{{"uuid", "c"}},
+	}
+	ctx := context.Background()
+	for _, src := range []MetadataQuery{newMemProvider(docs...), memScanner{newMemProvider(docs...)}} {
+		var export bytes.Buffer
+		exported, err := ExportDocuments(ctx, src, &export)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(exported) != len(docs) {
+			t.Fatalf("%T: exported %d documents, want %d", src, len(exported), len(docs))
+		}
+		dst := newMemProvider()
+		imported, err := ImportDocuments(ctx, dst, &export, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(imported, exported) {
+			t.Errorf("%T: imported %v, exported %v", src, imported, exported)
+		}
+		// exported with the uuid first and no storage keys
+		if got := dst.docs["b"]; len(got) != 3 || got[0] != [2]string{"uuid", "b"} || DocumentHash(got) != DocumentHash(docs[1]) {
+			t.Errorf("%T: imported %v", src, got)
+		}
+		v, err := VerifyDocuments(ctx, dst, exported)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !v.Ok() || v.Found != len(docs) {
+			t.Errorf("%T: %v", src, v)
+		}
+	}
+}
+
+func TestVerifyDocumentsMismatch(t *testing.T) {
+	want := DocumentHashes{}
+	for _, doc := range []KVList{
+		{{"uuid", "a"}, {"Path", "/soda/1"}},
+		{{"uuid", "b"}, {"Path", "/soda/2"}},
+		{{"uuid", "c"}, {"Path", "/soda/3"}},
+	} {
+		id, _ := doc.Get("uuid")
+		want[id] = DocumentHash(doc)
+	}
+	mq := newMemProvider(
+		KVList{{"uuid", "a"}, {"Path", "/soda/1"}},
+		KVList{{"uuid", "b"}, {"Path", "/soda/changed"}},
+		KVList{{"uuid", "d"}, {"Path", "/soda/4"}},
+	)
+	v, err := VerifyDocuments(context.Background(), mq, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Ok() || v.Expected != 3 || v.Found != 3 ||
+		!reflect.DeepEqual(v.Missing, []string{"c"}) ||
+		!reflect.DeepEqual(v.Extra, []string{"d"}) ||
+		!reflect.DeepEqual(v.Changed, []string{"b"}) {
+		t.Errorf("got %+v", v)
+	}
+}
+
+func TestImportDocumentsRejects(t *testing.T) {
+	for _, export := range []string{
+		`[["uuid","a"]]` + "\n" + `[["uuid","a"]]`,
+		`[["Path","/soda/1"]]`,
+		`{"uuid":"a"}`,
+	} {
+		if _, err := ImportDocuments(context.Background(), newMemProvider(), bytes.NewBufferString(export), 10); err == nil {
+			t.Errorf("import of %q should fail", export)
+		}
+	}
+}
+
+// a scanner that gives a document twice, as one reading a store while it is
+// written might
+type repeatingScanner struct {
+	*memProvider
+}
+
+func (p repeatingScanner) ScanDocuments(ctx context.Context, fn func(doc KVList) error) error {
+	for i := 0; i < 2; i++ {
+		if err := fn(p.docs["a"]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestExportDocumentsRepeated(t *testing.T) {
+	src := repeatingScanner{newMemProvider(KVList{{"uuid", "a"}})}
+	if _, err := ExportDocuments(context.Background(), src, &bytes.Buffer{}); err == nil {
+		t.Error("an export reading a document twice should fail")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"strings"
+)
+
+// Query plans from MongoDB's explain command. cmd is the command to explain,
+// such as a find or an aggregate, which the server runs to collect its
+// execution statistics
+
+func mongoExplain(db *mgo.Database, cmd bson.D) (*QueryPlan, error) {
+	var res bson.M
+	err := db.Run(bson.D{{Name: "explain", Value: cmd}, {Name: "verbosity", Value: "executionStats"}}, &res)
+	if err != nil {
+		return nil, fmt.Errorf("Error explaining query: %v", err)
+	}
+	plan := &QueryPlan{}
+	indexes := map[string]bool{}
+	explainStats(res, plan, indexes)
+	names := []string{}
+	for name := range indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	plan.Index = strings.Join(names, ",")
+	return plan, nil
+}
+
+// walks explain output, adding up the statistics of every executionStats
+// section and collecting the indexes named by the winning plans. An aggregate
+// explains each of its cursor stages separately, and sharded collections
+// explain each shard, so there may be several of both
+func explainStats(v interface{}, plan *QueryPlan, indexes map[string]bool) {
+	switch v := v.(type) {
+	case bson.M:
+		for k, child := range v {
+			switch k {
+			case "rejectedPlans", "allPlansExecution":
+				continue
+			case "executionStats":
+				if stats, ok := child.(bson.M); ok {
+					plan.KeysExamined += bsonInt(stats["totalKeysExamined"])
+					plan.DocsExamined += bsonInt(stats["totalDocsExamined"])
+				}
+			case "indexName":
+				if name, ok := child.(string); ok {
+					indexes[name] = true
+				}
+			}
+			explainStats(child, plan, indexes)
+		}
+	case []interface{}:
+		for _, child := range v {
+			explainStats(child, plan, indexes)
+		}
+	}
+}
+
+// a number from a server reply, which may arrive as any of the bson numeric types
+func bsonInt(v interface{}) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return 0
+}
+
+func explainFind(collection string, filter interface{}) bson.D {
+	return bson.D{{Name: "find", Value: collection}, {Name: "filter", Value: filter}}
+}
+
+func explainAggregate(collection string, pipe []bson.M) bson.D {
+	return bson.D{{Name: "aggregate", Value: collection}, {Name: "pipeline", Value: pipe}, {Name: "cursor", Value: bson.M{}}}
+}
+
+func explainDistinct(collection, key string, query interface{}) bson.D {
+	return bson.D{{Name: "distinct", Value: collection}, {Name: "key", Value: key}, {Name: "query", Value: query}}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session management for the Mongo providers. Initialize dials one root
+// session, which sets up the databases, and every call then runs on a session
+// of its own from a pool of copies of the root. A copy has a socket of its
+// own, so as many calls as the pool holds can run at once without queueing
+// behind each other on one connection
+
+// how many sessions a provider's pool holds when its MongoConfig doesn't say
+const DefaultMongoPoolSize = 16
+
+// how the Mongo providers connect, set before Initialize
+type MongoConfig struct {
+	// the server to dial. Empty dials $MONGODB_SERVER
+	URL string
+
+	// how many calls can use the server at once. Further calls wait for one
+	// of them to finish. 0 means DefaultMongoPoolSize
+	PoolSize int
+
+	// the members of a replica set reads go to, as the MongoDB read
+	// preference modes name them: "primary", "primaryPreferred",
+	// "secondary", "secondaryPreferred" or "nearest". Empty means "primary".
+	// Reads from secondaries may not see the latest writes
+	ReadPreference string
+
+	// how long a call may wait on the server before its socket is given up
+	// on. 0 keeps mgo's default of a minute
+	SocketTimeout time.Duration
+
+	Writes WriteConcern
+
+	// prepended to the names of the databases the provider keeps its data
+	// in, so that several stores of one kind can share a server
+	DBPrefix string
+
+	// connect Initialize to the data the database already holds, as an
+	// export needs, rather than dropping it to start empty as the benchmark
+	// does
+	KeepData bool
+}
+
+// how writes are acknowledged
+type WriteConcern struct {
+	// appended to the provider name in metrics, so write concerns can be told
+	// apart. The empty name leaves provider names as they are
+	Name string
+
+	// send writes without waiting for the server to acknowledge them. Their
+	// errors go unreported, and they are only ordered before the reads of
+	// the same session, so another session may not see them yet
+	Unacknowledged bool
+
+	// how acknowledged writes are confirmed: by how many members, whether
+	// journaled, and how long to wait. The zero value waits for the primary
+	Safe mgo.Safe
+}
+
+// writes acknowledged by the primary, mgo's default
+var SafeWrites = WriteConcern{}
+
+// writes sent without waiting for any acknowledgement
+var UnacknowledgedWrites = WriteConcern{Name: "unacked", Unacknowledged: true}
+
+func (cfg MongoConfig) poolSize() int {
+	if cfg.PoolSize <= 0 {
+		return DefaultMongoPoolSize
+	}
+	return cfg.PoolSize
+}
+
+func (cfg MongoConfig) socketTimeout() time.Duration {
+	if cfg.SocketTimeout <= 0 {
+		return time.Minute
+	}
+	return cfg.SocketTimeout
+}
+
+func (cfg MongoConfig) mode() (mgo.Mode, error) {
+	switch cfg.ReadPreference {
+	case "", "primary":
+		return mgo.Primary, nil
+	case "primaryPreferred":
+		return mgo.PrimaryPreferred, nil
+	case "secondary":
+		return mgo.Secondary, nil
+	case "secondaryPreferred":
+		return mgo.SecondaryPreferred, nil
+	case "nearest":
+		return mgo.Nearest, nil
+	}
+	return 0, fmt.Errorf("Unknown read preference %q", cfg.ReadPreference)
+}
+
+func (wc WriteConcern) safe() *mgo.Safe {
+	if wc.Unacknowledged {
+		return nil
+	}
+	safe := wc.Safe
+	return &safe
+}
+
+// the config as it is recorded with a run: the URL it dials, with any
+// password masked
+func (cfg MongoConfig) redacted() MongoConfig {
+	if cfg.URL == "" {
+		cfg.URL = os.Getenv("MONGODB_SERVER")
+	}
+	rest := cfg.URL
+	scheme := ""
+	if i := strings.Index(rest, "://"); i >= 0 {
+		scheme, rest = rest[:i+3], rest[i+3:]
+	}
+	hosts := rest
+	if i := strings.Index(rest, "/"); i >= 0 {
+		hosts = rest[:i]
+	}
+	if at := strings.LastIndex(hosts, "@"); at >= 0 {
+		if colon := strings.Index(hosts[:at], ":"); colon >= 0 {
+			rest = hosts[:colon+1] + "xxxxx" + rest[at:]
+		}
+	}
+	cfg.URL = scheme + rest
+	return cfg
+}
+
+// how a Mongo provider is set up, as recorded with a run
+type mongoProviderConfig struct {
+	Mongo         MongoConfig
+	Retry         RetryPolicy
+	HistoryPolicy HistoryPolicy
+}
+
+// the server ses is connected to, and its version
+func mongoServer(ses *mgo.Session) (string, error) {
+	bi, err := ses.BuildInfo()
+	if err != nil {
+		return "", fmt.Errorf("Could not get server version: %v", err)
+	}
+	return "MongoDB " + bi.Version, nil
+}
+
+// an identity of the server ses is connected to that is the same whichever
+// URL reached it: the replica set name, or else the host and process id the
+// server reports for itself
+func mongoServerId(ses *mgo.Session) (string, error) {
+	var hello struct {
+		SetName string `bson:"setName"`
+	}
+	if err := ses.Run("isMaster", &hello); err != nil {
+		return "", fmt.Errorf("Could not identify server: %v", err)
+	}
+	if hello.SetName != "" {
+		return "replset " + hello.SetName, nil
+	}
+	var status struct {
+		Host string `bson:"host"`
+		Pid  int64  `bson:"pid"`
+	}
+	if err := ses.Run("serverStatus", &status); err != nil {
+		return "", fmt.Errorf("Could not identify server: %v", err)
+	}
+	return fmt.Sprintf("%s pid %d", status.Host, status.Pid), nil
+}
+
+// dial the root session of a provider, set up as cfg says. The dial and the
+// session's socket and sync timeouts are cut to ctx's deadline, so the setup
+// made on the root ends with ctx; afterwards the caller restores them with
+// restoreTimeouts
+func dialMongo(ctx context.Context, cfg MongoConfig) (*mgo.Session, error) {
+	mode, err := cfg.mode()
+	if err != nil {
+		return nil, err
+	}
+	url := cfg.URL
+	if url == "" {
+		url = os.Getenv("MONGODB_SERVER")
+	}
+	// mgo.Dial's timeout
+	ses, err := mgo.DialWithTimeout(url, contextTimeout(ctx, 10*time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to mongo: %v", err)
+	}
+	ses.SetMode(mode, true)
+	ses.SetSafe(cfg.Writes.safe())
+	ses.SetSyncTimeout(contextTimeout(ctx, time.Minute))
+	ses.SetSocketTimeout(contextTimeout(ctx, cfg.socketTimeout()))
+	// a socket for each pooled session and one for the root
+	ses.SetPoolLimit(cfg.poolSize() + 1)
+	return ses, nil
+}
+
+// set the timeouts of a root session from dialMongo back to the config's,
+// once it is set up
+func restoreTimeouts(ses *mgo.Session, cfg MongoConfig) {
+	ses.SetSyncTimeout(time.Minute)
+	ses.SetSocketTimeout(cfg.socketTimeout())
+}
+
+// d, or the time ctx has left if that is less. mgo takes a timeout of 0 as
+// none at all, so the least returned is a millisecond
+func contextTimeout(ctx context.Context, d time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); left < d {
+			d = left
+			if d <= 0 {
+				d = time.Millisecond
+			}
+		}
+	}
+	return d
+}
+
+// A mongoPool hands out copies of a root session, at most size at a time.
+// Sessions are made as they are first needed and reused most recently
+// returned first, so a caller making one call at a time keeps getting the
+// same session, and sees its own unacknowledged writes.
+//
+// A call given up on at its context's deadline keeps running until mgo
+// returns, holding its session and slot. So that this is no longer than the
+// deadline, each session is handed out with its socket timeout cut to the
+// time its context has left
+type mongoPool struct {
+	root *mgo.Session
+	// holds a token for every session in use
+	slots chan struct{}
+	// the socket timeout of a session whose context has no deadline
+	timeout time.Duration
+
+	lock   sync.Mutex
+	idle   []*mgo.Session
+	closed bool
+}
+
+func newMongoPool(root *mgo.Session, size int, timeout time.Duration) *mongoPool {
+	return &mongoPool{root: root, slots: make(chan struct{}, size), timeout: timeout}
+}
+
+// take a session from the pool, waiting until one is free or ctx is done
+func (mp *mongoPool) get(ctx context.Context) (*mgo.Session, error) {
+	select {
+	case mp.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+	if mp.closed {
+		<-mp.slots
+		return nil, fmt.Errorf("Mongo provider is closed")
+	}
+	var ses *mgo.Session
+	if n := len(mp.idle); n > 0 {
+		ses = mp.idle[n-1]
+		mp.idle = mp.idle[:n-1]
+	} else {
+		ses = mp.root.Copy()
+	}
+	ses.SetSocketTimeout(contextTimeout(ctx, mp.timeout))
+	return ses, nil
+}
+
+// give back a session taken with get, along with the error of the call it was
+// used for. A session whose connection failed is refreshed, so it gets a new one
+func (mp *mongoPool) put(ses *mgo.Session, err error) {
+	if err != nil && isTransient(err) {
+		ses.Refresh()
+	}
+	mp.lock.Lock()
+	if mp.closed {
+		ses.Close()
+	} else {
+		mp.idle = append(mp.idle, ses)
+	}
+	mp.lock.Unlock()
+	<-mp.slots
+}
+
+// close the idle sessions and the root. Sessions in use are closed as they
+// are given back
+func (mp *mongoPool) close() {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+	if mp.closed {
+		return
+	}
+	mp.closed = true
+	for _, ses := range mp.idle {
+		ses.Close()
+	}
+	mp.idle = nil
+	mp.root.Close()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Multi-document transactions for the Mongo providers.
+// mgo predates MongoDB 4.0 and has no notion of sessions or transactions, so
+// the transaction protocol is spoken directly through database commands: each
+// command carries the logical session id and transaction number, the first one
+// also starts the transaction, and commitTransaction ends it. Transactions need
+// a replica set or mongos running MongoDB 4.2 or later
+
+// how many times a transaction is attempted when it hits a write conflict
+const maxTxnAttempts = 5
+
+type mongoTxn struct {
+	db        *mgo.Database
+	lsid      bson.M
+	txnNumber int64
+	started   bool
+}
+
+// the reply to a write command
+type txnWriteResult struct {
+	N           int `bson:"n"`
+	WriteErrors []struct {
+		Code   int    `bson:"code"`
+		Errmsg string `bson:"errmsg"`
+	} `bson:"writeErrors"`
+}
+
+// the reply to aggregate and getMore
+type txnCursorResult struct {
+	Cursor struct {
+		Id         int64    `bson:"id"`
+		FirstBatch []bson.M `bson:"firstBatch"`
+		NextBatch  []bson.M `bson:"nextBatch"`
+	} `bson:"cursor"`
+}
+
+// reports whether the server behind ses can run multi-document transactions
+func mongoSupportsTxn(ses *mgo.Session) bool {
+	var res struct {
+		SetName        string `bson:"setName"`
+		Msg            string `bson:"msg"`
+		MaxWireVersion int    `bson:"maxWireVersion"`
+	}
+	if err := ses.Run("isMaster", &res); err != nil {
+		return false
+	}
+	// wire version 8 is MongoDB 4.2
+	return (res.SetName != "" || res.Msg == "isdbgrid") && res.MaxWireVersion >= 8
+}
+
+// runs body inside a transaction on db and commits it. The whole transaction
+// is retried when the server reports a write conflict with another transaction
+func runMongoTxn(db *mgo.Database, body func(t *mongoTxn) error) error {
+	var res struct {
+		Id bson.M `bson:"id"`
+	}
+	if err := db.Session.Run("startSession", &res); err != nil {
+		return err
+	}
+	t := &mongoTxn{db: db, lsid: res.Id}
+	defer db.Session.Run(bson.D{{Name: "endSessions", Value: []bson.M{t.lsid}}}, nil)
+
+	for attempt := 1; ; attempt++ {
+		t.txnNumber++
+		t.started = false
+		err := body(t)
+		if err == nil {
+			err = t.finish("commitTransaction")
+		}
+		if err == nil {
+			return nil
+		}
+		if t.started {
+			t.finish("abortTransaction")
+		}
+		if !isTransientTxnError(err) || attempt == maxTxnAttempts {
+			return err
+		}
+	}
+}
+
+// WriteConflict and NoSuchTransaction are labelled TransientTransactionError
+// by the server, but mgo doesn't expose error labels
+func isTransientTxnError(err error) bool {
+	qerr, ok := err.(*mgo.QueryError)
+	return ok && (qerr.Code == 112 || qerr.Code == 251)
+}
+
+// appends the session fields to a command
+func (t *mongoTxn) session(cmd bson.D) bson.D {
+	return append(cmd,
+		bson.DocElem{Name: "lsid", Value: t.lsid},
+		bson.DocElem{Name: "txnNumber", Value: t.txnNumber},
+		bson.DocElem{Name: "autocommit", Value: false})
+}
+
+// runs a command inside the transaction, starting it if this is the first
+func (t *mongoTxn) run(cmd bson.D, result interface{}) error {
+	cmd = t.session(cmd)
+	if !t.started {
+		cmd = append(cmd, bson.DocElem{Name: "startTransaction", Value: true})
+		t.started = true
+	}
+	return t.db.Run(cmd, result)
+}
+
+// commits or aborts the transaction
+func (t *mongoTxn) finish(command string) error {
+	if !t.started {
+		return nil
+	}
+	return t.db.Session.Run(t.session(bson.D{{Name: command, Value: 1}}), nil)
+}
+
+// runs a write command, turning the first write error into an error
+func (t *mongoTxn) write(cmd bson.D) error {
+	var res txnWriteResult
+	if err := t.run(cmd, &res); err != nil {
+		return err
+	}
+	if len(res.WriteErrors) > 0 {
+		we := res.WriteErrors[0]
+		return &mgo.QueryError{Code: we.Code, Message: we.Errmsg}
+	}
+	return nil
+}
+
+// inserts documents
+func (t *mongoTxn) insert(collection string, docs []interface{}) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	return t.write(bson.D{{Name: "insert", Value: collection}, {Name: "documents", Value: docs}})
+}
+
+// runs update statements of the form {"q": ..., "u": ..., "multi": ..., "upsert": ...}
+func (t *mongoTxn) update(collection string, updates []bson.M) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	return t.write(bson.D{{Name: "update", Value: collection}, {Name: "updates", Value: updates}})
+}
+
+// runs delete statements of the form {"q": ..., "limit": ...}
+func (t *mongoTxn) remove(collection string, deletes []bson.M) error {
+	if len(deletes) == 0 {
+		return nil
+	}
+	return t.write(bson.D{{Name: "delete", Value: collection}, {Name: "deletes", Value: deletes}})
+}
+
+// runs an aggregation pipeline and returns every resulting document
+func (t *mongoTxn) aggregate(collection string, pipe []bson.M) ([]bson.M, error) {
+	var res txnCursorResult
+	err := t.run(bson.D{{Name: "aggregate", Value: collection}, {Name: "pipeline", Value: pipe}, {Name: "cursor", Value: bson.M{}}}, &res)
+	if err != nil {
+		return nil, err
+	}
+	ret := res.Cursor.FirstBatch
+	for res.Cursor.Id != 0 {
+		id := res.Cursor.Id
+		res = txnCursorResult{}
+		if err := t.run(bson.D{{Name: "getMore", Value: id}, {Name: "collection", Value: collection}}, &res); err != nil {
+			return nil, err
+		}
+		ret = append(ret, res.Cursor.NextBatch...)
+	}
+	return ret, nil
+}
@@ -1,33 +1,77 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
-	"os"
 	"regexp"
 )
 
 type ProviderMongo struct {
-	ses   *mgo.Session
+	// how to connect, set before Initialize
+	Mongo MongoConfig
+	pool  *mongoPool
+
+	// on the root session. Calls use the databases of a mongoCall instead
 	db_bw *mgo.Database
 
 	// NOTE: this particular Mongo provider implements a document
 	// as naive {key: value} and only indexes on the unique identifier
 	// "uuid". Another implementation would use {"key": realkey, "value": realvalue}
 	db_mq *mgo.Database
+
+	// whether the server can run multi-document transactions for ApplyBatch
+	txn bool
+
+	// reports writes to subscribers
+	feed ChangeFeed
+
+	// what history to keep, set before Initialize
+	HistoryPolicy HistoryPolicy
+	mongoHistory
+
+	// how calls that fail with transient errors are retried
+	Retry RetryPolicy
+}
+
+// the provider as one call sees it: its databases are on the call's own
+// session from the pool, and everything else is the provider's
+type mongoCall struct {
+	*ProviderMongo
+	db_bw *mgo.Database
+	db_mq *mgo.Database
+	mongoHistory
+}
+
+// bind the provider to a session for one call
+func (p *ProviderMongo) bind(ses *mgo.Session) *mongoCall {
+	return &mongoCall{
+		ProviderMongo: p,
+		db_bw:         p.db_bw.With(ses),
+		db_mq:         p.db_mq.With(ses),
+		mongoHistory:  p.mongoHistory.with(ses),
+	}
 }
 
 //== SHARED
-func (p *ProviderMongo) Initialize() {
-	ses, err := mgo.Dial(os.Getenv("MONGODB_SERVER"))
+
+// connect, dropping any connection made by an earlier Initialize, and set up
+// empty databases, unless the config keeps the data there
+func (p *ProviderMongo) initialize(ctx context.Context) error {
+	p.close()
+	ses, err := dialMongo(ctx, p.Mongo)
 	if err != nil {
-		Report.Fatal("could not connect to mongo: %v", err)
+		return err
+	}
+	p.pool = newMongoPool(ses, p.Mongo.poolSize(), p.Mongo.socketTimeout())
+	p.db_bw = ses.DB(p.Mongo.DBPrefix + "bosswavequery")
+	p.db_mq = ses.DB(p.Mongo.DBPrefix + "metadataquery")
+	p.txn = mongoSupportsTxn(ses)
+	if !p.Mongo.KeepData {
+		p.db_bw.DropDatabase()
+		p.db_mq.DropDatabase()
 	}
-	p.ses = ses
-	p.db_bw = ses.DB("bosswavequery")
-	p.db_mq = ses.DB("metadataquery")
-	p.db_bw.DropDatabase()
-	p.db_mq.DropDatabase()
 
 	//BosswaveQuery initialization
 	p.db_bw.C("records").EnsureIndex(mgo.Index{Key: []string{"key"}, Unique: true})
@@ -35,33 +79,50 @@ func (p *ProviderMongo) Initialize() {
 
 	//MetadataQuery initialization
 	p.db_mq.C("records").EnsureIndex(mgo.Index{Key: []string{"uuid"}, Unique: true})
+	err = p.mongoHistory.init(p.db_mq.C("history"), p.HistoryPolicy, &p.feed)
+	if ctx.Err() != nil {
+		// the setup above was cut short, so it can't be trusted
+		p.close()
+		return ctx.Err()
+	}
+	restoreTimeouts(ses, p.Mongo)
+	return err
+}
+
+// end every session of the pool
+func (p *ProviderMongo) close() {
+	if p.pool != nil {
+		p.pool.close()
+		p.pool = nil
+	}
 }
 
 //== BosswaveQuery
 
 //Get a specific value
-func (p *ProviderMongo) GetRecord(key string) BosswaveRecord {
+func (p *mongoCall) getRecord(key string) (BosswaveRecord, error) {
 	q := p.db_bw.C("records").Find(bson.M{"key": key})
 	rv := BosswaveRecord{}
 	qerr := q.One(&rv)
 	if qerr != nil {
-		Report.Fatal("could not query bosswave record: %v", qerr)
+		return rv, fmt.Errorf("could not query bosswave record: %v", qerr)
 	}
-	return rv
+	return rv, nil
 }
 
 //Insert a record
-func (p *ProviderMongo) InsertRecord(r BosswaveRecord) {
+func (p *mongoCall) insertRecord(r BosswaveRecord) error {
 	err := p.db_bw.C("records").Insert(r)
 	if err != nil {
-		Report.Fatal("could not insert bosswave record: %v", err)
+		return fmt.Errorf("could not insert bosswave record: %v", err)
 	}
+	return nil
 }
 
 //Get a list of keys up to a slash
 //so GetKeysUpToSlash(/foo/bar/) would return /foo/bar/baz
 //but not /foo/bar/baz/box
-func (p *ProviderMongo) GetKeysUpToSlash(keyprefix string) []string {
+func (p *mongoCall) getKeysUpToSlash(keyprefix string) ([]string, error) {
 
 	regex := "^" + regexp.QuoteMeta(keyprefix) + "[^/]*"
 	rv := []string{}
@@ -71,11 +132,14 @@ func (p *ProviderMongo) GetKeysUpToSlash(keyprefix string) []string {
 	for it.Next(&val) {
 		rv = append(rv, val.Key)
 	}
-	return rv
+	if err := it.Close(); err != nil {
+		return nil, fmt.Errorf("could not list bosswave keys: %v", err)
+	}
+	return rv, nil
 }
 
 //Get sum(size) for all records with the given allocation set
-func (p *ProviderMongo) SumSize(AllocSet int64) int64 {
+func (p *mongoCall) sumSize(AllocSet int64) (int64, error) {
 	pipe := []bson.M{
 		bson.M{"$match": bson.M{"allocset": AllocSet}},
 		bson.M{"$group": bson.M{"_id": "", "sum": bson.M{"$sum": "$size"}}},
@@ -84,27 +148,28 @@ func (p *ProviderMongo) SumSize(AllocSet int64) int64 {
 	val := struct{ Sum int64 }{}
 	err := pr.One(&val)
 	if err != nil {
-		Report.Fatal("Could not sum size: %v", err)
+		return 0, fmt.Errorf("Could not sum size: %v", err)
 	}
-	return val.Sum
+	return val.Sum, nil
 }
 
 //Create an allocation set
-func (p *ProviderMongo) CreateAllocSet(r AllocationSet) {
+func (p *mongoCall) createAllocSet(r AllocationSet) error {
 	if err := p.db_bw.C("allocset").Insert(r); err != nil {
-		Report.Fatal("Could not insert allocation set: %v", err)
+		return fmt.Errorf("Could not insert allocation set: %v", err)
 	}
+	return nil
 }
 
 //Get the allocation set ID
-func (p *ProviderMongo) GetAllocSetID(vk VK) int64 {
+func (p *mongoCall) getAllocSetID(vk VK) (int64, error) {
 	q := p.db_bw.C("allocset").Find(bson.M{"vk": bson.Binary{Kind: 0, Data: []byte(vk)}})
 	rv := struct{ Id int64 }{}
 	qerr := q.One(&rv)
 	if qerr != nil {
-		Report.Fatal("could not query allocset record: %v", qerr)
+		return 0, fmt.Errorf("could not query allocset record: %v", qerr)
 	}
-	return rv.Id
+	return rv.Id, nil
 }
 
 //== MetadataQuery
@@ -132,164 +197,621 @@ func KVList2Bson(list KVList) bson.M {
 	return ret
 }
 
-// get a single document by using a unique identifier
-func (p *ProviderMongo) GetDocumentUnique(uuid string) KVList {
-	var res bson.M
-	err := p.db_mq.C("records").Find(bson.M{"uuid": uuid}).One(&res)
+// translates a glob into a condition on a string field: an equality for a
+// literal, a range scan for a literal prefix followed by **, and an anchored
+// regex otherwise. The first two use an index on the field as a point or range
+// lookup, without examining every key
+func Glob2Bson(g *Glob) interface{} {
+	if lit, ok := g.Literal(); ok {
+		return lit
+	}
+	if prefix, ok := g.Prefix(); ok {
+		if upper, ok := PrefixUpperBound(prefix); ok {
+			return bson.M{"$gte": prefix, "$lt": upper}
+		}
+		return bson.M{"$gte": prefix}
+	}
+	return bson.M{"$regex": g.Regex()}
+}
+
+// parses a glob and translates it with Glob2Bson
+func globBson(pattern string) (interface{}, error) {
+	g, err := ParseGlob(pattern)
 	if err != nil {
-		Report.Fatal("Error finding unique document: %v", err)
+		return nil, err
 	}
-	return Bson2KVList(res)
+	return Glob2Bson(g), nil
 }
 
-// get a set of documents using a where clause
-func (p *ProviderMongo) GetDocumentSetWhere(where KVList) []KVList {
-	q := p.db_mq.C("records").Find(KVList2Bson(where))
+// the filter selecting the documents of a BatchSelector
+func selectorBson(sel BatchSelector) (bson.M, error) {
+	filter := KVList2Bson(sel.Where)
+	if sel.Key != "" {
+		cond, err := globBson(sel.ValueGlob)
+		if err != nil {
+			return nil, err
+		}
+		filter[sel.Key] = cond
+	}
+	return filter, nil
+}
+
+// maps the error from running a bulk write onto the documents that were in it.
+// rowdoc holds, for each queued operation, the index of the document it came
+// from. Each document is reported once, with the first error seen for it, and
+// errors the server couldn't place fail every document in the batch
+func bulkDocumentErrors(err error, rowdoc []int) []DocumentError {
+	if err == nil {
+		return nil
+	}
+	ret := []DocumentError{}
+	seen := map[int]bool{}
+	add := func(doc int, err error) {
+		if !seen[doc] {
+			seen[doc] = true
+			ret = append(ret, DocumentError{Index: doc, Err: err})
+		}
+	}
+	berr, ok := err.(*mgo.BulkError)
+	if !ok {
+		for _, doc := range rowdoc {
+			add(doc, err)
+		}
+		return ret
+	}
+	for _, c := range berr.Cases() {
+		if c.Index < 0 || c.Index >= len(rowdoc) {
+			for _, doc := range rowdoc {
+				add(doc, c.Err)
+			}
+		} else {
+			add(rowdoc[c.Index], c.Err)
+		}
+	}
+	return ret
+}
+
+// iterates a query, collecting each document as a KVList
+func collectDocuments(q *mgo.Query) ([]KVList, error) {
 	it := q.Iter()
 	ret := []KVList{}
 	doc := bson.M{}
 	for it.Next(&doc) {
 		ret = append(ret, Bson2KVList(doc))
+		doc = bson.M{}
 	}
-	return ret
+	if err := it.Close(); err != nil {
+		return nil, fmt.Errorf("Error fetching documents: %v", err)
+	}
+	return ret, nil
+}
+
+// get a single document by using a unique identifier
+func (p *mongoCall) getDocumentUnique(uuid string) (KVList, error) {
+	var res bson.M
+	err := p.db_mq.C("records").Find(bson.M{"uuid": uuid}).One(&res)
+	if err != nil {
+		return nil, fmt.Errorf("Error finding unique document: %v", err)
+	}
+	return Bson2KVList(res), nil
+}
+
+// get a set of documents using a where clause
+func (p *mongoCall) getDocumentSetWhere(where KVList) ([]KVList, error) {
+	return collectDocuments(p.db_mq.C("records").Find(KVList2Bson(where)))
 }
 
 // get list of unique values for a given key
-func (p *ProviderMongo) GetUniqueValues(key string) []interface{} {
+func (p *mongoCall) getUniqueValues(key string) ([]interface{}, error) {
 	var res []interface{}
 	err := p.db_mq.C("records").Find(bson.M{}).Distinct(key, &res)
 	if err != nil {
-		Report.Fatal("Error retreiving unique values: %v", err)
+		return nil, fmt.Errorf("Error retreiving unique values: %v", err)
 	}
-	return res
+	return res, nil
 }
 
-// get a set of documents with a key/value matching a glob (anchored regex)
-func (p *ProviderMongo) GetDocumentSetValueGlob(key, value_glob string) []KVList {
-	q := p.db_mq.C("records").Find(bson.M{key: bson.M{"$regex": value_glob}})
-	it := q.Iter()
-	ret := []KVList{}
-	doc := bson.M{}
-	for it.Next(&doc) {
-		ret = append(ret, Bson2KVList(doc))
+// get a set of documents with a key/value matching a glob
+func (p *mongoCall) getDocumentSetValueGlob(key, value_glob string) ([]KVList, error) {
+	filter, err := selectorBson(BatchSelector{Key: key, ValueGlob: value_glob})
+	if err != nil {
+		return nil, err
 	}
-	return ret
+	return collectDocuments(p.db_mq.C("records").Find(filter))
 }
 
 // get a set of keys that match a glob
 // MongoDB doesn't provide this functionality, so we actually fetch all keys
 // for all documents and check them individually
-func (p *ProviderMongo) GetKeyGlob(key_glob string) []string {
-	re := regexp.MustCompile(key_glob)
+func (p *mongoCall) getKeyGlob(key_glob string) ([]string, error) {
+	g, err := ParseGlob(key_glob)
+	if err != nil {
+		return nil, err
+	}
 	q := p.db_mq.C("records").Find(bson.M{})
 	it := q.Iter()
 	ret := []string{}
 	doc := bson.M{}
 	for it.Next(&doc) {
 		for key, _ := range doc {
-			if re.MatchString(key) {
+			if g.Match(key) {
 				ret = append(ret, key)
 			}
 		}
 	}
-	return ret
+	if err := it.Close(); err != nil {
+		return nil, fmt.Errorf("Error retreiving keys that match glob: %v", err)
+	}
+	return ret, nil
+}
+
+// Count Operations
+
+// get the number of documents matching a where clause
+func (p *mongoCall) countWhere(where KVList) (int, error) {
+	n, err := p.db_mq.C("records").Find(KVList2Bson(where)).Count()
+	if err != nil {
+		return 0, fmt.Errorf("Error counting documents: %v", err)
+	}
+	return n, nil
+}
+
+// get the number of documents with a key/value matching a glob
+func (p *mongoCall) countValueGlob(key, value_glob string) (int, error) {
+	filter, err := selectorBson(BatchSelector{Key: key, ValueGlob: value_glob})
+	if err != nil {
+		return 0, err
+	}
+	n, err := p.db_mq.C("records").Find(filter).Count()
+	if err != nil {
+		return 0, fmt.Errorf("Error counting documents: %v", err)
+	}
+	return n, nil
+}
+
+// check whether any document matches a where clause
+// the limit is passed through to the count, so the server stops at the first match
+func (p *mongoCall) existsWhere(where KVList) (bool, error) {
+	n, err := p.db_mq.C("records").Find(KVList2Bson(where)).Limit(1).Count()
+	if err != nil {
+		return false, fmt.Errorf("Error checking for documents: %v", err)
+	}
+	return n > 0, nil
+}
+
+func uniqueValueCountsPipeline(key string) []bson.M {
+	return []bson.M{
+		bson.M{"$match": bson.M{key: bson.M{"$exists": true}}},
+		bson.M{"$group": bson.M{"_id": "$" + key, "count": bson.M{"$sum": 1}}},
+	}
+}
+
+// get the number of documents holding each unique value for a given key
+func (p *mongoCall) getUniqueValueCounts(key string) (map[string]int, error) {
+	it := p.db_mq.C("records").Pipe(uniqueValueCountsPipeline(key)).Iter()
+	return collectValueCounts(it)
+}
+
+// read the counts from a unique value counts pipeline. Values aren't all
+// strings, so they are decoded as they are and formatted as keys, as the
+// values from GetUniqueValues would be
+func collectValueCounts(it *mgo.Iter) (map[string]int, error) {
+	ret := map[string]int{}
+	for {
+		val := struct {
+			Value interface{} `bson:"_id"`
+			Count int
+		}{}
+		if !it.Next(&val) {
+			break
+		}
+		ret[fmt.Sprint(val.Value)] = val.Count
+	}
+	if err := it.Close(); err != nil {
+		return nil, fmt.Errorf("Error counting unique values: %v", err)
+	}
+	return ret, nil
 }
 
 // Set Operations
 
 // insert list of documents
-func (p *ProviderMongo) InsertDocument(docs []KVList) {
+func (p *mongoCall) insertDocument(docs []KVList) (err error) {
+	defer p.feed.Track(p, ChangeInsert, nil, documentUUIDs(docs)...).Publish(&err)
 	for _, doc := range docs {
 		err := p.db_mq.C("records").Insert(KVList2Bson(doc))
 		if err != nil {
-			Report.Fatal("Error inserting documents: %v : %v", err, doc)
+			return fmt.Errorf("Error inserting documents: %v : %v", err, doc)
+		}
+	}
+	return nil
+}
+
+// insert list of documents using unordered bulk writes of batchsize documents each
+func (p *mongoCall) bulkInsertDocument(docs []KVList, batchsize int) (failed []DocumentError, err error) {
+	defer p.feed.Track(p, ChangeInsert, nil, documentUUIDs(docs)...).Publish(&err)
+	failed = []DocumentError{}
+	for start := 0; start < len(docs); start += batchsize {
+		end := start + batchsize
+		if end > len(docs) {
+			end = len(docs)
+		}
+		bulk := p.db_mq.C("records").Bulk()
+		bulk.Unordered()
+		rowdoc := []int{}
+		for i := start; i < end; i++ {
+			bulk.Insert(KVList2Bson(docs[i]))
+			rowdoc = append(rowdoc, i)
 		}
+		_, err := bulk.Run()
+		failed = append(failed, bulkDocumentErrors(err, rowdoc)...)
 	}
+	return failed, nil
+}
+
+// apply each update as SetKVDocumentUnique would, using unordered bulk writes
+// of batchsize updates each
+func (p *mongoCall) bulkSetKVDocumentUnique(updates []DocumentUpdate, batchsize int) (failed []DocumentError, err error) {
+	defer p.feed.Track(p, ChangeSet, nil, updateUUIDs(updates)...).Publish(&err)
+	failed = []DocumentError{}
+	for start := 0; start < len(updates); start += batchsize {
+		end := start + batchsize
+		if end > len(updates) {
+			end = len(updates)
+		}
+		bulk := p.db_mq.C("records").Bulk()
+		bulk.Unordered()
+		rowdoc := []int{}
+		for i := start; i < end; i++ {
+			update := kvSetUpdate(updates[i].KV)
+			if update == nil {
+				continue
+			}
+			bulk.Update(bson.M{"uuid": updates[i].UUID}, update)
+			rowdoc = append(rowdoc, i)
+		}
+		if len(rowdoc) == 0 {
+			continue
+		}
+		_, err := bulk.Run()
+		failed = append(failed, bulkDocumentErrors(err, rowdoc)...)
+	}
+	return failed, nil
+}
+
+// builds a $set update from k/v pairs, leaving out the uuid so a document's
+// identity never changes. Returns nil if there is nothing left to set
+func kvSetUpdate(kv KVList) bson.M {
+	set := KVList2Bson(kv)
+	delete(set, "uuid")
+	if len(set) == 0 {
+		return nil
+	}
+	return bson.M{"$set": set}
+}
+
+// set k/v pairs in the document with the doc's uuid, creating the
+// document if no document has that uuid
+func (p *mongoCall) upsertDocument(doc KVList) (err error) {
+	defer p.feed.Track(p, ChangeSet, nil, documentUUIDs([]KVList{doc})...).Publish(&err)
+	uuid, found := doc.Get("uuid")
+	if !found {
+		return fmt.Errorf("Error upserting document without uuid: %v", doc)
+	}
+	update := kvSetUpdate(doc)
+	if update == nil {
+		update = bson.M{"$setOnInsert": bson.M{"uuid": uuid}}
+	}
+	_, err = p.db_mq.C("records").Upsert(bson.M{"uuid": uuid}, update)
+	if err != nil {
+		return fmt.Errorf("Error upserting document: %v", err)
+	}
+	return nil
 }
 
 // set k/v pairs in unique document
-func (p *ProviderMongo) SetKVDocumentUnique(kv KVList, uuid string) {
-	err := p.db_mq.C("records").Update(bson.M{"uuid": uuid}, bson.M{"$set": KVList2Bson(kv)})
+func (p *mongoCall) setKVDocumentUnique(kv KVList, uuid string) (err error) {
+	defer p.feed.Track(p, ChangeSet, nil, uuid).Publish(&err)
+	update := kvSetUpdate(kv)
+	if update == nil {
+		return nil
+	}
+	err = p.db_mq.C("records").Update(bson.M{"uuid": uuid}, update)
 	if err != nil {
-		Report.Fatal("Error setting k/v pairs: %v", err)
+		return fmt.Errorf("Error setting k/v pairs: %v", err)
 	}
+	return nil
 }
 
 // set k/v pairs in set of documents using where clause
-func (p *ProviderMongo) SetKVDocumentWhere(kv, where KVList) {
+func (p *mongoCall) setKVDocumentWhere(kv, where KVList) (err error) {
+	defer p.feed.Track(p, ChangeSet, func() ([]KVList, error) { return p.getDocumentSetWhere(where) }).Publish(&err)
+	update := kvSetUpdate(kv)
+	if update == nil {
+		return nil
+	}
 	// discarding mgo.CollectionInfo
-	_, err := p.db_mq.C("records").UpdateAll(KVList2Bson(where), bson.M{"$set": KVList2Bson(kv)})
+	_, err = p.db_mq.C("records").UpdateAll(KVList2Bson(where), update)
 	if err != nil {
-		Report.Fatal("Error setting k/v pairs: %v", err)
+		return fmt.Errorf("Error setting k/v pairs: %v", err)
 	}
+	return nil
 }
 
 // set k/v pairs for set of documents with k/v matching glob
-func (p *ProviderMongo) SetKVDocumentValueGlob(kv KVList, key, value_glob string) {
+func (p *mongoCall) setKVDocumentValueGlob(kv KVList, key, value_glob string) (err error) {
+	filter, err := selectorBson(BatchSelector{Key: key, ValueGlob: value_glob})
+	if err != nil {
+		return err
+	}
+	defer p.feed.Track(p, ChangeSet, func() ([]KVList, error) { return p.getDocumentSetValueGlob(key, value_glob) }).Publish(&err)
+	update := kvSetUpdate(kv)
+	if update == nil {
+		return nil
+	}
 	// discarding mgo.CollectionInfo
-	_, err := p.db_mq.C("records").UpdateAll(bson.M{key: bson.M{"$regex": value_glob}}, bson.M{"$set": KVList2Bson(kv)})
+	_, err = p.db_mq.C("records").UpdateAll(filter, update)
+	if err != nil {
+		return fmt.Errorf("Error setting k/v pairs: %v", err)
+	}
+	return nil
+}
+
+// replace all k/v pairs of a unique document, keeping its uuid
+// a full-document update is atomic in MongoDB, so no reader sees a partial replacement
+func (p *mongoCall) replaceDocumentUnique(doc KVList, uuid string) (err error) {
+	defer p.feed.Track(p, ChangeSet, nil, uuid).Publish(&err)
+	replacement := KVList2Bson(doc)
+	replacement["uuid"] = uuid
+	err = p.db_mq.C("records").Update(bson.M{"uuid": uuid}, replacement)
 	if err != nil {
-		Report.Fatal("Error setting k/v pairs: %v", err)
+		return fmt.Errorf("Error replacing document: %v", err)
 	}
+	return nil
 }
 
 // Delete Operations
 
 // delete list of keys in unique document
-func (p *ProviderMongo) DeleteKeyDocumentUnique(keys []string, uuid string) {
+func (p *mongoCall) deleteKeyDocumentUnique(keys []string, uuid string) (err error) {
+	defer p.feed.Track(p, ChangeDeleteKey, nil, uuid).Publish(&err)
 	removekeys := bson.M{}
 	for _, key := range keys {
 		removekeys[key] = ""
 	}
 	update := bson.M{"$unset": removekeys}
-	err := p.db_mq.C("records").Update(bson.M{"uuid": uuid}, update)
+	err = p.db_mq.C("records").Update(bson.M{"uuid": uuid}, update)
 	if err != nil {
-		Report.Fatal("Error deleting key from document: %v", err)
+		return fmt.Errorf("Error deleting key from document: %v", err)
 	}
+	return nil
 }
 
 // delete list of keys in set of documents using where clause
-func (p *ProviderMongo) DeleteKeyDocumentWhere(keys []string, where KVList) {
+func (p *mongoCall) deleteKeyDocumentWhere(keys []string, where KVList) (err error) {
+	defer p.feed.Track(p, ChangeDeleteKey, func() ([]KVList, error) { return p.getDocumentSetWhere(where) }).Publish(&err)
 	removekeys := bson.M{}
 	for _, key := range keys {
 		removekeys[key] = ""
 	}
 	update := bson.M{"$unset": removekeys}
-	_, err := p.db_mq.C("records").UpdateAll(KVList2Bson(where), update)
+	_, err = p.db_mq.C("records").UpdateAll(KVList2Bson(where), update)
 	if err != nil {
-		Report.Fatal("Error deleting key from documents: %v", err)
+		return fmt.Errorf("Error deleting key from documents: %v", err)
 	}
+	return nil
 }
 
 // delete keys that match glob in unique document
-func (p *ProviderMongo) DeleteKeyGlobDocumentUnique(key_glob, uuid string) {
+func (p *mongoCall) deleteKeyGlobDocumentUnique(key_glob, uuid string) (err error) {
+	g, err := ParseGlob(key_glob)
+	if err != nil {
+		return err
+	}
+	defer p.feed.Track(p, ChangeDeleteKey, nil, uuid).Publish(&err)
 	var doc bson.M
-	re := regexp.MustCompile(key_glob)
 	removekeys := bson.M{}
-	err := p.db_mq.C("records").Find(bson.M{"uuid": uuid}).One(&doc)
+	err = p.db_mq.C("records").Find(bson.M{"uuid": uuid}).One(&doc)
 	if err != nil {
-		Report.Fatal("Error finding doc with uuid %v", err)
+		return fmt.Errorf("Error finding doc with uuid %v", err)
 	}
 	delete(doc, "_id")
 	delete(doc, "uuid")
 	for k, _ := range doc {
-		if re.MatchString(k) {
+		if g.Match(k) {
 			removekeys[k] = ""
 		}
 	}
 	update := bson.M{"$unset": removekeys}
 	err = p.db_mq.C("records").Update(bson.M{"uuid": uuid}, update)
 	if err != nil {
-		Report.Fatal("Error deleting keys from document: %v", err)
+		return fmt.Errorf("Error deleting keys from document: %v", err)
 	}
+	return nil
 }
 
 // delete keys that match glob in set of documents using where clause
-func (p *ProviderMongo) DeleteKeyGlobDocumentWhere(key_glob string, where KVList) {
+// changes are reported by DeleteKeyGlobDocumentUnique, once per document
+func (p *mongoCall) deleteKeyGlobDocumentWhere(key_glob string, where KVList) error {
 	q := p.db_mq.C("records").Find(KVList2Bson(where))
 	it := q.Iter()
 	doc := bson.M{}
 	for it.Next(&doc) {
-		p.DeleteKeyGlobDocumentUnique(key_glob, doc["uuid"].(string))
+		if err := p.deleteKeyGlobDocumentUnique(key_glob, doc["uuid"].(string)); err != nil {
+			it.Close()
+			return err
+		}
+	}
+	if err := it.Close(); err != nil {
+		return fmt.Errorf("Error finding documents: %v", err)
+	}
+	return nil
+}
+
+// delete a unique document entirely
+func (p *mongoCall) deleteDocumentUnique(uuid string) (err error) {
+	defer p.feed.Track(p, ChangeDeleteDocument, nil, uuid).Publish(&err)
+	err = p.db_mq.C("records").Remove(bson.M{"uuid": uuid})
+	if err != nil {
+		return fmt.Errorf("Error deleting document: %v", err)
+	}
+	return nil
+}
+
+// delete every document matching a where clause
+func (p *mongoCall) deleteDocumentsWhere(where KVList) (err error) {
+	defer p.feed.Track(p, ChangeDeleteDocument, func() ([]KVList, error) { return p.getDocumentSetWhere(where) }).Publish(&err)
+	_, err = p.db_mq.C("records").RemoveAll(KVList2Bson(where))
+	if err != nil {
+		return fmt.Errorf("Error deleting documents: %v", err)
+	}
+	return nil
+}
+
+// Batch Operations
+
+// apply every operation in the batch atomically, using a MongoDB
+// multi-document transaction. Each operation becomes one multi-document update
+// statement, so the documents it touches are selected inside the transaction
+func (p *mongoCall) applyBatch(batch *MetadataBatch) (applied bool, err error) {
+	if !p.txn {
+		return false, nil
+	}
+	updates := []bson.M{}
+	for _, op := range batch.Ops {
+		filter, err := selectorBson(op.Select)
+		if err != nil {
+			return false, err
+		}
+		var update interface{}
+		switch op.Kind {
+		case BatchSetKV:
+			set := kvSetUpdate(op.KV)
+			if set == nil {
+				continue
+			}
+			update = set
+		case BatchDeleteKeys:
+			removekeys := bson.M{}
+			for _, key := range op.Keys {
+				removekeys[key] = ""
+			}
+			update = bson.M{"$unset": removekeys}
+		case BatchDeleteKeyGlob:
+			g, err := ParseGlob(op.KeyGlob)
+			if err != nil {
+				return false, err
+			}
+			// rebuild the document from the fields whose names don't match,
+			// always keeping _id and uuid as DeleteKeyGlobDocumentUnique does
+			keep := bson.M{"$or": []interface{}{
+				bson.M{"$in": []interface{}{"$$this.k", []string{"_id", "uuid"}}},
+				bson.M{"$not": []interface{}{bson.M{"$regexMatch": bson.M{"input": "$$this.k", "regex": g.Regex()}}}},
+			}}
+			update = []bson.M{bson.M{"$replaceWith": bson.M{"$arrayToObject": bson.M{"$filter": bson.M{
+				"input": bson.M{"$objectToArray": "$$ROOT"},
+				"cond":  keep,
+			}}}}}
+		}
+		updates = append(updates, bson.M{"q": filter, "u": update, "multi": true})
+	}
+	defer p.feed.Track(p, batchChangeKind(batch), func() ([]KVList, error) { return batchDocuments(p, batch) }).Publish(&err)
+	err = runMongoTxn(p.db_mq, func(t *mongoTxn) error {
+		return t.update("records", updates)
+	})
+	if err != nil {
+		return false, fmt.Errorf("Error applying batch: %v", err)
+	}
+	return true, nil
+}
+
+// Subscriptions
+
+// subscribe to changes of documents matching a where clause, as made
+// through this provider. The subscription is closed when ctx is done
+func (p *ProviderMongo) Subscribe(ctx context.Context, where KVList) *Subscription {
+	return p.feed.Subscribe(ctx, where)
+}
+
+//== IndexManager
+
+// create an index on the given keys, unless it exists already
+func (p *mongoCall) ensureIndex(keys ...string) error {
+	if err := p.db_mq.C("records").EnsureIndex(mgo.Index{Key: keys}); err != nil {
+		return fmt.Errorf("Error creating index on %v: %v", keys, err)
+	}
+	return nil
+}
+
+// drop the index on exactly the given keys
+func (p *mongoCall) dropIndex(keys ...string) error {
+	if err := p.db_mq.C("records").DropIndex(keys...); err != nil {
+		return fmt.Errorf("Error dropping index on %v: %v", keys, err)
+	}
+	return nil
+}
+
+// list the keys of every index that can be dropped, which is all but _id
+func (p *mongoCall) listIndexes() ([][]string, error) {
+	indexes, err := p.db_mq.C("records").Indexes()
+	if err != nil {
+		return nil, fmt.Errorf("Error listing indexes: %v", err)
+	}
+	ret := [][]string{}
+	for _, index := range indexes {
+		if len(index.Key) == 1 && index.Key[0] == "_id" {
+			continue
+		}
+		ret = append(ret, index.Key)
+	}
+	return ret, nil
+}
+
+//== QueryExplainer
+
+// explain the find, distinct or aggregate an operation runs
+func (p *mongoCall) explain(q Query) (*QueryPlan, error) {
+	if sel, ok := q.selector(); ok {
+		filter, err := selectorBson(sel)
+		if err != nil {
+			return nil, err
+		}
+		cmd := explainFind("records", filter)
+		if q.Op == "ExistsWhere" {
+			cmd = append(cmd, bson.DocElem{Name: "limit", Value: 1})
+		}
+		return mongoExplain(p.db_mq, cmd)
+	}
+	switch q.Op {
+	case "GetUniqueValues":
+		return mongoExplain(p.db_mq, explainDistinct("records", q.Key, bson.M{}))
+	case "GetKeyGlob":
+		return mongoExplain(p.db_mq, explainFind("records", bson.M{}))
+	case "GetUniqueValueCounts":
+		return mongoExplain(p.db_mq, explainAggregate("records", uniqueValueCountsPipeline(q.Key)))
+	}
+	return nil, nil
+}
+
+//== DocumentScanner
+
+// call fn with every document with a uuid after *after, in uuid order, and
+// note the uuid of each document fn is called with in *after, so that a retry
+// carries on where the scan broke off
+func (p *mongoCall) scanDocuments(after *string, fn func(doc KVList) error) error {
+	it := p.db_mq.C("records").Find(bson.M{"uuid": bson.M{"$gt": *after}}).Sort("uuid").Iter()
+	res := bson.M{}
+	for it.Next(&res) {
+		doc := Bson2KVList(res)
+		if err := fn(doc); err != nil {
+			it.Close()
+			return err
+		}
+		*after, _ = doc.Get("uuid")
+		res = bson.M{}
+	}
+	if err := it.Close(); err != nil {
+		return fmt.Errorf("Error scanning documents: %v", err)
 	}
+	return nil
 }
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// The exported methods of the Mongo providers. Each runs the unexported
+// method that does the work under the caller's context and the provider's
+// RetryPolicy, bound to a session from the provider's pool
+
+var errNotInitialized = errors.New("Mongo provider is not initialized")
+
+//== ProviderMongo
+
+// make a call under ctx with the provider's RetryPolicy. Each try runs on a
+// session of its own from the pool
+func (p *ProviderMongo) call(ctx context.Context, write bool, call func(c *mongoCall) (interface{}, error)) (interface{}, error) {
+	return p.Retry.do(ctx, write, func() (interface{}, error) {
+		pool := p.pool
+		if pool == nil {
+			return nil, errNotInitialized
+		}
+		ses, err := pool.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res, err := call(p.bind(ses))
+		pool.put(ses, err)
+		return res, err
+	})
+}
+
+// connect and set up the databases. This runs on the caller's goroutine, with
+// the dial and the setup's socket timeouts cut to ctx's deadline, so it is
+// over when Initialize returns, and leaves nothing half set up behind
+func (p *ProviderMongo) Initialize(ctx context.Context) error {
+	_, err := p.Retry.retry(ctx, false, func() (interface{}, error) { return nil, p.initialize(ctx) })
+	return err
+}
+
+// end the provider's sessions. It can be initialized again afterwards
+func (p *ProviderMongo) Close() error {
+	p.close()
+	return nil
+}
+
+func (p *ProviderMongo) GetRecord(ctx context.Context, key string) (BosswaveRecord, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.getRecord(key) })
+	rv, _ := res.(BosswaveRecord)
+	return rv, err
+}
+
+func (p *ProviderMongo) InsertRecord(ctx context.Context, r BosswaveRecord) error {
+	_, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return nil, c.insertRecord(r) })
+	return err
+}
+
+func (p *ProviderMongo) GetKeysUpToSlash(ctx context.Context, keyprefix string) ([]string, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.getKeysUpToSlash(keyprefix) })
+	rv, _ := res.([]string)
+	return rv, err
+}
+
+func (p *ProviderMongo) SumSize(ctx context.Context, AllocSet int64) (int64, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.sumSize(AllocSet) })
+	rv, _ := res.(int64)
+	return rv, err
+}
+
+func (p *ProviderMongo) CreateAllocSet(ctx context.Context, r AllocationSet) error {
+	_, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return nil, c.createAllocSet(r) })
+	return err
+}
+
+func (p *ProviderMongo) GetAllocSetID(ctx context.Context, vk VK) (int64, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.getAllocSetID(vk) })
+	rv, _ := res.(int64)
+	return rv, err
+}
+
+func (p *ProviderMongo) GetDocumentUnique(ctx context.Context, uuid string) (KVList, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.getDocumentUnique(uuid) })
+	rv, _ := res.(KVList)
+	return rv, err
+}
+
+func (p *ProviderMongo) GetDocumentSetWhere(ctx context.Context, where KVList) ([]KVList, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.getDocumentSetWhere(where) })
+	rv, _ := res.([]KVList)
+	return rv, err
+}
+
+func (p *ProviderMongo) GetUniqueValues(ctx context.Context, key string) ([]interface{}, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.getUniqueValues(key) })
+	rv, _ := res.([]interface{})
+	return rv, err
+}
+
+func (p *ProviderMongo) GetDocumentSetValueGlob(ctx context.Context, key, value_glob string) ([]KVList, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.getDocumentSetValueGlob(key, value_glob) })
+	rv, _ := res.([]KVList)
+	return rv, err
+}
+
+func (p *ProviderMongo) GetKeyGlob(ctx context.Context, key_glob string) ([]string, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.getKeyGlob(key_glob) })
+	rv, _ := res.([]string)
+	return rv, err
+}
+
+func (p *ProviderMongo) CountWhere(ctx context.Context, where KVList) (int, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.countWhere(where) })
+	rv, _ := res.(int)
+	return rv, err
+}
+
+func (p *ProviderMongo) CountValueGlob(ctx context.Context, key, value_glob string) (int, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.countValueGlob(key, value_glob) })
+	rv, _ := res.(int)
+	return rv, err
+}
+
+func (p *ProviderMongo) ExistsWhere(ctx context.Context, where KVList) (bool, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.existsWhere(where) })
+	rv, _ := res.(bool)
+	return rv, err
+}
+
+func (p *ProviderMongo) GetUniqueValueCounts(ctx context.Context, key string) (map[string]int, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.getUniqueValueCounts(key) })
+	rv, _ := res.(map[string]int)
+	return rv, err
+}
+
+func (p *ProviderMongo) InsertDocument(ctx context.Context, docs []KVList) error {
+	_, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return nil, c.insertDocument(docs) })
+	return err
+}
+
+func (p *ProviderMongo) BulkInsertDocument(ctx context.Context, docs []KVList, batchsize int) ([]DocumentError, error) {
+	res, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return c.bulkInsertDocument(docs, batchsize) })
+	rv, _ := res.([]DocumentError)
+	return rv, err
+}
+
+func (p *ProviderMongo) BulkSetKVDocumentUnique(ctx context.Context, updates []DocumentUpdate, batchsize int) ([]DocumentError, error) {
+	res, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return c.bulkSetKVDocumentUnique(updates, batchsize) })
+	rv, _ := res.([]DocumentError)
+	return rv, err
+}
+
+func (p *ProviderMongo) UpsertDocument(ctx context.Context, doc KVList) error {
+	_, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return nil, c.upsertDocument(doc) })
+	return err
+}
+
+func (p *ProviderMongo) SetKVDocumentUnique(ctx context.Context, kv KVList, uuid string) error {
+	_, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return nil, c.setKVDocumentUnique(kv, uuid) })
+	return err
+}
+
+func (p *ProviderMongo) SetKVDocumentWhere(ctx context.Context, kv, where KVList) error {
+	_, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return nil, c.setKVDocumentWhere(kv, where) })
+	return err
+}
+
+func (p *ProviderMongo) SetKVDocumentValueGlob(ctx context.Context, kv KVList, key, value_glob string) error {
+	_, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return nil, c.setKVDocumentValueGlob(kv, key, value_glob) })
+	return err
+}
+
+func (p *ProviderMongo) ReplaceDocumentUnique(ctx context.Context, doc KVList, uuid string) error {
+	_, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return nil, c.replaceDocumentUnique(doc, uuid) })
+	return err
+}
+
+func (p *ProviderMongo) DeleteKeyDocumentUnique(ctx context.Context, keys []string, uuid string) error {
+	_, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return nil, c.deleteKeyDocumentUnique(keys, uuid) })
+	return err
+}
+
+func (p *ProviderMongo) DeleteKeyDocumentWhere(ctx context.Context, keys []string, where KVList) error {
+	_, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return nil, c.deleteKeyDocumentWhere(keys, where) })
+	return err
+}
+
+func (p *ProviderMongo) DeleteKeyGlobDocumentUnique(ctx context.Context, key_glob, uuid string) error {
+	_, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return nil, c.deleteKeyGlobDocumentUnique(key_glob, uuid) })
+	return err
+}
+
+func (p *ProviderMongo) DeleteKeyGlobDocumentWhere(ctx context.Context, key_glob string, where KVList) error {
+	_, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return nil, c.deleteKeyGlobDocumentWhere(key_glob, where) })
+	return err
+}
+
+func (p *ProviderMongo) DeleteDocumentUnique(ctx context.Context, uuid string) error {
+	_, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return nil, c.deleteDocumentUnique(uuid) })
+	return err
+}
+
+func (p *ProviderMongo) DeleteDocumentsWhere(ctx context.Context, where KVList) error {
+	_, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return nil, c.deleteDocumentsWhere(where) })
+	return err
+}
+
+func (p *ProviderMongo) ApplyBatch(ctx context.Context, batch *MetadataBatch) (bool, error) {
+	res, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return c.applyBatch(batch) })
+	rv, _ := res.(bool)
+	return rv, err
+}
+
+func (p *ProviderMongo) GetDocumentUniqueAsOf(ctx context.Context, uuid string, t time.Time) (KVList, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.getDocumentUniqueAsOf(uuid, t) })
+	rv, _ := res.(KVList)
+	return rv, err
+}
+
+func (p *ProviderMongo) GetDocumentSetWhereAsOf(ctx context.Context, where KVList, t time.Time) ([]KVList, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.getDocumentSetWhereAsOf(where, t) })
+	rv, _ := res.([]KVList)
+	return rv, err
+}
+
+func (p *ProviderMongo) GetUniqueValuesAsOf(ctx context.Context, key string, t time.Time) ([]interface{}, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.getUniqueValuesAsOf(key, t) })
+	rv, _ := res.([]interface{})
+	return rv, err
+}
+
+func (p *ProviderMongo) GetDocumentSetValueGlobAsOf(ctx context.Context, key, value_glob string, t time.Time) ([]KVList, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.getDocumentSetValueGlobAsOf(key, value_glob, t) })
+	rv, _ := res.([]KVList)
+	return rv, err
+}
+
+func (p *ProviderMongo) GetKeyGlobAsOf(ctx context.Context, key_glob string, t time.Time) ([]string, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.getKeyGlobAsOf(key_glob, t) })
+	rv, _ := res.([]string)
+	return rv, err
+}
+
+func (p *ProviderMongo) CountWhereAsOf(ctx context.Context, where KVList, t time.Time) (int, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.countWhereAsOf(where, t) })
+	rv, _ := res.(int)
+	return rv, err
+}
+
+func (p *ProviderMongo) CountValueGlobAsOf(ctx context.Context, key, value_glob string, t time.Time) (int, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.countValueGlobAsOf(key, value_glob, t) })
+	rv, _ := res.(int)
+	return rv, err
+}
+
+func (p *ProviderMongo) ExistsWhereAsOf(ctx context.Context, where KVList, t time.Time) (bool, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.existsWhereAsOf(where, t) })
+	rv, _ := res.(bool)
+	return rv, err
+}
+
+func (p *ProviderMongo) GetUniqueValueCountsAsOf(ctx context.Context, key string, t time.Time) (map[string]int, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.getUniqueValueCountsAsOf(key, t) })
+	rv, _ := res.(map[string]int)
+	return rv, err
+}
+
+func (p *ProviderMongo) GetDocumentHistory(ctx context.Context, uuid string) ([]ChangeEvent, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.getDocumentHistory(uuid) })
+	rv, _ := res.([]ChangeEvent)
+	return rv, err
+}
+
+func (p *ProviderMongo) CompactHistory(ctx context.Context) error {
+	_, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return nil, c.compactHistory() })
+	return err
+}
+
+func (p *ProviderMongo) EnsureIndex(ctx context.Context, keys ...string) error {
+	_, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return nil, c.ensureIndex(keys...) })
+	return err
+}
+
+func (p *ProviderMongo) DropIndex(ctx context.Context, keys ...string) error {
+	_, err := p.call(ctx, true, func(c *mongoCall) (interface{}, error) { return nil, c.dropIndex(keys...) })
+	return err
+}
+
+func (p *ProviderMongo) ListIndexes(ctx context.Context) ([][]string, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.listIndexes() })
+	rv, _ := res.([][]string)
+	return rv, err
+}
+
+func (p *ProviderMongo) Explain(ctx context.Context, q Query) (*QueryPlan, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return c.explain(q) })
+	rv, _ := res.(*QueryPlan)
+	return rv, err
+}
+
+func (p *ProviderMongo) ScanDocuments(ctx context.Context, fn func(doc KVList) error) error {
+	after := ""
+	_, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return nil, c.scanDocuments(&after, fn) })
+	return err
+}
+
+func (p *ProviderMongo) Describe(ctx context.Context) (ProviderInfo, error) {
+	res, err := p.call(ctx, false, func(c *mongoCall) (interface{}, error) { return mongoServer(c.db_mq.Session) })
+	server, _ := res.(string)
+	return ProviderInfo{Server: server, Config: mongoProviderConfig{p.Mongo.redacted(), p.Retry, p.HistoryPolicy}}, err
+}
+
+//== ProviderMongoExploded
+
+// make a call under ctx with the provider's RetryPolicy. Each try runs on a
+// session of its own from the pool
+func (p *ProviderMongoExploded) call(ctx context.Context, write bool, call func(c *explodedCall) (interface{}, error)) (interface{}, error) {
+	return p.Retry.do(ctx, write, func() (interface{}, error) {
+		pool := p.pool
+		if pool == nil {
+			return nil, errNotInitialized
+		}
+		ses, err := pool.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res, err := call(p.bind(ses))
+		pool.put(ses, err)
+		return res, err
+	})
+}
+
+// connect and set up the database, as ProviderMongo.Initialize does
+func (p *ProviderMongoExploded) Initialize(ctx context.Context) error {
+	_, err := p.Retry.retry(ctx, false, func() (interface{}, error) { return nil, p.initialize(ctx) })
+	return err
+}
+
+// end the provider's sessions. It can be initialized again afterwards
+func (p *ProviderMongoExploded) Close() error {
+	p.close()
+	return nil
+}
+
+func (p *ProviderMongoExploded) GetDocumentUnique(ctx context.Context, uuid string) (KVList, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.getDocumentUnique(uuid) })
+	rv, _ := res.(KVList)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) GetDocumentSetWhere(ctx context.Context, where KVList) ([]KVList, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.getDocumentSetWhere(where) })
+	rv, _ := res.([]KVList)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) GetUniqueValues(ctx context.Context, key string) ([]interface{}, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.getUniqueValues(key) })
+	rv, _ := res.([]interface{})
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) GetDocumentSetValueGlob(ctx context.Context, key, value_glob string) ([]KVList, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.getDocumentSetValueGlob(key, value_glob) })
+	rv, _ := res.([]KVList)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) GetKeyGlob(ctx context.Context, key_glob string) ([]string, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.getKeyGlob(key_glob) })
+	rv, _ := res.([]string)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) CountWhere(ctx context.Context, where KVList) (int, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.countWhere(where) })
+	rv, _ := res.(int)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) CountValueGlob(ctx context.Context, key, value_glob string) (int, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.countValueGlob(key, value_glob) })
+	rv, _ := res.(int)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) ExistsWhere(ctx context.Context, where KVList) (bool, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.existsWhere(where) })
+	rv, _ := res.(bool)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) GetUniqueValueCounts(ctx context.Context, key string) (map[string]int, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.getUniqueValueCounts(key) })
+	rv, _ := res.(map[string]int)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) InsertDocument(ctx context.Context, docs []KVList) error {
+	_, err := p.call(ctx, true, func(c *explodedCall) (interface{}, error) { return nil, c.insertDocument(docs) })
+	return err
+}
+
+func (p *ProviderMongoExploded) BulkInsertDocument(ctx context.Context, docs []KVList, batchsize int) ([]DocumentError, error) {
+	res, err := p.call(ctx, true, func(c *explodedCall) (interface{}, error) { return c.bulkInsertDocument(docs, batchsize) })
+	rv, _ := res.([]DocumentError)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) BulkSetKVDocumentUnique(ctx context.Context, updates []DocumentUpdate, batchsize int) ([]DocumentError, error) {
+	res, err := p.call(ctx, true, func(c *explodedCall) (interface{}, error) { return c.bulkSetKVDocumentUnique(updates, batchsize) })
+	rv, _ := res.([]DocumentError)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) UpsertDocument(ctx context.Context, doc KVList) error {
+	_, err := p.call(ctx, true, func(c *explodedCall) (interface{}, error) { return nil, c.upsertDocument(doc) })
+	return err
+}
+
+func (p *ProviderMongoExploded) SetKVDocumentUnique(ctx context.Context, kv KVList, uuid string) error {
+	_, err := p.call(ctx, true, func(c *explodedCall) (interface{}, error) { return nil, c.setKVDocumentUnique(kv, uuid) })
+	return err
+}
+
+func (p *ProviderMongoExploded) SetKVDocumentWhere(ctx context.Context, kv, where KVList) error {
+	_, err := p.call(ctx, true, func(c *explodedCall) (interface{}, error) { return nil, c.setKVDocumentWhere(kv, where) })
+	return err
+}
+
+func (p *ProviderMongoExploded) SetKVDocumentValueGlob(ctx context.Context, kv KVList, key, value_glob string) error {
+	_, err := p.call(ctx, true, func(c *explodedCall) (interface{}, error) { return nil, c.setKVDocumentValueGlob(kv, key, value_glob) })
+	return err
+}
+
+func (p *ProviderMongoExploded) ReplaceDocumentUnique(ctx context.Context, doc KVList, uuid string) error {
+	_, err := p.call(ctx, true, func(c *explodedCall) (interface{}, error) { return nil, c.replaceDocumentUnique(doc, uuid) })
+	return err
+}
+
+func (p *ProviderMongoExploded) DeleteKeyDocumentUnique(ctx context.Context, keys []string, uuid string) error {
+	_, err := p.call(ctx, true, func(c *explodedCall) (interface{}, error) { return nil, c.deleteKeyDocumentUnique(keys, uuid) })
+	return err
+}
+
+func (p *ProviderMongoExploded) DeleteKeyDocumentWhere(ctx context.Context, keys []string, where KVList) error {
+	_, err := p.call(ctx, true, func(c *explodedCall) (interface{}, error) { return nil, c.deleteKeyDocumentWhere(keys, where) })
+	return err
+}
+
+func (p *ProviderMongoExploded) DeleteKeyGlobDocumentUnique(ctx context.Context, key_glob, uuid string) error {
+	_, err := p.call(ctx, true, func(c *explodedCall) (interface{}, error) { return nil, c.deleteKeyGlobDocumentUnique(key_glob, uuid) })
+	return err
+}
+
+func (p *ProviderMongoExploded) DeleteKeyGlobDocumentWhere(ctx context.Context, key_glob string, where KVList) error {
+	_, err := p.call(ctx, true, func(c *explodedCall) (interface{}, error) { return nil, c.deleteKeyGlobDocumentWhere(key_glob, where) })
+	return err
+}
+
+func (p *ProviderMongoExploded) DeleteDocumentUnique(ctx context.Context, uuid string) error {
+	_, err := p.call(ctx, true, func(c *explodedCall) (interface{}, error) { return nil, c.deleteDocumentUnique(uuid) })
+	return err
+}
+
+func (p *ProviderMongoExploded) DeleteDocumentsWhere(ctx context.Context, where KVList) error {
+	_, err := p.call(ctx, true, func(c *explodedCall) (interface{}, error) { return nil, c.deleteDocumentsWhere(where) })
+	return err
+}
+
+func (p *ProviderMongoExploded) ApplyBatch(ctx context.Context, batch *MetadataBatch) (bool, error) {
+	res, err := p.call(ctx, true, func(c *explodedCall) (interface{}, error) { return c.applyBatch(batch) })
+	rv, _ := res.(bool)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) GetDocumentUniqueAsOf(ctx context.Context, uuid string, t time.Time) (KVList, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.getDocumentUniqueAsOf(uuid, t) })
+	rv, _ := res.(KVList)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) GetDocumentSetWhereAsOf(ctx context.Context, where KVList, t time.Time) ([]KVList, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.getDocumentSetWhereAsOf(where, t) })
+	rv, _ := res.([]KVList)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) GetUniqueValuesAsOf(ctx context.Context, key string, t time.Time) ([]interface{}, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.getUniqueValuesAsOf(key, t) })
+	rv, _ := res.([]interface{})
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) GetDocumentSetValueGlobAsOf(ctx context.Context, key, value_glob string, t time.Time) ([]KVList, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.getDocumentSetValueGlobAsOf(key, value_glob, t) })
+	rv, _ := res.([]KVList)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) GetKeyGlobAsOf(ctx context.Context, key_glob string, t time.Time) ([]string, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.getKeyGlobAsOf(key_glob, t) })
+	rv, _ := res.([]string)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) CountWhereAsOf(ctx context.Context, where KVList, t time.Time) (int, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.countWhereAsOf(where, t) })
+	rv, _ := res.(int)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) CountValueGlobAsOf(ctx context.Context, key, value_glob string, t time.Time) (int, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.countValueGlobAsOf(key, value_glob, t) })
+	rv, _ := res.(int)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) ExistsWhereAsOf(ctx context.Context, where KVList, t time.Time) (bool, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.existsWhereAsOf(where, t) })
+	rv, _ := res.(bool)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) GetUniqueValueCountsAsOf(ctx context.Context, key string, t time.Time) (map[string]int, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.getUniqueValueCountsAsOf(key, t) })
+	rv, _ := res.(map[string]int)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) GetDocumentHistory(ctx context.Context, uuid string) ([]ChangeEvent, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.getDocumentHistory(uuid) })
+	rv, _ := res.([]ChangeEvent)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) CompactHistory(ctx context.Context) error {
+	_, err := p.call(ctx, true, func(c *explodedCall) (interface{}, error) { return nil, c.compactHistory() })
+	return err
+}
+
+func (p *ProviderMongoExploded) EnsureIndex(ctx context.Context, keys ...string) error {
+	_, err := p.call(ctx, true, func(c *explodedCall) (interface{}, error) { return nil, c.ensureIndex(keys...) })
+	return err
+}
+
+func (p *ProviderMongoExploded) DropIndex(ctx context.Context, keys ...string) error {
+	_, err := p.call(ctx, true, func(c *explodedCall) (interface{}, error) { return nil, c.dropIndex(keys...) })
+	return err
+}
+
+func (p *ProviderMongoExploded) ListIndexes(ctx context.Context) ([][]string, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.listIndexes() })
+	rv, _ := res.([][]string)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) Explain(ctx context.Context, q Query) (*QueryPlan, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return c.explain(q) })
+	rv, _ := res.(*QueryPlan)
+	return rv, err
+}
+
+func (p *ProviderMongoExploded) ScanDocuments(ctx context.Context, fn func(doc KVList) error) error {
+	after, emitted := "", map[string]bool{}
+	_, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return nil, c.scanDocuments(&after, emitted, fn) })
+	return err
+}
+
+func (p *ProviderMongoExploded) Describe(ctx context.Context) (ProviderInfo, error) {
+	res, err := p.call(ctx, false, func(c *explodedCall) (interface{}, error) { return mongoServer(c.db_mq.Session) })
+	server, _ := res.(string)
+	return ProviderInfo{Server: server, Config: mongoProviderConfig{p.Mongo.redacted(), p.Retry, p.HistoryPolicy}}, err
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
-	"os"
 )
 
 // The "Exploded" Mongo structures each document as having a linking docid field,
@@ -11,25 +12,79 @@ import (
 // {"key": key, "value": value, "docid": docid}.
 // This allows us to index on keys as well as values
 type ProviderMongoExploded struct {
-	ses *mgo.Session
+	// how to connect, set before Initialize
+	Mongo MongoConfig
+	pool  *mongoPool
 
 	// We only re-implement db_mq here because we are comparing
 	// a different structure of database
 	db_mq *mgo.Database
+
+	// whether the server can run multi-document transactions for ApplyBatch
+	txn bool
+
+	// reports writes to subscribers
+	feed ChangeFeed
+
+	// what history to keep, set before Initialize
+	HistoryPolicy HistoryPolicy
+	mongoHistory
+
+	// how calls that fail with transient errors are retried
+	Retry RetryPolicy
+}
+
+// the provider as one call sees it, as for mongoCall
+type explodedCall struct {
+	*ProviderMongoExploded
+	db_mq *mgo.Database
+	mongoHistory
+}
+
+// bind the provider to a session for one call
+func (p *ProviderMongoExploded) bind(ses *mgo.Session) *explodedCall {
+	return &explodedCall{
+		ProviderMongoExploded: p,
+		db_mq:                 p.db_mq.With(ses),
+		mongoHistory:          p.mongoHistory.with(ses),
+	}
 }
 
-func (p *ProviderMongoExploded) Initialize() {
-	ses, err := mgo.Dial(os.Getenv("MONGODB_SERVER"))
+// connect, dropping any connection made by an earlier Initialize, and set up
+// an empty database, unless the config keeps the data there. The database is
+// not ProviderMongo's, so the two can hold different data on one server
+func (p *ProviderMongoExploded) initialize(ctx context.Context) error {
+	p.close()
+	ses, err := dialMongo(ctx, p.Mongo)
 	if err != nil {
-		Report.Fatal("could not connect to mongo: %v", err)
+		return err
+	}
+	p.pool = newMongoPool(ses, p.Mongo.poolSize(), p.Mongo.socketTimeout())
+	p.db_mq = ses.DB(p.Mongo.DBPrefix + "metadataquery_exploded")
+	p.txn = mongoSupportsTxn(ses)
+	if !p.Mongo.KeepData {
+		p.db_mq.DropDatabase()
 	}
-	p.ses = ses
-	p.db_mq = ses.DB("metadataquery")
-	p.db_mq.DropDatabase()
 
 	//MetadataQuery initialization
 	p.db_mq.C("records").EnsureIndex(mgo.Index{Key: []string{"key"}, Unique: false})
 	p.db_mq.C("records").EnsureIndex(mgo.Index{Key: []string{"docid"}, Unique: false})
+	err = p.mongoHistory.init(p.db_mq.C("history"), p.HistoryPolicy, &p.feed)
+	if ctx.Err() != nil {
+		// the setup above was cut short, so it can't be trusted
+		p.close()
+		return ctx.Err()
+	}
+	restoreTimeouts(ses, p.Mongo)
+	return err
+}
+
+// end every session of the pool
+func (p *ProviderMongoExploded) close() {
+	if p.pool != nil {
+		p.pool.close()
+		p.pool = nil
+	}
 }
 
 //== MetadataQuery
@@ -65,164 +120,511 @@ func KVList2ExplodedBsonOne(list KVList, docid string) []bson.M {
 	return ret
 }
 
-// get a single document by using a unique identifier
-// get the document that has the given uuid, then extract all documents that
-// share the resulting docid
-func (p *ProviderMongoExploded) GetDocumentUnique(uuid string) KVList {
+// builds an aggregation pipeline yielding one {"_id": docid} per document that
+// contains every k/v pair in the where clause. Rows matching any of the pairs
+// are grouped by docid, and only groups that matched each key are kept
+func explodedWherePipeline(where KVList) []bson.M {
+	pipe, _ := explodedSelectPipeline(BatchSelector{Where: where})
+	return pipe
+}
+
+// as explodedWherePipeline, with the value glob on sel.Key as one more
+// condition that every selected document has to meet
+func explodedSelectPipeline(sel BatchSelector) ([]bson.M, error) {
+	conds := KVList2ExplodedBsonMany(sel.Where)
+	keys := map[string]bool{}
+	for _, kv := range sel.Where {
+		keys[kv[0]] = true
+	}
+	if sel.Key != "" {
+		values, err := globBson(sel.ValueGlob)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, bson.M{"key": sel.Key, "value": values})
+		keys[sel.Key] = true
+	}
+	if len(conds) == 0 {
+		return []bson.M{bson.M{"$group": bson.M{"_id": "$docid"}}}, nil
+	}
+	return []bson.M{
+		bson.M{"$match": bson.M{"$or": conds}},
+		bson.M{"$group": bson.M{"_id": "$docid", "keys": bson.M{"$addToSet": "$key"}}},
+		bson.M{"$match": bson.M{"keys": bson.M{"$size": len(keys)}}},
+	}, nil
+}
+
+// runs a pipeline that yields one row per document and returns the number of rows
+func (p *explodedCall) countPipeline(pipe []bson.M) (int, error) {
+	pipe = append(pipe, bson.M{"$group": bson.M{"_id": nil, "count": bson.M{"$sum": 1}}})
+	val := struct{ Count int }{}
+	err := p.db_mq.C("records").Pipe(pipe).One(&val)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("Error counting documents: %v", err)
+	}
+	return val.Count, nil
+}
+
+// find the docid of the document with the given uuid
+func (p *explodedCall) docidForUUID(uuid string) (string, error) {
 	var first bson.M
-	var res []bson.M
-	var err error
-	err = p.db_mq.C("records").Find(bson.M{"key": "uuid", "value": uuid}).One(&first)
+	err := p.db_mq.C("records").Find(bson.M{"key": "uuid", "value": uuid}).One(&first)
 	if err != nil {
-		Report.Fatal("Error fetching record uuid: %v", err)
+		return "", fmt.Errorf("Error fetching record uuid: %v", err)
+	}
+	return first["docid"].(string), nil
+}
+
+// find the docids of all documents matching a where clause
+func (p *explodedCall) docidsWhere(where KVList) ([]string, error) {
+	return p.docidsPipeline(explodedWherePipeline(where))
+}
+
+// runs a pipeline yielding one {"_id": docid} per document and collects the docids
+func (p *explodedCall) docidsPipeline(pipe []bson.M) ([]string, error) {
+	it := p.db_mq.C("records").Pipe(pipe).Iter()
+	ret := []string{}
+	val := struct {
+		Docid string `bson:"_id"`
+	}{}
+	for it.Next(&val) {
+		ret = append(ret, val.Docid)
+	}
+	if err := it.Close(); err != nil {
+		return nil, fmt.Errorf("Error selecting documents: %v", err)
 	}
+	return ret, nil
+}
 
-	err = p.db_mq.C("records").Find(bson.M{"docid": first["docid"].(string)}).All(&res)
+// fetches every row of the given docids and assembles them into documents,
+// in the order of docids. A docid without a uuid row is a document that
+// ReplaceDocumentUnique is in the middle of replacing, either the new rows
+// before the uuid moves to them or the old ones after, and is left out
+func (p *explodedCall) documentsForDocids(docids []string) ([]KVList, error) {
+	ret := []KVList{}
+	if len(docids) == 0 {
+		return ret, nil
+	}
+	var rows []bson.M
+	err := p.db_mq.C("records").Find(bson.M{"docid": bson.M{"$in": docids}}).All(&rows)
 	if err != nil {
-		Report.Fatal("Error fetching all docs with same docid: %v", err)
+		return nil, fmt.Errorf("Error fetching documents: %v", err)
+	}
+	bydocid := map[string][]bson.M{}
+	for _, row := range rows {
+		docid := row["docid"].(string)
+		bydocid[docid] = append(bydocid[docid], row)
+	}
+	for _, docid := range docids {
+		if docrows, found := bydocid[docid]; found {
+			doc := ExplodedBson2KVList(docrows)
+			if _, found := doc.Get("uuid"); found {
+				ret = append(ret, doc)
+			}
+		}
 	}
-	return ExplodedBson2KVList(res)
+	return ret, nil
 }
 
-// get a set of documents using a where clause
-func (p *ProviderMongoExploded) GetDocumentSetWhere(where KVList) []KVList {
-	pipe := []bson.M{
-		bson.M{"$match": KVList2ExplodedBsonMany(where)},
-		bson.M{"$group": bson.M{"_id": "$docid", "kvpairs": bson.M{"$push": "$$ROOT"}}},
+// get a single document by using a unique identifier
+// get the document that has the given uuid, then extract all documents that
+// share the resulting docid. ReplaceDocumentUnique moves the uuid row to a new
+// docid, so the lookup is repeated after the fetch and the read is retried if
+// the document was replaced in between
+func (p *explodedCall) getDocumentUnique(uuid string) (KVList, error) {
+	var res []bson.M
+	docid, err := p.docidForUUID(uuid)
+	if err != nil {
+		return nil, err
 	}
-	q := p.db_mq.C("records").Pipe(pipe)
-	it := q.Iter()
-	ret := []KVList{}
-	doc := bson.M{}
-	for it.Next(&doc) {
-		ret = append(ret, ExplodedBson2KVList(doc["metadata"].([]bson.M)))
+	for {
+		err := p.db_mq.C("records").Find(bson.M{"docid": docid}).All(&res)
+		if err != nil {
+			return nil, fmt.Errorf("Error fetching all docs with same docid: %v", err)
+		}
+		current, err := p.docidForUUID(uuid)
+		if err != nil {
+			return nil, err
+		}
+		if current == docid {
+			break
+		}
+		docid = current
 	}
-	return ret
+	return ExplodedBson2KVList(res), nil
+}
+
+// get a set of documents using a where clause
+func (p *explodedCall) getDocumentSetWhere(where KVList) ([]KVList, error) {
+	docids, err := p.docidsWhere(where)
+	if err != nil {
+		return nil, err
+	}
+	return p.documentsForDocids(docids)
 }
 
 // get list of unique values for a given key
 // Find all documents with a "key" of [key], and then find distinct "value"
-func (p *ProviderMongoExploded) GetUniqueValues(key string) []interface{} {
+func (p *explodedCall) getUniqueValues(key string) ([]interface{}, error) {
 	var res []interface{}
 	err := p.db_mq.C("records").Find(bson.M{"key": key}).Distinct("value", &res)
 	if err != nil {
-		Report.Fatal("Error fetching unique values for doc: %v", err)
+		return nil, fmt.Errorf("Error fetching unique values for doc: %v", err)
 	}
-	return res
+	return res, nil
 }
 
-// get a set of documents with a key/value matching a glob (anchored regex)
-func (p *ProviderMongoExploded) GetDocumentSetValueGlob(key, value_glob string) []KVList {
-	pipe := []bson.M{
-		bson.M{"$match": bson.M{"key": key, "value": bson.M{"$regex": value_glob}}},
-		bson.M{"$group": bson.M{"_id": "$docid", "kvpairs": bson.M{"$push": "$$ROOT"}}},
+// get a set of documents with a key/value matching a glob
+func (p *explodedCall) getDocumentSetValueGlob(key, value_glob string) ([]KVList, error) {
+	pipe, err := explodedSelectPipeline(BatchSelector{Key: key, ValueGlob: value_glob})
+	if err != nil {
+		return nil, err
 	}
-	q := p.db_mq.C("records").Pipe(pipe)
-	it := q.Iter()
-	ret := []KVList{}
-	doc := bson.M{}
-	for it.Next(&doc) {
-		ret = append(ret, ExplodedBson2KVList(doc["metadata"].([]bson.M)))
+	docids, err := p.docidsPipeline(pipe)
+	if err != nil {
+		return nil, err
 	}
-	return ret
+	return p.documentsForDocids(docids)
 }
 
 // get a set of keys that match a glob
-func (p *ProviderMongoExploded) GetKeyGlob(key_glob string) []string {
+func (p *explodedCall) getKeyGlob(key_glob string) ([]string, error) {
+	keys, err := globBson(key_glob)
+	if err != nil {
+		return nil, err
+	}
 	var res []bson.M
-	q := p.db_mq.C("records").Find(bson.M{"key": bson.M{"$regex": key_glob}}).Select(bson.M{"key": 1})
-	err := q.All(&res)
+	q := p.db_mq.C("records").Find(bson.M{"key": keys}).Select(bson.M{"key": 1})
+	err = q.All(&res)
 	if err != nil {
-		Report.Fatal("Error retreiving keys that match blob: %v", err)
+		return nil, fmt.Errorf("Error retreiving keys that match blob: %v", err)
 	}
 	ret := []string{}
 	for _, d := range res {
 		ret = append(ret, d["key"].(string))
 	}
-	return ret
+	return ret, nil
+}
+
+// Count Operations
+
+// get the number of documents matching a where clause
+func (p *explodedCall) countWhere(where KVList) (int, error) {
+	return p.countPipeline(explodedWherePipeline(where))
+}
+
+// get the number of documents with a key/value matching a glob
+func (p *explodedCall) countValueGlob(key, value_glob string) (int, error) {
+	values, err := globBson(value_glob)
+	if err != nil {
+		return 0, err
+	}
+	pipe := []bson.M{
+		bson.M{"$match": bson.M{"key": key, "value": values}},
+		bson.M{"$group": bson.M{"_id": "$docid"}},
+	}
+	return p.countPipeline(pipe)
+}
+
+// check whether any document matches a where clause
+func (p *explodedCall) existsWhere(where KVList) (bool, error) {
+	pipe := append(explodedWherePipeline(where), bson.M{"$limit": 1})
+	var res []bson.M
+	err := p.db_mq.C("records").Pipe(pipe).All(&res)
+	if err != nil {
+		return false, fmt.Errorf("Error checking for documents: %v", err)
+	}
+	return len(res) > 0, nil
+}
+
+func explodedUniqueValueCountsPipeline(key string) []bson.M {
+	return []bson.M{
+		bson.M{"$match": bson.M{"key": key}},
+		bson.M{"$group": bson.M{"_id": bson.M{"value": "$value", "docid": "$docid"}}},
+		bson.M{"$group": bson.M{"_id": "$_id.value", "count": bson.M{"$sum": 1}}},
+	}
+}
+
+// get the number of documents holding each unique value for a given key
+// rows are first grouped on (value, docid) so a document is only counted once per value
+func (p *explodedCall) getUniqueValueCounts(key string) (map[string]int, error) {
+	it := p.db_mq.C("records").Pipe(explodedUniqueValueCountsPipeline(key)).Iter()
+	return collectValueCounts(it)
 }
 
 // Set Operations
 
 // insert list of documents
-func (p *ProviderMongoExploded) InsertDocument(docs []KVList) {
-	for i, doc := range docs {
-		for _, rec := range KVList2ExplodedBsonOne(doc, string(i)) {
+// each document is given a fresh docid so that rows from separate calls never collide
+func (p *explodedCall) insertDocument(docs []KVList) (err error) {
+	defer p.feed.Track(p, ChangeInsert, nil, documentUUIDs(docs)...).Publish(&err)
+	for _, doc := range docs {
+		for _, rec := range KVList2ExplodedBsonOne(doc, bson.NewObjectId().Hex()) {
 			err := p.db_mq.C("records").Insert(rec)
 			if err != nil {
-				Report.Fatal("Error inserting documents: %v", err)
+				return fmt.Errorf("Error inserting documents: %v", err)
 			}
 		}
 	}
+	return nil
 }
 
-// set k/v pairs in unique document
-func (p *ProviderMongoExploded) SetKVDocumentUnique(kv KVList, uuid string) {
-	var first bson.M
-	var err error
-	err = p.db_mq.C("records").Find(bson.M{"key": "uuid", "value": uuid}).One(&first)
-	if err != nil {
-		Report.Fatal("Error fetching doc with uuid: %v", err)
+// queues one upsert per key onto bulk, so an existing row has its value
+// replaced in place and a missing key gets a new row. The uuid row is never
+// touched. Returns the number of operations queued
+func queueSetKV(bulk *mgo.Bulk, kv KVList, docid string) int {
+	ops := 0
+	for _, pair := range kv {
+		if pair[0] == "uuid" {
+			continue
+		}
+		bulk.Upsert(bson.M{"docid": docid, "key": pair[0]}, bson.M{"$set": bson.M{"value": pair[1]}})
+		ops++
 	}
+	return ops
+}
 
-	bson_docs := []bson.M{}
-	for _, kv := range kv {
-		bson_docs = append(bson_docs, bson.M{"key": kv[0], "value": kv[1], "docid": first["docid"].(string)})
+// sets k/v pairs on every given docid with a single unordered bulk write
+func (p *explodedCall) setKVDocids(kv KVList, docids []string) error {
+	bulk := p.db_mq.C("records").Bulk()
+	bulk.Unordered()
+	ops := 0
+	for _, docid := range docids {
+		ops += queueSetKV(bulk, kv, docid)
 	}
-	err = p.db_mq.C("records").Insert(bson_docs)
-	if err != nil {
-		Report.Fatal("Error inserting documents: %v", err)
+	if ops == 0 {
+		return nil
+	}
+	if _, err := bulk.Run(); err != nil {
+		return fmt.Errorf("Error setting k/v pairs: %v", err)
 	}
+	return nil
 }
 
-// set k/v pairs in set of documents using where clause
-func (p *ProviderMongoExploded) SetKVDocumentWhere(kv, where KVList) {
-	var docids []string
-	err := p.db_mq.C("records").Find(KVList2ExplodedBsonMany(where)).Distinct("docid", &docids)
-	if err != nil {
-		Report.Fatal("Error selecting documents: %v", err)
+// insert list of documents using unordered bulk writes of batchsize documents each.
+// Every row of a document is queued in the same batch, so a failed row is
+// reported against the document it belongs to
+func (p *explodedCall) bulkInsertDocument(docs []KVList, batchsize int) (failed []DocumentError, err error) {
+	defer p.feed.Track(p, ChangeInsert, nil, documentUUIDs(docs)...).Publish(&err)
+	failed = []DocumentError{}
+	for start := 0; start < len(docs); start += batchsize {
+		end := start + batchsize
+		if end > len(docs) {
+			end = len(docs)
+		}
+		bulk := p.db_mq.C("records").Bulk()
+		bulk.Unordered()
+		rowdoc := []int{}
+		for i := start; i < end; i++ {
+			for _, rec := range KVList2ExplodedBsonOne(docs[i], bson.NewObjectId().Hex()) {
+				bulk.Insert(rec)
+				rowdoc = append(rowdoc, i)
+			}
+		}
+		if len(rowdoc) == 0 {
+			continue
+		}
+		_, err := bulk.Run()
+		failed = append(failed, bulkDocumentErrors(err, rowdoc)...)
 	}
+	return failed, nil
+}
 
-	bson_docs := []bson.M{}
-	for _, kv := range kv {
-		for _, docid := range docids {
-			bson_docs = append(bson_docs, bson.M{"key": kv[0], "value": kv[1], "docid": docid})
+// apply each update as SetKVDocumentUnique would, using unordered bulk writes
+// of batchsize updates each. The docids for a batch are resolved in one query,
+// and updates whose uuid doesn't exist fail with mgo.ErrNotFound
+func (p *explodedCall) bulkSetKVDocumentUnique(updates []DocumentUpdate, batchsize int) (failed []DocumentError, err error) {
+	defer p.feed.Track(p, ChangeSet, nil, updateUUIDs(updates)...).Publish(&err)
+	failed = []DocumentError{}
+	for start := 0; start < len(updates); start += batchsize {
+		end := start + batchsize
+		if end > len(updates) {
+			end = len(updates)
+		}
+		uuids := []string{}
+		for i := start; i < end; i++ {
+			uuids = append(uuids, updates[i].UUID)
+		}
+		var res []bson.M
+		err := p.db_mq.C("records").Find(bson.M{"key": "uuid", "value": bson.M{"$in": uuids}}).All(&res)
+		if err != nil {
+			for i := start; i < end; i++ {
+				failed = append(failed, DocumentError{Index: i, Err: err})
+			}
+			continue
+		}
+		docids := map[string]string{}
+		for _, row := range res {
+			docids[row["value"].(string)] = row["docid"].(string)
+		}
+
+		bulk := p.db_mq.C("records").Bulk()
+		bulk.Unordered()
+		rowdoc := []int{}
+		for i := start; i < end; i++ {
+			docid, found := docids[updates[i].UUID]
+			if !found {
+				failed = append(failed, DocumentError{Index: i, Err: mgo.ErrNotFound})
+				continue
+			}
+			for n := queueSetKV(bulk, updates[i].KV, docid); n > 0; n-- {
+				rowdoc = append(rowdoc, i)
+			}
+		}
+		if len(rowdoc) == 0 {
+			continue
 		}
+		_, err = bulk.Run()
+		failed = append(failed, bulkDocumentErrors(err, rowdoc)...)
+	}
+	return failed, nil
+}
+
+// set k/v pairs in the document with the doc's uuid, creating the
+// document if no document has that uuid.
+// The uuid row is claimed first with an upsert, so the document's docid is
+// settled before any of its other rows are written
+func (p *explodedCall) upsertDocument(doc KVList) (err error) {
+	defer p.feed.Track(p, ChangeSet, nil, documentUUIDs([]KVList{doc})...).Publish(&err)
+	uuid, found := doc.Get("uuid")
+	if !found {
+		return fmt.Errorf("Error upserting document without uuid: %v", doc)
+	}
+	_, err = p.db_mq.C("records").Upsert(bson.M{"key": "uuid", "value": uuid},
+		bson.M{"$setOnInsert": bson.M{"docid": bson.NewObjectId().Hex()}})
+	if err != nil {
+		return fmt.Errorf("Error upserting document uuid: %v", err)
+	}
+	docid, err := p.docidForUUID(uuid)
+	if err != nil {
+		return err
 	}
-	err = p.db_mq.C("records").Insert(bson_docs)
+	return p.setKVDocids(doc, []string{docid})
+}
+
+// set k/v pairs in unique document
+func (p *explodedCall) setKVDocumentUnique(kv KVList, uuid string) (err error) {
+	defer p.feed.Track(p, ChangeSet, nil, uuid).Publish(&err)
+	docid, err := p.docidForUUID(uuid)
+	if err != nil {
+		return err
+	}
+	return p.setKVDocids(kv, []string{docid})
+}
+
+// set k/v pairs in set of documents using where clause
+func (p *explodedCall) setKVDocumentWhere(kv, where KVList) (err error) {
+	defer p.feed.Track(p, ChangeSet, func() ([]KVList, error) { return p.getDocumentSetWhere(where) }).Publish(&err)
+	docids, err := p.docidsWhere(where)
 	if err != nil {
-		Report.Fatal("Error inserting documents: %v", err)
+		return err
 	}
+	return p.setKVDocids(kv, docids)
 }
 
 // set k/v pairs for set of documents with k/v matching glob
-func (p *ProviderMongoExploded) SetKVDocumentValueGlob(kv KVList, key, value_glob string) {
+func (p *explodedCall) setKVDocumentValueGlob(kv KVList, key, value_glob string) (err error) {
+	values, err := globBson(value_glob)
+	if err != nil {
+		return err
+	}
+	defer p.feed.Track(p, ChangeSet, func() ([]KVList, error) { return p.getDocumentSetValueGlob(key, value_glob) }).Publish(&err)
 	var docids []string
-	err := p.db_mq.C("records").Find(bson.M{"key": key, "value": bson.M{"$regex": value_glob}}).Distinct("docid", &docids)
+	err = p.db_mq.C("records").Find(bson.M{"key": key, "value": values}).Distinct("docid", &docids)
 	if err != nil {
-		Report.Fatal("Error selecting documents: %v", err)
+		return fmt.Errorf("Error selecting documents: %v", err)
 	}
+	return p.setKVDocids(kv, docids)
+}
 
-	bson_docs := []bson.M{}
-	for _, kv := range kv {
-		for _, docid := range docids {
-			bson_docs = append(bson_docs, bson.M{"key": kv[0], "value": kv[1], "docid": docid})
+// replace all k/v pairs of a unique document, keeping its uuid
+// Where the server has transactions, the old rows are swapped for the new ones
+// in a single transaction. Otherwise the new rows are written under a fresh
+// docid that nothing points to yet, then the uuid row is moved over to it in a
+// single-document update. Readers resolve the uuid to exactly one of the two
+// docids, GetDocumentUnique re-checks the resolution after reading, and the
+// other readers skip rows without a uuid, so a half-replaced document is never
+// returned
+func (p *explodedCall) replaceDocumentUnique(doc KVList, uuid string) (err error) {
+	defer p.feed.Track(p, ChangeSet, nil, uuid).Publish(&err)
+	if p.txn {
+		return p.replaceDocumentUniqueTxn(doc, uuid)
+	}
+	olddocid, err := p.docidForUUID(uuid)
+	if err != nil {
+		return err
+	}
+	newdocid := bson.NewObjectId().Hex()
+
+	rows := explodedRows(doc, newdocid)
+	if len(rows) > 0 {
+		if err := p.db_mq.C("records").Insert(rows...); err != nil {
+			return fmt.Errorf("Error inserting replacement document: %v", err)
 		}
 	}
-	err = p.db_mq.C("records").Insert(bson_docs)
+
+	err = p.db_mq.C("records").Update(bson.M{"key": "uuid", "value": uuid, "docid": olddocid}, bson.M{"$set": bson.M{"docid": newdocid}})
+	if err != nil {
+		// the document is as it was, but for the rows nothing points to
+		p.db_mq.C("records").RemoveAll(bson.M{"docid": newdocid})
+		return fmt.Errorf("Error moving uuid to replacement document: %v", err)
+	}
+	_, err = p.db_mq.C("records").RemoveAll(bson.M{"docid": olddocid})
+	if err != nil {
+		return fmt.Errorf("Error removing replaced document: %v", err)
+	}
+	return nil
+}
+
+// replace a document's rows, other than its uuid, in one transaction
+func (p *explodedCall) replaceDocumentUniqueTxn(doc KVList, uuid string) error {
+	err := runMongoTxn(p.db_mq, func(t *mongoTxn) error {
+		found, err := t.aggregate("records", []bson.M{bson.M{"$match": bson.M{"key": "uuid", "value": uuid}}})
+		if err != nil {
+			return err
+		}
+		if len(found) == 0 {
+			return fmt.Errorf("no document with uuid %s", uuid)
+		}
+		docid := found[0]["docid"].(string)
+		err = t.remove("records", []bson.M{bson.M{
+			"q":     bson.M{"docid": docid, "key": bson.M{"$ne": "uuid"}},
+			"limit": 0,
+		}})
+		if err != nil {
+			return err
+		}
+		return t.insert("records", explodedRows(doc, docid))
+	})
 	if err != nil {
-		Report.Fatal("Error inserting documents: %v", err)
+		return fmt.Errorf("Error replacing document: %v", err)
+	}
+	return nil
+}
+
+// the rows of a document under docid, leaving out its uuid
+func explodedRows(doc KVList, docid string) []interface{} {
+	rows := []interface{}{}
+	for _, kv := range doc {
+		if kv[0] == "uuid" {
+			continue
+		}
+		rows = append(rows, bson.M{"key": kv[0], "value": kv[1], "docid": docid})
 	}
+	return rows
 }
 
 // Delete Operations
 
 // delete list of keys in unique document
-func (p *ProviderMongoExploded) DeleteKeyDocumentUnique(keys []string, uuid string) {
+func (p *explodedCall) deleteKeyDocumentUnique(keys []string, uuid string) (err error) {
+	defer p.feed.Track(p, ChangeDeleteKey, nil, uuid).Publish(&err)
 	var first bson.M
-	err := p.db_mq.C("records").Find(bson.M{"key": "uuid", "value": uuid}).One(&first)
+	err = p.db_mq.C("records").Find(bson.M{"key": "uuid", "value": uuid}).One(&first)
 	if err != nil {
-		Report.Fatal("Error finding unique document for delete with uuid: %v", err)
+		return fmt.Errorf("Error finding unique document for delete with uuid: %v", err)
 	}
 
 	for _, key := range keys {
@@ -231,17 +633,18 @@ func (p *ProviderMongoExploded) DeleteKeyDocumentUnique(keys []string, uuid stri
 		}
 		_, err = p.db_mq.C("records").RemoveAll(bson.M{"docid": first["docid"].(string), "key": key})
 		if err != nil {
-			Report.Fatal("Error deleting key from document: %v", err)
+			return fmt.Errorf("Error deleting key from document: %v", err)
 		}
 	}
+	return nil
 }
 
 // delete list of keys in set of documents using where clause
-func (p *ProviderMongoExploded) DeleteKeyDocumentWhere(keys []string, where KVList) {
-	var docids []string
-	err := p.db_mq.C("records").Find(KVList2ExplodedBsonMany(where)).Distinct("docid", &docids)
+func (p *explodedCall) deleteKeyDocumentWhere(keys []string, where KVList) (err error) {
+	defer p.feed.Track(p, ChangeDeleteKey, func() ([]KVList, error) { return p.getDocumentSetWhere(where) }).Publish(&err)
+	docids, err := p.docidsWhere(where)
 	if err != nil {
-		Report.Fatal("Error selecting documents: %v", err)
+		return err
 	}
 	for _, key := range keys {
 		if key == "uuid" {
@@ -250,36 +653,296 @@ func (p *ProviderMongoExploded) DeleteKeyDocumentWhere(keys []string, where KVLi
 		for _, docid := range docids {
 			_, err := p.db_mq.C("records").RemoveAll(bson.M{"key": key, "docid": docid})
 			if err != nil {
-				Report.Fatal("Error deleting key from document: %v", err)
+				return fmt.Errorf("Error deleting key from document: %v", err)
 			}
 		}
 	}
+	return nil
 }
 
 // delete keys that match glob in unique document
-func (p *ProviderMongoExploded) DeleteKeyGlobDocumentUnique(key_glob, uuid string) {
+func (p *explodedCall) deleteKeyGlobDocumentUnique(key_glob, uuid string) (err error) {
+	keys, err := globBson(key_glob)
+	if err != nil {
+		return err
+	}
+	defer p.feed.Track(p, ChangeDeleteKey, nil, uuid).Publish(&err)
 	var first bson.M
-	err := p.db_mq.C("records").Find(bson.M{"key": "uuid", "value": uuid}).One(&first)
+	err = p.db_mq.C("records").Find(bson.M{"key": "uuid", "value": uuid}).One(&first)
 	if err != nil {
-		Report.Fatal("Error finding document for glob delete with uuid: %v", err)
+		return fmt.Errorf("Error finding document for glob delete with uuid: %v", err)
 	}
-	_, err = p.db_mq.C("records").RemoveAll(bson.M{"docid": first["docid"].(string), "key": bson.M{"$regex": key_glob}})
+	_, err = p.db_mq.C("records").RemoveAll(bson.M{"docid": first["docid"].(string), "key": keys})
 	if err != nil {
-		Report.Fatal("Error deleting key from document: %v", err)
+		return fmt.Errorf("Error deleting key from document: %v", err)
 	}
+	return nil
 }
 
 // delete keys that match glob in set of documents using where clause
-func (p *ProviderMongoExploded) DeleteKeyGlobDocumentWhere(key_glob string, where KVList) {
-	var docids []string
-	err := p.db_mq.C("records").Find(KVList2ExplodedBsonMany(where)).Distinct("docid", &docids)
+func (p *explodedCall) deleteKeyGlobDocumentWhere(key_glob string, where KVList) (err error) {
+	keys, err := globBson(key_glob)
+	if err != nil {
+		return err
+	}
+	defer p.feed.Track(p, ChangeDeleteKey, func() ([]KVList, error) { return p.getDocumentSetWhere(where) }).Publish(&err)
+	docids, err := p.docidsWhere(where)
 	if err != nil {
-		Report.Fatal("Error selecting documents: %v", err)
+		return err
 	}
 	for _, docid := range docids {
-		_, err := p.db_mq.C("records").RemoveAll(bson.M{"key": bson.M{"$regex": key_glob}, "docid": docid})
+		_, err := p.db_mq.C("records").RemoveAll(bson.M{"key": keys, "docid": docid})
+		if err != nil {
+			return fmt.Errorf("Error deleting key from document: %v", err)
+		}
+	}
+	return nil
+}
+
+// delete a unique document entirely
+// the uuid row goes first so the document is unreachable before its other rows are removed
+func (p *explodedCall) deleteDocumentUnique(uuid string) (err error) {
+	defer p.feed.Track(p, ChangeDeleteDocument, nil, uuid).Publish(&err)
+	docid, err := p.docidForUUID(uuid)
+	if err != nil {
+		return err
+	}
+	err = p.db_mq.C("records").Remove(bson.M{"key": "uuid", "docid": docid})
+	if err != nil {
+		return fmt.Errorf("Error deleting document uuid: %v", err)
+	}
+	_, err = p.db_mq.C("records").RemoveAll(bson.M{"docid": docid})
+	if err != nil {
+		return fmt.Errorf("Error deleting document: %v", err)
+	}
+	return nil
+}
+
+// delete every document matching a where clause
+func (p *explodedCall) deleteDocumentsWhere(where KVList) (err error) {
+	defer p.feed.Track(p, ChangeDeleteDocument, func() ([]KVList, error) { return p.getDocumentSetWhere(where) }).Publish(&err)
+	docids, err := p.docidsWhere(where)
+	if err != nil || len(docids) == 0 {
+		return err
+	}
+	_, err = p.db_mq.C("records").RemoveAll(bson.M{"key": "uuid", "docid": bson.M{"$in": docids}})
+	if err != nil {
+		return fmt.Errorf("Error deleting document uuids: %v", err)
+	}
+	_, err = p.db_mq.C("records").RemoveAll(bson.M{"docid": bson.M{"$in": docids}})
+	if err != nil {
+		return fmt.Errorf("Error deleting documents: %v", err)
+	}
+	return nil
+}
+
+// Batch Operations
+
+// apply every operation in the batch atomically, using a MongoDB
+// multi-document transaction. The docids for each operation are selected
+// inside the transaction, so they reflect the operations before it
+func (p *explodedCall) applyBatch(batch *MetadataBatch) (applied bool, err error) {
+	if !p.txn {
+		return false, nil
+	}
+	pipes := [][]bson.M{}
+	globs := []interface{}{}
+	for _, op := range batch.Ops {
+		pipe, err := explodedSelectPipeline(op.Select)
+		if err != nil {
+			return false, err
+		}
+		pipes = append(pipes, pipe)
+		var keys interface{}
+		if op.Kind == BatchDeleteKeyGlob {
+			if keys, err = globBson(op.KeyGlob); err != nil {
+				return false, err
+			}
+		}
+		globs = append(globs, keys)
+	}
+	defer p.feed.Track(p, batchChangeKind(batch), func() ([]KVList, error) { return batchDocuments(p, batch) }).Publish(&err)
+	err = runMongoTxn(p.db_mq, func(t *mongoTxn) error {
+		for i, op := range batch.Ops {
+			rows, err := t.aggregate("records", pipes[i])
+			if err != nil {
+				return err
+			}
+			docids := []string{}
+			for _, row := range rows {
+				docids = append(docids, row["_id"].(string))
+			}
+			if len(docids) == 0 {
+				continue
+			}
+			switch op.Kind {
+			case BatchSetKV:
+				updates := []bson.M{}
+				for _, pair := range op.KV {
+					if pair[0] == "uuid" {
+						continue
+					}
+					for _, docid := range docids {
+						updates = append(updates, bson.M{
+							"q":      bson.M{"docid": docid, "key": pair[0]},
+							"u":      bson.M{"$set": bson.M{"value": pair[1]}},
+							"upsert": true,
+						})
+					}
+				}
+				err = t.update("records", updates)
+			case BatchDeleteKeys:
+				keys := []string{}
+				for _, key := range op.Keys {
+					if key != "uuid" {
+						keys = append(keys, key)
+					}
+				}
+				err = t.remove("records", []bson.M{bson.M{
+					"q":     bson.M{"docid": bson.M{"$in": docids}, "key": bson.M{"$in": keys}},
+					"limit": 0,
+				}})
+			case BatchDeleteKeyGlob:
+				err = t.remove("records", []bson.M{bson.M{
+					"q": bson.M{"docid": bson.M{"$in": docids}, "$and": []bson.M{
+						bson.M{"key": globs[i]},
+						bson.M{"key": bson.M{"$ne": "uuid"}},
+					}},
+					"limit": 0,
+				}})
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("Error applying batch: %v", err)
+	}
+	return true, nil
+}
+
+// Subscriptions
+
+// subscribe to changes of documents matching a where clause, as made
+// through this provider. The subscription is closed when ctx is done
+func (p *ProviderMongoExploded) Subscribe(ctx context.Context, where KVList) *Subscription {
+	return p.feed.Subscribe(ctx, where)
+}
+
+//== IndexManager
+
+// create an index on the given keys, unless it exists already
+func (p *explodedCall) ensureIndex(keys ...string) error {
+	if err := p.db_mq.C("records").EnsureIndex(mgo.Index{Key: keys}); err != nil {
+		return fmt.Errorf("Error creating index on %v: %v", keys, err)
+	}
+	return nil
+}
+
+// drop the index on exactly the given keys
+func (p *explodedCall) dropIndex(keys ...string) error {
+	if err := p.db_mq.C("records").DropIndex(keys...); err != nil {
+		return fmt.Errorf("Error dropping index on %v: %v", keys, err)
+	}
+	return nil
+}
+
+// list the keys of every index that can be dropped, which is all but _id
+func (p *explodedCall) listIndexes() ([][]string, error) {
+	indexes, err := p.db_mq.C("records").Indexes()
+	if err != nil {
+		return nil, fmt.Errorf("Error listing indexes: %v", err)
+	}
+	ret := [][]string{}
+	for _, index := range indexes {
+		if len(index.Key) == 1 && index.Key[0] == "_id" {
+			continue
+		}
+		ret = append(ret, index.Key)
+	}
+	return ret, nil
+}
+
+//== QueryExplainer
+
+// explain the query an operation selects its rows with. Documents named by
+// uuid are found through their uuid row, and every other selection runs the
+// docid pipeline
+func (p *explodedCall) explain(q Query) (*QueryPlan, error) {
+	if sel, ok := q.selector(); ok {
+		if q.UUID != "" {
+			return mongoExplain(p.db_mq, explainFind("records", bson.M{"key": "uuid", "value": q.UUID}))
+		}
+		pipe, err := explodedSelectPipeline(sel)
 		if err != nil {
-			Report.Fatal("Error deleting key from document: %v", err)
+			return nil, err
 		}
+		if q.Op == "ExistsWhere" {
+			pipe = append(pipe, bson.M{"$limit": 1})
+		}
+		return mongoExplain(p.db_mq, explainAggregate("records", pipe))
+	}
+	switch q.Op {
+	case "GetUniqueValues":
+		return mongoExplain(p.db_mq, explainDistinct("records", "value", bson.M{"key": q.Key}))
+	case "GetKeyGlob":
+		keys, err := globBson(q.KeyGlob)
+		if err != nil {
+			return nil, err
+		}
+		return mongoExplain(p.db_mq, explainFind("records", bson.M{"key": keys}))
+	case "GetUniqueValueCounts":
+		return mongoExplain(p.db_mq, explainAggregate("records", explodedUniqueValueCountsPipeline(q.Key)))
+	}
+	return nil, nil
+}
+
+//== DocumentScanner
+
+// call fn with every document with a docid after *after, in docid order, and
+// note the docid of each document fn is called with in *after, so that a retry
+// carries on where the scan broke off. The rows of a document are adjacent in
+// docid order, and are collected until the docid changes. As in
+// documentsForDocids, docids without a uuid row are left out.
+// Replacing a document outside a transaction moves it to a new docid, which
+// sorts after every docid before it, so a document replaced during the scan
+// can come up twice. The uuids fn has been called with are kept in emitted,
+// and a document with one of them is skipped
+func (p *explodedCall) scanDocuments(after *string, emitted map[string]bool, fn func(doc KVList) error) error {
+	it := p.db_mq.C("records").Find(bson.M{"docid": bson.M{"$gt": *after}}).Sort("docid").Iter()
+	var rows []bson.M
+	docid := ""
+	emit := func() error {
+		if len(rows) == 0 {
+			return nil
+		}
+		doc := ExplodedBson2KVList(rows)
+		rows = nil
+		if id, found := doc.Get("uuid"); found && !emitted[id] {
+			if err := fn(doc); err != nil {
+				return err
+			}
+			emitted[id] = true
+		}
+		*after = docid
+		return nil
+	}
+	row := bson.M{}
+	for it.Next(&row) {
+		if d := row["docid"].(string); d != docid {
+			if err := emit(); err != nil {
+				it.Close()
+				return err
+			}
+			docid = d
+		}
+		rows = append(rows, row)
+		row = bson.M{}
+	}
+	if err := it.Close(); err != nil {
+		return fmt.Errorf("Error scanning documents: %v", err)
 	}
+	return emit()
 }
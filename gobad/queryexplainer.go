@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+)
+
+// A QueryExplainer can say how a provider answers a query: which index it
+// used, if any, and how much it had to read. Operations that go to the store
+// several times are explained by the query that selects their documents
+type QueryExplainer interface {
+
+	// explain the query behind a MetadataQuery operation, or return nil if
+	// the provider has no plan to show for it
+	Explain(ctx context.Context, q Query) (*QueryPlan, error)
+}
+
+// a MetadataQuery operation to explain, named by its method. Only the
+// arguments the operation takes need to be set
+type Query struct {
+	Op        string
+	UUID      string
+	Where     KVList
+	Key       string
+	ValueGlob string
+	KeyGlob   string
+}
+
+type QueryPlan struct {
+	// index entries and documents (or rows) the store read
+	KeysExamined int `json:"keysexamined"`
+	DocsExamined int `json:"docsexamined"`
+	// the indexes used, comma separated. Empty for a full scan
+	Index string `json:"index"`
+}
+
+// the documents the operation reads or writes, for operations that select
+// them by uuid, where clause or value glob
+func (q Query) selector() (BatchSelector, bool) {
+	switch q.Op {
+	case "GetDocumentUnique", "SetKVDocumentUnique", "ReplaceDocumentUnique",
+		"DeleteKeyDocumentUnique", "DeleteKeyGlobDocumentUnique", "DeleteDocumentUnique":
+		return whereUUID(q.UUID), true
+	case "GetDocumentSetWhere", "CountWhere", "ExistsWhere", "SetKVDocumentWhere",
+		"DeleteKeyDocumentWhere", "DeleteKeyGlobDocumentWhere", "DeleteDocumentsWhere":
+		return BatchSelector{Where: q.Where}, true
+	case "GetDocumentSetValueGlob", "CountValueGlob", "SetKVDocumentValueGlob":
+		return BatchSelector{Key: q.Key, ValueGlob: q.ValueGlob}, true
+	}
+	return BatchSelector{}, false
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// gobad report: renders a result, as written by the json or jsonl sinks, as a
+// single HTML file with the charts drawn as inline SVG, so it can be opened or
+// mailed around with nothing else. For every phase it draws the median time of
+// each provider and how the times spread over the iterations, then the calls
+// per second of each provider over the iterations, and a table of every metric
+
+// whether a metric is the time a phase took, rather than a count or a stat of
+// the instruments, faults or cache
+func phaseMetric(id string) bool {
+	return !strings.Contains(id, ".") && !strings.HasPrefix(id, "Cache")
+}
+
+// the values of one provider's metric over the iterations
+type reportSeries struct {
+	Provider string
+	Values   []float64
+}
+
+type reportRow struct {
+	Provider, Id                          string
+	N                                     int
+	Min, P25, Median, Mean, P75, P95, Max float64
+}
+
+type reportPhase struct {
+	Id     string
+	Bars   template.HTML
+	Spread template.HTML
+}
+
+type reportPage struct {
+	Title      string
+	Report     *Reporter
+	Phases     []reportPhase
+	Throughput template.HTML
+	Rows       []reportRow
+}
+
+// the metrics of a result by id and then provider, each in iteration order,
+// with the providers and ids in the order they first appear
+func reportSeriesById(r *Reporter) (ids []string, providers []string, series map[string][]reportSeries) {
+	type point struct {
+		it int
+		v  float64
+	}
+	byKey := map[seriesKey][]point{}
+	seenId, seenProvider := map[string]bool{}, map[string]bool{}
+	for _, p := range r.VAL_Metrics {
+		if !seenId[p.Id] {
+			seenId[p.Id] = true
+			ids = append(ids, p.Id)
+		}
+		if !seenProvider[p.Provider] {
+			seenProvider[p.Provider] = true
+			providers = append(providers, p.Provider)
+		}
+		k := seriesKey{p.Provider, p.Id}
+		byKey[k] = append(byKey[k], point{p.Iteration, p.Value})
+	}
+	series = map[string][]reportSeries{}
+	for _, id := range ids {
+		for _, provider := range providers {
+			points, found := byKey[seriesKey{provider, id}]
+			if !found {
+				continue
+			}
+			sort.SliceStable(points, func(i, j int) bool { return points[i].it < points[j].it })
+			s := reportSeries{Provider: provider}
+			for _, p := range points {
+				s.Values = append(s.Values, p.v)
+			}
+			series[id] = append(series[id], s)
+		}
+	}
+	return
+}
+
+// calls made through the instruments per second of phase time, for every
+// provider and iteration. Providers that weren't instrumented are left out
+func reportThroughput(r *Reporter) map[string]map[int]float64 {
+	calls := map[string]map[int]float64{}
+	busy := map[string]map[int]float64{}
+	add := func(m map[string]map[int]float64, p BPoint) {
+		if m[p.Provider] == nil {
+			m[p.Provider] = map[int]float64{}
+		}
+		m[p.Provider][p.Iteration] += p.Value
+	}
+	for _, p := range r.VAL_Metrics {
+		switch {
+		case strings.HasSuffix(p.Id, ".Calls"):
+			add(calls, p)
+		case phaseMetric(p.Id):
+			add(busy, p)
+		}
+	}
+	ret := map[string]map[int]float64{}
+	for provider, its := range calls {
+		for it, n := range its {
+			if us := busy[provider][it]; us > 0 {
+				if ret[provider] == nil {
+					ret[provider] = map[int]float64{}
+				}
+				ret[provider][it] = n / us * 1e6
+			}
+		}
+	}
+	return ret
+}
+
+func buildReportPage(r *Reporter, title string) reportPage {
+	page := reportPage{Title: title, Report: r}
+	ids, providers, series := reportSeriesById(r)
+	for _, id := range ids {
+		for _, s := range series[id] {
+			page.Rows = append(page.Rows, reportRow{
+				Provider: s.Provider, Id: id, N: len(s.Values),
+				Min: quantile(s.Values, 0), P25: quantile(s.Values, 0.25), Median: median(s.Values),
+				Mean: mean(s.Values), P75: quantile(s.Values, 0.75), P95: quantile(s.Values, 0.95),
+				Max: quantile(s.Values, 1),
+			})
+		}
+		if !phaseMetric(id) {
+			continue
+		}
+		page.Phases = append(page.Phases, reportPhase{
+			Id:     id,
+			Bars:   svgBarChart(series[id]),
+			Spread: svgBoxPlot(series[id]),
+		})
+	}
+	if tp := reportThroughput(r); len(tp) > 0 {
+		lines := []reportSeries{}
+		for _, provider := range providers {
+			its, found := tp[provider]
+			if !found {
+				continue
+			}
+			lines = append(lines, reportSeries{Provider: provider, Values: byIteration(its)})
+		}
+		page.Throughput = svgLineChart(lines)
+	}
+	return page
+}
+
+// the values of a map by iteration, in iteration order, with NaN for the
+// iterations in between that have none
+func byIteration(its map[int]float64) []float64 {
+	last := -1
+	for it := range its {
+		if it > last {
+			last = it
+		}
+	}
+	ret := make([]float64, last+1)
+	for i := range ret {
+		v, found := its[i]
+		if !found {
+			v = math.NaN()
+		}
+		ret[i] = v
+	}
+	return ret
+}
+
+//== SVG
+
+const (
+	svgWidth  = 640
+	svgLabels = 220 // width of the provider names left of a chart
+	svgRow    = 20
+	svgPad    = 6
+)
+
+// colours for the providers, in order, repeating past the last
+var svgPalette = []string{"#4e79a7", "#f28e2b", "#e15759", "#76b7b2", "#59a14f", "#edc948", "#b07aa1", "#ff9da7", "#9c755f", "#bab0ac"}
+
+func svgColour(i int) string {
+	return svgPalette[i%len(svgPalette)]
+}
+
+func svgNumber(v float64) string {
+	return fmt.Sprintf("%.4g", v)
+}
+
+// the biggest value to scale a chart to, so that an empty or all-zero chart
+// still has a scale
+func svgScale(values ...[]float64) float64 {
+	max := 0.0
+	for _, vs := range values {
+		for _, v := range vs {
+			if !math.IsNaN(v) && v > max {
+				max = v
+			}
+		}
+	}
+	if max == 0 {
+		return 1
+	}
+	return max
+}
+
+func svgOpen(b *strings.Builder, height int) {
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`,
+		svgWidth, height, svgWidth, height)
+}
+
+func svgLabel(b *strings.Builder, x, y int, anchor, text string) {
+	fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="%s">%s</text>`, x, y, anchor, template.HTMLEscapeString(text))
+}
+
+// a horizontal bar for the median of every provider
+func svgBarChart(series []reportSeries) template.HTML {
+	medians := make([]float64, len(series))
+	for i, s := range series {
+		medians[i] = median(s.Values)
+	}
+	max := svgScale(medians)
+	plot := float64(svgWidth - svgLabels - 60)
+	b := &strings.Builder{}
+	svgOpen(b, len(series)*svgRow+svgPad)
+	for i, s := range series {
+		y := i*svgRow + svgPad
+		w := medians[i] / max * plot
+		svgLabel(b, svgLabels-svgPad, y+svgRow/2+4, "end", s.Provider)
+		fmt.Fprintf(b, `<rect x="%d" y="%d" width="%.1f" height="%d" fill="%s"><title>%s</title></rect>`,
+			svgLabels, y+2, w, svgRow-4, svgColour(i), template.HTMLEscapeString(s.Provider+": "+svgNumber(medians[i])))
+		svgLabel(b, svgLabels+int(w)+svgPad, y+svgRow/2+4, "start", svgNumber(medians[i]))
+	}
+	b.WriteString("</svg>")
+	return template.HTML(b.String())
+}
+
+// a box plot of every provider's values: whiskers from the smallest to the
+// biggest, the box from the first to the third quartile, and the median
+func svgBoxPlot(series []reportSeries) template.HTML {
+	all := make([][]float64, len(series))
+	for i, s := range series {
+		all[i] = s.Values
+	}
+	max := svgScale(all...)
+	plot := float64(svgWidth - svgLabels - 60)
+	x := func(v float64) float64 { return float64(svgLabels) + v/max*plot }
+	b := &strings.Builder{}
+	svgOpen(b, len(series)*svgRow+svgPad+svgRow)
+	for i, s := range series {
+		y := float64(i*svgRow + svgPad)
+		mid := y + svgRow/2
+		lo, q1, med, q3, hi := quantile(s.Values, 0), quantile(s.Values, 0.25), median(s.Values), quantile(s.Values, 0.75), quantile(s.Values, 1)
+		svgLabel(b, svgLabels-svgPad, int(mid)+4, "end", s.Provider)
+		fmt.Fprintf(b, `<g stroke="%s"><title>%s</title>`, svgColour(i),
+			template.HTMLEscapeString(fmt.Sprintf("%s: min %s, q1 %s, median %s, q3 %s, max %s",
+				s.Provider, svgNumber(lo), svgNumber(q1), svgNumber(med), svgNumber(q3), svgNumber(hi))))
+		fmt.Fprintf(b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f"/>`, x(lo), mid, x(hi), mid)
+		fmt.Fprintf(b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f"/>`, x(lo), y+5, x(lo), y+svgRow-5)
+		fmt.Fprintf(b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f"/>`, x(hi), y+5, x(hi), y+svgRow-5)
+		fmt.Fprintf(b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%d" fill="%s" fill-opacity="0.35"/>`,
+			x(q1), y+2, x(q3)-x(q1), svgRow-4, svgColour(i))
+		fmt.Fprintf(b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke-width="2"/>`, x(med), y+2, x(med), y+svgRow-2)
+		b.WriteString("</g>")
+	}
+	axis := len(series)*svgRow + svgPad + svgRow/2 + 4
+	svgLabel(b, svgLabels, axis, "start", "0")
+	svgLabel(b, svgLabels+int(plot), axis, "end", svgNumber(max))
+	b.WriteString("</svg>")
+	return template.HTML(b.String())
+}
+
+// a line for every provider's values over the iterations, with a legend
+func svgLineChart(series []reportSeries) template.HTML {
+	const height, left, bottom = 260, 60, 24
+	all := make([][]float64, len(series))
+	iterations := 1
+	for i, s := range series {
+		all[i] = s.Values
+		if len(s.Values) > iterations {
+			iterations = len(s.Values)
+		}
+	}
+	max := svgScale(all...)
+	plotW, plotH := float64(svgWidth-left-svgPad), float64(height-bottom-svgPad)
+	x := func(it int) float64 {
+		if iterations == 1 {
+			return left + plotW/2
+		}
+		return left + float64(it)/float64(iterations-1)*plotW
+	}
+	y := func(v float64) float64 { return svgPad + plotH - v/max*plotH }
+	b := &strings.Builder{}
+	svgOpen(b, height+len(series)*svgRow)
+	fmt.Fprintf(b, `<line x1="%d" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#888"/>`, left, y(0), left+plotW, y(0))
+	fmt.Fprintf(b, `<line x1="%d" y1="%d" x2="%d" y2="%.1f" stroke="#888"/>`, left, svgPad, left, y(0))
+	svgLabel(b, left-svgPad, int(y(max))+8, "end", svgNumber(max))
+	svgLabel(b, left-svgPad, int(y(0)), "end", "0")
+	svgLabel(b, left, int(y(0))+14, "start", "iteration 0")
+	svgLabel(b, int(left+plotW), int(y(0))+14, "end", fmt.Sprintf("iteration %d", iterations-1))
+	for i, s := range series {
+		// break the line where an iteration has no value
+		points := []string{}
+		flush := func() {
+			if len(points) > 0 {
+				fmt.Fprintf(b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="1.5"/>`, strings.Join(points, " "), svgColour(i))
+				points = points[:0]
+			}
+		}
+		for it, v := range s.Values {
+			if math.IsNaN(v) {
+				flush()
+				continue
+			}
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x(it), y(v)))
+			fmt.Fprintf(b, `<circle cx="%.1f" cy="%.1f" r="2" fill="%s"><title>%s</title></circle>`, x(it), y(v), svgColour(i),
+				template.HTMLEscapeString(fmt.Sprintf("%s, iteration %d: %s", s.Provider, it, svgNumber(v))))
+		}
+		flush()
+		ly := height + i*svgRow
+		fmt.Fprintf(b, `<rect x="%d" y="%d" width="12" height="12" fill="%s"/>`, left, ly, svgColour(i))
+		svgLabel(b, left+18, ly+10, "start", s.Provider)
+	}
+	b.WriteString("</svg>")
+	return template.HTML(b.String())
+}
+
+//== HTML
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"num": svgNumber,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h2 { border-bottom: 1px solid #ccc; padding-bottom: .2em; }
+.phase { display: flex; flex-wrap: wrap; gap: 1em; margin-bottom: 1.5em; }
+.phase h4 { margin: .2em 0; font-weight: normal; color: #555; }
+table { border-collapse: collapse; font-size: 12px; }
+th, td { padding: 2px 8px; border-bottom: 1px solid #eee; text-align: right; }
+th:nth-child(-n+2), td:nth-child(-n+2) { text-align: left; }
+.failed { color: #b00; font-weight: bold; }
+dt { float: left; clear: left; width: 9em; color: #555; }
+dd { margin-left: 10em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{with .Report}}
+{{if not .VAL_Ok}}<p class="failed">The run failed: {{.VAL_FatalMsg}}</p>{{end}}
+<dl>
+<dt>Revision</dt><dd>{{or .VAL_Run.GitRevision "unknown"}}</dd>
+<dt>Seed</dt><dd>{{.VAL_Run.Seed}}</dd>
+<dt>Factor</dt><dd>{{.VAL_Run.Factor}}</dd>
+<dt>Host</dt><dd>{{.VAL_Run.Hostname}} ({{.VAL_Run.OS}}/{{.VAL_Run.Arch}}, {{.VAL_Run.CPUCores}} × {{.VAL_Run.CPUModel}}, GOMAXPROCS {{.VAL_Run.GOMAXPROCS}})</dd>
+<dt>Go</dt><dd>{{.VAL_Run.GoVersion}}</dd>
+{{range $name, $info := .VAL_Providers}}<dt>{{$name}}</dt><dd>{{$info.Server}}</dd>
+{{end}}</dl>
+{{end}}
+
+<h2>Phases</h2>
+<p>Time each phase took, in microseconds: the median over the iterations, and how the iterations spread.</p>
+{{range .Phases}}
+<h3>{{.Id}}</h3>
+<div class="phase">
+<div><h4>median</h4>{{.Bars}}</div>
+<div><h4>spread over iterations</h4>{{.Spread}}</div>
+</div>
+{{end}}
+
+{{with .Report.VAL_Steady}}
+<h2>Cold start and steady state</h2>
+<p>The time of each phase's first iteration, and its median from the iteration where it settled. Outliers are steady iterations much slower than the median, caused by GC pauses or by the host.</p>
+<table>
+<tr><th>provider</th><th>id</th><th>cold start</th><th>steady from</th><th>steady</th><th>outliers</th></tr>
+{{range .}}<tr><td>{{.Provider}}</td><td>{{.Id}}</td><td>{{num .ColdStart}}</td><td>{{.SteadyFrom}}</td><td>{{num .Steady}}</td><td>{{range $i, $o := .Outliers}}{{if $i}}, {{end}}#{{$o.Iteration}} {{$o.Cause}}{{end}}</td></tr>
+{{end}}</table>
+{{end}}
+
+{{if .Throughput}}
+<h2>Throughput</h2>
+<p>Calls to the provider per second of phase time, in every iteration.</p>
+{{.Throughput}}
+{{end}}
+
+<h2>Summary</h2>
+<table>
+<tr><th>provider</th><th>id</th><th>n</th><th>min</th><th>p25</th><th>median</th><th>mean</th><th>p75</th><th>p95</th><th>max</th></tr>
+{{range .Rows}}<tr><td>{{.Provider}}</td><td>{{.Id}}</td><td>{{.N}}</td><td>{{num .Min}}</td><td>{{num .P25}}</td><td>{{num .Median}}</td><td>{{num .Mean}}</td><td>{{num .P75}}</td><td>{{num .P95}}</td><td>{{num .Max}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// render a result as a self-contained HTML page
+func WriteHTMLReport(r *Reporter, title string, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Could not create report: %v", err)
+	}
+	if err := reportTemplate.Execute(f, buildReportPage(r, title)); err != nil {
+		f.Close()
+		return fmt.Errorf("Could not render report: %v", err)
+	}
+	return f.Close()
+}
+
+// run gobad report with the arguments after "report", returning the exit status
+func reportMain(args []string) int {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	out := fs.String("out", "report.html", "HTML file to write")
+	title := fs.String("title", "", "title of the report (default the result file's name)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: gobad report [flags] result.json\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	r, err := LoadReport(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *title == "" {
+		*title = "gobad: " + fs.Arg(0)
+	}
+	if err := WriteHTMLReport(r, *title, *out); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("wrote %s\n", *out)
+	return 0
+}
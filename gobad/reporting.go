@@ -1,10 +1,10 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"runtime"
 	"time"
 )
 
@@ -13,6 +13,8 @@ type BPoint struct {
 	Provider  string  `json:"provider"`
 	Iteration int     `json:"iteration"`
 	Value     float64 `json:"value"`
+	// how the provider ran a sample query of the operation, if it could say
+	Plan *QueryPlan `json:"plan,omitempty"`
 }
 type Reporter struct {
 	VAL_Ok       bool     `json:"ok"`
@@ -20,6 +22,23 @@ type Reporter struct {
 	VAL_Metrics  []BPoint `json:"metrics"`
 	VAL_Start    int64    `json:"starttime"`
 	VAL_End      int64    `json:"endtime"`
+	// what was run where, and the setup of each provider by reported name
+	VAL_Run       RunInfo                 `json:"run"`
+	VAL_Providers map[string]ProviderInfo `json:"providers"`
+	// how each phase's time grew with the dataset, if sizes were swept
+	VAL_Scaling []ScalingFit `json:"scaling,omitempty"`
+	// cold-start and steady-state times of each phase, with outliers
+	VAL_Steady []SteadyState `json:"steady,omitempty"`
+
+	// where the results go. WriteOut writes benchmarkresult.json if none
+	// were added
+	sinks []Sink
+	// how many of VAL_Metrics have been streamed to the sinks
+	flushed int
+	// the GC pause total when the last timer started, and the microseconds
+	// of GC pause during each timed metric that had any, by index in VAL_Metrics
+	gcPause uint64
+	pauses  map[int]float64
 }
 
 type Measurement time.Time
@@ -42,29 +61,127 @@ func (r *Reporter) Fatal(format string, args ...interface{}) {
 	os.Exit(1)
 }
 
+// stop the run with Fatal if a call failed. Calls failed by fault injection
+// are let through, since the injector counts them in its Faults metrics, and
+// the run is there to see how the workload copes with them
+func (r *Reporter) Check(err error) {
+	if err == ErrInjectedFault || err == ErrInjectedTimeout {
+		return
+	}
+	if err != nil {
+		r.Fatal("%v", err)
+	}
+}
+
+// send results to a sink as well as any added before
+func (r *Reporter) AddSink(s Sink) {
+	r.sinks = append(r.sinks, s)
+}
+
+// stream the metrics recorded since the last Flush to the sinks. A sink that
+// fails is logged and dropped, so the run goes on
+func (r *Reporter) Flush() {
+	points := r.VAL_Metrics[r.flushed:]
+	if len(points) == 0 {
+		return
+	}
+	r.flushed = len(r.VAL_Metrics)
+	sinks := r.sinks[:0]
+	for _, s := range r.sinks {
+		if err := s.WriteMetrics(points); err != nil {
+			log.Printf("Could not write metrics, dropping sink: %v", err)
+			s.Close(r)
+			continue
+		}
+		sinks = append(sinks, s)
+	}
+	r.sinks = sinks
+}
+
 func (r *Reporter) Metric(provider string, id string, iteration int, value float64) {
 	r.VAL_Metrics = append(r.VAL_Metrics, BPoint{Id: id, Provider: provider, Iteration: iteration, Value: value})
 }
 
 func (r *Reporter) DeltaMetric(provider string, id string, iteration int, start time.Time) {
 	r.Metric(provider, id, iteration, r.FinishTimer(start))
+	r.notePause()
+}
+
+// record a phase's time as the time its calls spent in the provider, from the
+// instruments the phase's calls went through
+func (r *Reporter) PhaseMetric(provider string, id string, iteration int, start PhaseTimer) {
+	r.Metric(provider, id, iteration, start.in.Elapsed()-start.elapsed)
+	r.notePause()
 }
 
+// note the GC pause since the timer started against the latest metric
+func (r *Reporter) notePause() {
+	if pause := gcPauseTotal() - r.gcPause; pause > 0 {
+		if r.pauses == nil {
+			r.pauses = map[int]float64{}
+		}
+		r.pauses[len(r.VAL_Metrics)-1] = float64(pause) / float64(time.Microsecond)
+	}
+}
+
+// the time this process has spent paused for GC, in nanoseconds
+func gcPauseTotal() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.PauseTotalNs
+}
+
+// attach a query plan to the latest metric with the given provider, id and iteration
+func (r *Reporter) AttachPlan(provider string, id string, iteration int, plan QueryPlan) {
+	for i := len(r.VAL_Metrics) - 1; i >= 0; i-- {
+		m := &r.VAL_Metrics[i]
+		if m.Provider == provider && m.Id == id && m.Iteration == iteration {
+			m.Plan = &plan
+			return
+		}
+	}
+}
+
+// stream the last metrics and close every sink with the final report
 func (r *Reporter) WriteOut() {
-	Report.VAL_End = time.Now().Unix()
-	f, err := os.Create("benchmarkresult.json")
-	if err != nil {
-		log.Panicf("Could not create result file")
+	r.VAL_End = time.Now().Unix()
+	if len(r.sinks) == 0 {
+		r.AddSink(NewJSONSink(SinkFormats["json"], r))
 	}
-	enc := json.NewEncoder(f)
-	enc.Encode(r)
-	f.Close()
+	r.Flush()
+	for _, s := range r.sinks {
+		if err := s.Close(r); err != nil {
+			log.Printf("Could not write results: %v", err)
+		}
+	}
+	r.sinks = nil
 }
 
+// start timing a phase. The metrics of the phases before are finished by now,
+// query plans and all, so they are streamed to the sinks first. GC pauses are
+// counted from here, outside the timed section, as ReadMemStats stops the world
 func (r *Reporter) StartTimer() time.Time {
+	r.Flush()
+	r.gcPause = gcPauseTotal()
 	return time.Now()
 }
 
+// a phase being timed by its calls, from StartPhase
+type PhaseTimer struct {
+	in      *Instruments
+	elapsed float64
+}
+
+// start timing a phase by the time its calls spend in the provider, as in
+// records them, which leaves out the workload's own work between calls and
+// the instruments' bookkeeping. Metrics are streamed and GC pauses counted as
+// for StartTimer
+func (r *Reporter) StartPhase(in *Instruments) PhaseTimer {
+	r.Flush()
+	r.gcPause = gcPauseTotal()
+	return PhaseTimer{in: in, elapsed: in.Elapsed()}
+}
+
 func (r *Reporter) FinishTimer(t time.Time) float64 {
 	return float64(time.Now().Sub(t)) / float64(time.Microsecond)
 }
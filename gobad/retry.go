@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// mgo takes no contexts, so a provider can't cancel a query it has sent. It
+// gives up on it instead: the call returns the context's error as soon as the
+// context is done, and the query runs on in the background until it finishes
+// or the session's socket timeout ends it
+
+// A RetryPolicy says how a provider retries calls that failed with a transient
+// error, such as a connection reset, with exponential backoff between tries.
+// The zero policy tries every call once
+type RetryPolicy struct {
+	// how many times a call is tried in all. 0 and 1 both mean once
+	Attempts int
+
+	// the wait before the first retry, doubled after every retry up to
+	// MaxBackoff. A MaxBackoff of 0 lets it grow without limit
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// retry writes as well as reads. A write that failed with a transient
+	// error may still have been applied, so retrying it may apply it twice,
+	// or fail where the first try succeeded
+	Writes bool
+}
+
+// parts of the messages of the errors mgo returns when a connection failed
+// rather than the operation. Providers wrap errors in messages of their own,
+// so these are looked for anywhere in the error
+var transientErrors = []string{
+	"EOF",
+	"connection reset",
+	"broken pipe",
+	"i/o timeout",
+	"no reachable servers",
+}
+
+func isTransient(err error) bool {
+	msg := err.Error()
+	for _, t := range transientErrors {
+		if strings.Contains(msg, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// make a call under ctx, retrying it as the policy says
+func (rp RetryPolicy) do(ctx context.Context, write bool, call func() (interface{}, error)) (interface{}, error) {
+	return rp.retry(ctx, write, func() (interface{}, error) { return withContext(ctx, call) })
+}
+
+// make a call, retrying it as the policy says while ctx is live. Unlike do,
+// each try runs on the caller's goroutine and is waited for, so it has to
+// heed ctx's deadline itself
+func (rp RetryPolicy) retry(ctx context.Context, write bool, call func() (interface{}, error)) (interface{}, error) {
+	wait := rp.waits()
+	for attempt := 1; ; attempt++ {
+		r, err := call()
+		if err == nil || attempt >= rp.Attempts || (write && !rp.Writes) || ctx.Err() != nil || !isTransient(err) {
+			return r, err
+		}
+		if err := wait.next(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// the backoff between the tries of one call
+type retryWait struct {
+	backoff, max time.Duration
+}
+
+func (rp RetryPolicy) waits() *retryWait {
+	return &retryWait{backoff: rp.Backoff, max: rp.MaxBackoff}
+}
+
+// sleep until the next try, or until ctx is done, in which case its error is
+// returned
+func (w *retryWait) next(ctx context.Context) error {
+	if err := sleepContext(ctx, w.backoff); err != nil {
+		return err
+	}
+	w.backoff *= 2
+	if w.max > 0 && w.backoff > w.max {
+		w.backoff = w.max
+	}
+	return nil
+}
+
+// make a call, unless ctx is done first. If ctx is done while the call is
+// running, its error is returned at once and the call's results are dropped
+// when it finishes. The call goes on running until then, so it has to stop
+// on its own near the deadline, as the Mongo providers' socket timeouts do
+func withContext(ctx context.Context, call func() (interface{}, error)) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() == nil {
+		return call()
+	}
+	type result struct {
+		r   interface{}
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		r, err := call()
+		done <- result{r, err}
+	}()
+	select {
+	case res := <-done:
+		return res.r, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// sleep for d, or until ctx is done, in which case its error is returned
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
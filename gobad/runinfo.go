@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// What a run was and where it ran, recorded with its results so that results
+// can be reproduced, and results from different machines told apart
+type RunInfo struct {
+	// the seed the workload was generated from; -seed replays the run
+	Seed   int64 `json:"seed"`
+	Factor int   `json:"factor"`
+
+	// the commit the benchmark was built from, with "+dirty" appended if the
+	// tree had uncommitted changes. Empty if it can't be found
+	GitRevision string `json:"gitrevision"`
+	GoVersion   string `json:"goversion"`
+
+	Hostname   string `json:"hostname"`
+	OS         string `json:"os"`
+	Arch       string `json:"arch"`
+	GOMAXPROCS int    `json:"gomaxprocs"`
+	CPUModel   string `json:"cpumodel"`
+	CPUCores   int    `json:"cpucores"`
+	// total physical memory, 0 if it can't be found
+	MemoryBytes uint64 `json:"memorybytes"`
+
+	Workload WorkloadSpec `json:"workload"`
+}
+
+// A provider that can say how it is configured and what it runs against, for
+// the record of a run
+type ProviderDescriber interface {
+	Describe(ctx context.Context) (ProviderInfo, error)
+}
+
+type ProviderInfo struct {
+	// the backend and its version, such as "MongoDB 4.2.1"
+	Server string `json:"server"`
+	// the provider's settings, with any credentials removed
+	Config interface{} `json:"config"`
+}
+
+// gather the RunInfo of this process
+func CollectRunInfo(seed int64, workload WorkloadSpec) RunInfo {
+	info := RunInfo{
+		Seed:        seed,
+		Factor:      FACTOR,
+		GitRevision: gitRevision(),
+		GoVersion:   runtime.Version(),
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		GOMAXPROCS:  runtime.GOMAXPROCS(0),
+		CPUModel:    cpuModel(),
+		CPUCores:    runtime.NumCPU(),
+		MemoryBytes: memoryBytes(),
+		Workload:    workload,
+	}
+	info.Hostname, _ = os.Hostname()
+	return info
+}
+
+// the revision the binary was built from, as the go tool stamped it, or else
+// the revision checked out where the benchmark runs
+func gitRevision() string {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		rev, dirty := "", false
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				rev = s.Value
+			case "vcs.modified":
+				dirty = s.Value == "true"
+			}
+		}
+		if rev != "" {
+			if dirty {
+				rev += "+dirty"
+			}
+			return rev
+		}
+	}
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	rev := strings.TrimSpace(string(out))
+	if err := exec.Command("git", "diff", "--quiet", "HEAD").Run(); err != nil {
+		rev += "+dirty"
+	}
+	return rev
+}
+
+// the value of the first line of a /proc file with the given field name, as
+// in /proc/cpuinfo and /proc/meminfo. Empty where there is no /proc
+func procField(path, field string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		parts := strings.SplitN(sc.Text(), ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == field {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+	return ""
+}
+
+func cpuModel() string {
+	return procField("/proc/cpuinfo", "model name")
+}
+
+func memoryBytes() uint64 {
+	// "MemTotal: 16318928 kB"
+	fields := strings.Fields(procField("/proc/meminfo", "MemTotal"))
+	if len(fields) == 0 {
+		return 0
+	}
+	kb, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return kb * 1024
+}
+
+// record the description of a provider under the name it is reported as, if
+// it can describe itself and hasn't been recorded already
+func describeProvider(ctx context.Context, mq MetadataQuery, provider string) {
+	if _, seen := Report.VAL_Providers[provider]; seen {
+		return
+	}
+	pd, ok := baseProvider(mq).(ProviderDescriber)
+	if !ok {
+		return
+	}
+	info, err := pd.Describe(ctx)
+	Report.Check(err)
+	if Report.VAL_Providers == nil {
+		Report.VAL_Providers = map[string]ProviderInfo{}
+	}
+	Report.VAL_Providers[provider] = info
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// How the time of a phase grows with the dataset, from a sweep over dataset
+// sizes. Every phase makes the same number of calls at every size, so the
+// trend of its time is the trend of the cost of one call
+type ScalingFit struct {
+	Provider string `json:"provider"`
+	Id       string `json:"id"`
+	// the dataset sizes, ascending, and the median time of the phase over the
+	// iterations at each
+	Sizes   []int     `json:"sizes"`
+	Medians []float64 `json:"medians"`
+	// k of the power law time = c n^k that fits best, on a log-log scale
+	Exponent float64 `json:"exponent"`
+	// the complexity class that fits best, such as "O(n log n)"
+	Model string `json:"model"`
+}
+
+// the complexity classes a phase is fitted to, each as time = a + b f(n)
+var complexityModels = []struct {
+	Name string
+	f    func(n float64) float64
+}{
+	{"O(log n)", math.Log},
+	{"O(n)", func(n float64) float64 { return n }},
+	{"O(n log n)", func(n float64) float64 { return n * math.Log(n) }},
+	{"O(n^2)", func(n float64) float64 { return n * n }},
+}
+
+// the intercept and slope of the least squares line through (xs, ys), and
+// the sum of its squared residuals
+func leastSquares(xs, ys []float64) (a, b, sse float64) {
+	mx, my := mean(xs), mean(ys)
+	sxy, sxx := 0.0, 0.0
+	for i := range xs {
+		sxy += (xs[i] - mx) * (ys[i] - my)
+		sxx += (xs[i] - mx) * (xs[i] - mx)
+	}
+	if sxx > 0 {
+		b = sxy / sxx
+	}
+	a = my - b*mx
+	for i := range xs {
+		r := ys[i] - a - b*xs[i]
+		sse += r * r
+	}
+	return
+}
+
+// the Bayesian information criterion of a fit with k parameters to m points,
+// lower being better. It charges for the extra parameter, so a constant
+// can win over a line through noise
+func bic(sse float64, m, k int) float64 {
+	return float64(m)*math.Log(math.Max(sse, 1e-12)/float64(m)) + float64(k)*math.Log(float64(m))
+}
+
+// fit the time of a phase at each dataset size to the power law and to each
+// of the complexity classes, picking the class with the lowest BIC. A class
+// whose time would shrink as the dataset grows doesn't fit, and with fewer
+// than three sizes there is no telling the classes apart, so none is picked
+func fitComplexity(sizes []int, times []float64) (exponent float64, model string) {
+	ns := make([]float64, len(sizes))
+	for i, n := range sizes {
+		ns[i] = float64(n)
+	}
+	logn, logt := []float64{}, []float64{}
+	for i := range ns {
+		if times[i] > 0 {
+			logn = append(logn, math.Log(ns[i]))
+			logt = append(logt, math.Log(times[i]))
+		}
+	}
+	if len(logn) >= 2 {
+		_, exponent, _ = leastSquares(logn, logt)
+	}
+	if len(times) < 3 {
+		return exponent, ""
+	}
+
+	my := mean(times)
+	sse := 0.0
+	for _, t := range times {
+		sse += (t - my) * (t - my)
+	}
+	model, best := "O(1)", bic(sse, len(times), 1)
+	for _, cm := range complexityModels {
+		xs := make([]float64, len(ns))
+		for i, n := range ns {
+			xs[i] = cm.f(n)
+		}
+		_, b, sse := leastSquares(xs, times)
+		if b <= 0 {
+			continue
+		}
+		if c := bic(sse, len(times), 2); c < best {
+			model, best = cm.Name, c
+		}
+	}
+	return exponent, model
+}
+
+// fit every phase of every provider that was run at more than one dataset
+// size. Providers are grouped by their names without the size
+func FitScaling(metrics []BPoint) []ScalingFit {
+	// times of each phase by provider and size
+	times := map[seriesKey]map[int][]float64{}
+	for _, p := range metrics {
+		if !phaseMetric(p.Id) {
+			continue
+		}
+		provider, documents, ok := splitSizedProviderName(p.Provider)
+		if !ok {
+			continue
+		}
+		k := seriesKey{provider, p.Id}
+		if times[k] == nil {
+			times[k] = map[int][]float64{}
+		}
+		times[k][documents] = append(times[k][documents], p.Value)
+	}
+
+	fits := []ScalingFit{}
+	for k, bySize := range times {
+		if len(bySize) < 2 {
+			continue
+		}
+		fit := ScalingFit{Provider: k.Provider, Id: k.Id}
+		for documents := range bySize {
+			fit.Sizes = append(fit.Sizes, documents)
+		}
+		sort.Ints(fit.Sizes)
+		for _, documents := range fit.Sizes {
+			fit.Medians = append(fit.Medians, median(bySize[documents]))
+		}
+		fit.Exponent, fit.Model = fitComplexity(fit.Sizes, fit.Medians)
+		fits = append(fits, fit)
+	}
+	sort.Slice(fits, func(i, j int) bool {
+		if fits[i].Provider != fits[j].Provider {
+			return fits[i].Provider < fits[j].Provider
+		}
+		return fits[i].Id < fits[j].Id
+	})
+	return fits
+}
+
+// print the fits as a table, with the median time at each size
+func PrintScaling(w io.Writer, fits []ScalingFit) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "provider\tid\ttrend\texponent\tmedian time at each size")
+	for _, fit := range fits {
+		at := make([]string, len(fit.Sizes))
+		for i := range fit.Sizes {
+			at[i] = fmt.Sprintf("%d:%.4g", fit.Sizes[i], fit.Medians[i])
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.2f\t%s\n", fit.Provider, fit.Id, fit.Model, fit.Exponent, strings.Join(at, " "))
+	}
+	tw.Flush()
+}
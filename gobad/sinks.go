@@ -0,0 +1,368 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Sink is where a Reporter's results go. Metrics are streamed to it as the
+// run goes, so a run that dies part way through leaves what it measured so far
+// behind, and it is closed with the whole report at the end of the run or on
+// Fatal
+type Sink interface {
+	// write metrics that haven't been written before
+	WriteMetrics(points []BPoint) error
+
+	// finish the output with the final state of the run
+	Close(r *Reporter) error
+}
+
+// the formats OpenSink knows, with the file each is written to by default
+var SinkFormats = map[string]string{
+	"json":   "benchmarkresult.json",
+	"jsonl":  "benchmarkresult.jsonl",
+	"csv":    "benchmarkresult.csv",
+	"prom":   "benchmarkresult.prom",
+	"sqlite": "benchmarkresult.db",
+}
+
+// open a sink of the given format writing to path, or to the format's default
+// file if path is empty, for the results of r
+func OpenSink(format, path string, r *Reporter) (Sink, error) {
+	def, ok := SinkFormats[format]
+	if !ok {
+		return nil, fmt.Errorf("Unknown result format %q", format)
+	}
+	if path == "" {
+		path = def
+	}
+	switch format {
+	case "json":
+		return NewJSONSink(path, r), nil
+	case "jsonl":
+		return NewJSONLSink(path)
+	case "csv":
+		return NewCSVSink(path)
+	case "prom":
+		return NewPrometheusSink(path)
+	default:
+		return NewSQLiteSink(path)
+	}
+}
+
+//== JSON
+
+// A JSONSink writes the whole report as one JSON document, the format
+// analysis_mongo.py reads. As metrics come in, the file is rewritten with the
+// report being run, marked as not ok since the run hasn't finished, and it is
+// replaced by the final report when the run ends. Each write goes to a
+// temporary file first, so the file is never left half written.
+// The file holds every metric, so rewriting it gets slower as the run goes on.
+// Rewrites are skipped until ten times as long as the last one took has
+// passed, so they take no more than a tenth of the run
+type JSONSink struct {
+	path string
+	// the report being run
+	r *Reporter
+	// when the file was last rewritten, and how long that took
+	written time.Time
+	cost    time.Duration
+}
+
+func NewJSONSink(path string, r *Reporter) *JSONSink {
+	return &JSONSink{path: path, r: r}
+}
+
+func (s *JSONSink) WriteMetrics(points []BPoint) error {
+	if time.Since(s.written) < 10*s.cost {
+		return nil
+	}
+	interim := *s.r
+	interim.VAL_Ok = false
+	interim.VAL_FatalMsg = "The run has not finished"
+	interim.VAL_End = time.Now().Unix()
+	return s.write(&interim)
+}
+
+func (s *JSONSink) Close(r *Reporter) error {
+	return s.write(r)
+}
+
+func (s *JSONSink) write(r *Reporter) error {
+	start := time.Now()
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("Could not create result file: %v", err)
+	}
+	if err := json.NewEncoder(f).Encode(r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.written = time.Now()
+	s.cost = s.written.Sub(start)
+	return nil
+}
+
+//== JSONL
+
+// A JSONLSink writes one JSON object per line: a metric for every line but
+// the last, which holds the rest of the report, as the JSON report does but
+// without its metrics
+type JSONLSink struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+func NewJSONLSink(path string) (*JSONLSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create result file: %v", err)
+	}
+	return &JSONLSink{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (s *JSONLSink) WriteMetrics(points []BPoint) error {
+	for _, p := range points {
+		if err := s.enc.Encode(p); err != nil {
+			return err
+		}
+	}
+	return s.f.Sync()
+}
+
+func (s *JSONLSink) Close(r *Reporter) error {
+	summary := *r
+	summary.VAL_Metrics = nil
+	if err := s.enc.Encode(summary); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
+
+//== CSV
+
+// A CSVSink writes a header and then a row per metric, with the sample query
+// plan, if any, in the last three columns. Only metrics are written, so
+// whether the run succeeded has to be found out elsewhere
+type CSVSink struct {
+	f *os.File
+	w *csv.Writer
+}
+
+var csvHeader = []string{"provider", "id", "iteration", "value", "keysexamined", "docsexamined", "index"}
+
+func NewCSVSink(path string) (*CSVSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create result file: %v", err)
+	}
+	s := &CSVSink{f: f, w: csv.NewWriter(f)}
+	if err := s.w.Write(csvHeader); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *CSVSink) WriteMetrics(points []BPoint) error {
+	for _, p := range points {
+		row := []string{p.Provider, p.Id, strconv.Itoa(p.Iteration), strconv.FormatFloat(p.Value, 'g', -1, 64), "", "", ""}
+		if p.Plan != nil {
+			row[4] = strconv.Itoa(p.Plan.KeysExamined)
+			row[5] = strconv.Itoa(p.Plan.DocsExamined)
+			row[6] = p.Plan.Index
+		}
+		if err := s.w.Write(row); err != nil {
+			return err
+		}
+	}
+	s.w.Flush()
+	if err := s.w.Error(); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *CSVSink) Close(r *Reporter) error {
+	s.w.Flush()
+	if err := s.w.Error(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
+
+//== Prometheus
+
+// A PrometheusSink writes the Prometheus text exposition format, as read by
+// the node exporter's textfile collector: every metric is a sample of the
+// gobad_metric gauge, labelled with its provider, id and iteration, and the
+// end of the run adds the gobad_run_* gauges, with the RunInfo as labels of
+// gobad_run_info. Each family's samples are
+// written together, as the format requires, since the run gauges only come
+// after the last metric
+type PrometheusSink struct {
+	f *os.File
+}
+
+func NewPrometheusSink(path string) (*PrometheusSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create result file: %v", err)
+	}
+	_, err = fmt.Fprint(f, "# HELP gobad_metric A benchmark measurement; timings are in microseconds.\n# TYPE gobad_metric gauge\n")
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &PrometheusSink{f: f}, nil
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func (s *PrometheusSink) WriteMetrics(points []BPoint) error {
+	for _, p := range points {
+		_, err := fmt.Fprintf(s.f, "gobad_metric{provider=\"%s\",id=\"%s\",iteration=\"%d\"} %s\n",
+			promLabelEscaper.Replace(p.Provider), promLabelEscaper.Replace(p.Id), p.Iteration, strconv.FormatFloat(p.Value, 'g', -1, 64))
+		if err != nil {
+			return err
+		}
+	}
+	return s.f.Sync()
+}
+
+func (s *PrometheusSink) Close(r *Reporter) error {
+	ok := 0
+	if r.VAL_Ok {
+		ok = 1
+	}
+	_, err := fmt.Fprintf(s.f, "# HELP gobad_run_ok Whether the run finished without a fatal error.\n# TYPE gobad_run_ok gauge\ngobad_run_ok %d\n"+
+		"# HELP gobad_run_start_seconds When the run started, in seconds since the epoch.\n# TYPE gobad_run_start_seconds gauge\ngobad_run_start_seconds %d\n"+
+		"# HELP gobad_run_end_seconds When the run ended, in seconds since the epoch.\n# TYPE gobad_run_end_seconds gauge\ngobad_run_end_seconds %d\n",
+		ok, r.VAL_Start, r.VAL_End)
+	if err == nil {
+		ri := r.VAL_Run
+		_, err = fmt.Fprintf(s.f, "# HELP gobad_run_info What was run where; always 1.\n# TYPE gobad_run_info gauge\n"+
+			"gobad_run_info{seed=\"%d\",factor=\"%d\",gitrevision=\"%s\",goversion=\"%s\",hostname=\"%s\",cpumodel=\"%s\",cpucores=\"%d\",gomaxprocs=\"%d\",memorybytes=\"%d\"} 1\n",
+			ri.Seed, ri.Factor, promLabelEscaper.Replace(ri.GitRevision), promLabelEscaper.Replace(ri.GoVersion), promLabelEscaper.Replace(ri.Hostname),
+			promLabelEscaper.Replace(ri.CPUModel), ri.CPUCores, ri.GOMAXPROCS, ri.MemoryBytes)
+	}
+	if err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
+
+//== SQLite
+
+// A SQLiteSink adds a row for the run to the runs table of a SQLite database,
+// and its metrics to the metrics table, so the results of many runs can be
+// kept in one file and queried together. The run's RunInfo and provider
+// descriptions, the steady-state analysis and the scaling fits of a sweep,
+// are kept as JSON in the info column of its row
+type SQLiteSink struct {
+	db  *sql.DB
+	run int64
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	run INTEGER PRIMARY KEY AUTOINCREMENT,
+	starttime INTEGER NOT NULL,
+	endtime INTEGER,
+	ok INTEGER,
+	fatalmsg TEXT,
+	info TEXT
+);
+CREATE TABLE IF NOT EXISTS metrics (
+	run INTEGER NOT NULL REFERENCES runs(run),
+	provider TEXT NOT NULL,
+	id TEXT NOT NULL,
+	iteration INTEGER NOT NULL,
+	value REAL NOT NULL,
+	keysexamined INTEGER,
+	docsexamined INTEGER,
+	idx TEXT
+);
+CREATE INDEX IF NOT EXISTS metrics_run_id ON metrics (run, id, provider);
+`
+
+func NewSQLiteSink(path string) (*SQLiteSink, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open result database: %v", err)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Could not create result tables: %v", err)
+	}
+	res, err := db.Exec("INSERT INTO runs (starttime) VALUES (?)", Report.VAL_Start)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Could not add run: %v", err)
+	}
+	run, err := res.LastInsertId()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteSink{db: db, run: run}, nil
+}
+
+func (s *SQLiteSink) WriteMetrics(points []BPoint) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT INTO metrics (run, provider, id, iteration, value, keysexamined, docsexamined, idx) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, p := range points {
+		var keys, docs, index interface{}
+		if p.Plan != nil {
+			keys, docs, index = p.Plan.KeysExamined, p.Plan.DocsExamined, p.Plan.Index
+		}
+		if _, err := stmt.Exec(s.run, p.Provider, p.Id, p.Iteration, p.Value, keys, docs, index); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	stmt.Close()
+	return tx.Commit()
+}
+
+func (s *SQLiteSink) Close(r *Reporter) error {
+	info, err := json.Marshal(struct {
+		Run       RunInfo                 `json:"run"`
+		Providers map[string]ProviderInfo `json:"providers"`
+		Scaling   []ScalingFit            `json:"scaling,omitempty"`
+		Steady    []SteadyState           `json:"steady,omitempty"`
+	}{r.VAL_Run, r.VAL_Providers, r.VAL_Scaling, r.VAL_Steady})
+	if err == nil {
+		_, err = s.db.Exec("UPDATE runs SET starttime = ?, endtime = ?, ok = ?, fatalmsg = ?, info = ? WHERE run = ?", r.VAL_Start, r.VAL_End, r.VAL_Ok, r.VAL_FatalMsg, string(info), s.run)
+	}
+	if err != nil {
+		s.db.Close()
+		return err
+	}
+	return s.db.Close()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Statistics over the values of a metric across iterations
+
+func median(xs []float64) float64 {
+	if len(xs) == 0 {
+		return math.NaN()
+	}
+	s := append([]float64(nil), xs...)
+	sort.Float64s(s)
+	mid := len(s) / 2
+	if len(s)%2 == 1 {
+		return s[mid]
+	}
+	return (s[mid-1] + s[mid]) / 2
+}
+
+// the ranks of xs in ascending order, from 1, with tied values given the mean
+// of the ranks they span. Also returns the sum of t^3 - t over each group of
+// t tied values, for tie corrections
+func ranks(xs []float64) ([]float64, float64) {
+	idx := make([]int, len(xs))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(a, b int) bool { return xs[idx[a]] < xs[idx[b]] })
+	r := make([]float64, len(xs))
+	ties := 0.0
+	for i := 0; i < len(idx); {
+		j := i + 1
+		for j < len(idx) && xs[idx[j]] == xs[idx[i]] {
+			j++
+		}
+		// positions i..j-1 hold equal values, ranks i+1..j
+		rank := float64(i+1+j) / 2
+		for k := i; k < j; k++ {
+			r[idx[k]] = rank
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+	return r, ties
+}
+
+// the two-sided p-value of the Mann-Whitney U test that a and b are samples
+// of the same distribution, by the normal approximation with continuity and
+// tie corrections. Reasonable from about eight values per sample; returns 1
+// if either sample is empty or every value is the same
+func mannWhitney(a, b []float64) float64 {
+	n1, n2 := float64(len(a)), float64(len(b))
+	if n1 == 0 || n2 == 0 {
+		return 1
+	}
+	r, ties := ranks(append(append([]float64(nil), a...), b...))
+	r1 := 0.0
+	for _, x := range r[:len(a)] {
+		r1 += x
+	}
+	u := r1 - n1*(n1+1)/2
+	n := n1 + n2
+	sigma := math.Sqrt(n1 * n2 / 12 * ((n + 1) - ties/(n*(n-1))))
+	if sigma == 0 || math.IsNaN(sigma) {
+		return 1
+	}
+	z := (math.Abs(u-n1*n2/2) - 0.5) / sigma
+	if z < 0 {
+		z = 0
+	}
+	return math.Erfc(z / math.Sqrt2)
+}
+
+// the q quantile of xs, interpolating between the values either side
+func quantile(xs []float64, q float64) float64 {
+	if len(xs) == 0 {
+		return math.NaN()
+	}
+	s := append([]float64(nil), xs...)
+	sort.Float64s(s)
+	pos := q * float64(len(s)-1)
+	lo := int(math.Floor(pos))
+	if lo >= len(s)-1 {
+		return s[len(s)-1]
+	}
+	return s[lo] + (pos-float64(lo))*(s[lo+1]-s[lo])
+}
+
+func mean(xs []float64) float64 {
+	if len(xs) == 0 {
+		return math.NaN()
+	}
+	sum := 0.0
+	for _, x := range xs {
+		sum += x
+	}
+	return sum / float64(len(xs))
+}
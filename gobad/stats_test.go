@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMedian(t *testing.T) {
+	for _, tc := range []struct {
+		xs   []float64
+		want float64
+	}{
+		{[]float64{3}, 3},
+		{[]float64{3, 1, 2}, 2},
+		{[]float64{4, 1, 3, 2}, 2.5},
+	} {
+		if got := median(tc.xs); got != tc.want {
+			t.Errorf("median(%v): got %v, want %v", tc.xs, got, tc.want)
+		}
+	}
+	if !math.IsNaN(median(nil)) {
+		t.Error("median of nothing should be NaN")
+	}
+}
+
+func TestRanks(t *testing.T) {
+	r, ties := ranks([]float64{10, 30, 20, 30, 30})
+	want := []float64{1, 4, 2, 4, 4}
+	for i := range want {
+		if r[i] != want[i] {
+			t.Fatalf("got ranks %v, want %v", r, want)
+		}
+	}
+	if ties != 24 {
+		t.Errorf("got tie sum %v, want 24", ties)
+	}
+}
+
+func TestMannWhitney(t *testing.T) {
+	seq := func(from, to float64) []float64 {
+		ret := []float64{}
+		for x := from; x <= to; x++ {
+			ret = append(ret, x)
+		}
+		return ret
+	}
+	for _, tc := range []struct {
+		a, b []float64
+		want float64
+	}{
+		// worked by hand from the normal approximation, as scipy's
+		// mannwhitneyu gives with method="asymptotic"
+		{seq(1, 8), seq(9, 16), 0.0009391056991},
+		{seq(9, 16), seq(1, 8), 0.0009391056991},
+		{[]float64{1, 2, 2, 3, 3, 3}, []float64{2, 3, 4, 4, 5, 5}, 0.04796787374},
+		{seq(1, 8), seq(1, 8), 1},
+		{[]float64{5, 5, 5}, []float64{5, 5}, 1},
+		{nil, seq(1, 8), 1},
+		{seq(1, 8), nil, 1},
+	} {
+		if got := mannWhitney(tc.a, tc.b); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("mannWhitney(%v, %v): got %.10g, want %.10g", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+)
+
+// Every run starts from databases Initialize has just dropped, and the first
+// runs of a process also pay for connecting, filling the server's caches and
+// growing the heap. The phase times of those runs describe a cold start, not
+// how the provider performs once it has settled, so each phase's series over
+// the iterations is split where it reaches its steady state, and what is left
+// is checked for outliers
+
+// a phase iteration that took much longer than the phase's steady state
+type Outlier struct {
+	Iteration int     `json:"iteration"`
+	Value     float64 `json:"value"`
+	// microseconds the process was paused for GC during the phase
+	GCPause float64 `json:"gcpause"`
+	// "gc" if the GC pause accounts for at least half of the excess over the
+	// steady state, "host" otherwise, such as from other load on the machine
+	Cause string `json:"cause"`
+}
+
+type SteadyState struct {
+	Provider string `json:"provider"`
+	Id       string `json:"id"`
+	// the time of the first iteration
+	ColdStart float64 `json:"coldstart"`
+	// the first iteration of the steady state, and the median time from there
+	SteadyFrom int       `json:"steadyfrom"`
+	Steady     float64   `json:"steady"`
+	Outliers   []Outlier `json:"outliers,omitempty"`
+}
+
+// where a series reaches its steady state, by the MSER rule: the truncation
+// point d, in the first half, that minimises the variance of the mean of
+// what is left, sum((x - mean)^2) / (n - d)^2. A warm-up adds variance that
+// cutting it off removes, while cutting off steady values only makes the
+// rest a smaller sample
+func steadyStart(xs []float64) int {
+	best, bestScore := 0, math.Inf(1)
+	for d := 0; d <= len(xs)/2; d++ {
+		rest := xs[d:]
+		m := mean(rest)
+		ss := 0.0
+		for _, x := range rest {
+			ss += (x - m) * (x - m)
+		}
+		score := ss / float64(len(rest)*len(rest))
+		if score < bestScore {
+			best, bestScore = d, score
+		}
+	}
+	return best
+}
+
+// the median absolute deviation of xs from m, scaled to estimate the standard
+// deviation of normally distributed values
+func mad(xs []float64, m float64) float64 {
+	dev := make([]float64, len(xs))
+	for i, x := range xs {
+		dev[i] = math.Abs(x - m)
+	}
+	return 1.4826 * median(dev)
+}
+
+// split every phase's times into cold start and steady state, and flag the
+// steady iterations more than madLimit median absolute deviations above the
+// steady median. pauses holds the GC pause during each metric, by index in
+// metrics, as the Reporter records them
+func AnalyzeSteadyState(metrics []BPoint, pauses map[int]float64, madLimit float64) []SteadyState {
+	type point struct {
+		it    int
+		v     float64
+		pause float64
+	}
+	series := map[seriesKey][]point{}
+	for i, p := range metrics {
+		if !phaseMetric(p.Id) {
+			continue
+		}
+		k := seriesKey{p.Provider, p.Id}
+		series[k] = append(series[k], point{p.Iteration, p.Value, pauses[i]})
+	}
+
+	states := []SteadyState{}
+	for k, points := range series {
+		sort.SliceStable(points, func(i, j int) bool { return points[i].it < points[j].it })
+		xs := make([]float64, len(points))
+		for i, p := range points {
+			xs[i] = p.v
+		}
+		from := steadyStart(xs)
+		st := SteadyState{
+			Provider:   k.Provider,
+			Id:         k.Id,
+			ColdStart:  xs[0],
+			SteadyFrom: points[from].it,
+			Steady:     median(xs[from:]),
+		}
+		limit := st.Steady + madLimit*mad(xs[from:], st.Steady)
+		for _, p := range points[from:] {
+			if p.v <= limit || limit == st.Steady {
+				continue
+			}
+			o := Outlier{Iteration: p.it, Value: p.v, GCPause: p.pause, Cause: "host"}
+			if p.pause >= (p.v-st.Steady)/2 {
+				o.Cause = "gc"
+			}
+			st.Outliers = append(st.Outliers, o)
+		}
+		states = append(states, st)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Provider != states[j].Provider {
+			return states[i].Provider < states[j].Provider
+		}
+		return states[i].Id < states[j].Id
+	})
+	return states
+}
+
+// print how many phases settled late and every outlier
+func PrintSteadyState(w io.Writer, states []SteadyState) {
+	late, outliers := 0, 0
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, st := range states {
+		if st.SteadyFrom > 0 {
+			late++
+		}
+		for _, o := range st.Outliers {
+			if outliers == 0 {
+				fmt.Fprintln(tw, "outlier\tprovider\tid\titeration\ttime\tsteady\tgc pause")
+			}
+			outliers++
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%.4g\t%.4g\t%.4g\n", o.Cause, st.Provider, st.Id, o.Iteration, o.Value, st.Steady, o.GCPause)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d of %d phases needed warming up, %d outliers flagged\n", late, len(states), outliers)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// A TimeoutPolicy sets a deadline on every call by method. It is applied by
+// wrapping a provider in a TimeoutMetadataQuery, which gives each call a
+// context that times out after the method's timeout, so a call that hangs
+// fails with context.DeadlineExceeded instead
+type TimeoutPolicy struct {
+	// the timeout of every method without its own entry in Methods. 0 sets
+	// no deadline
+	Default time.Duration
+
+	// timeouts by method name, such as "GetDocumentUnique"
+	Methods map[string]time.Duration
+}
+
+// the zero TimeoutPolicy sets no deadlines
+func (p TimeoutPolicy) Active() bool {
+	if p.Default > 0 {
+		return true
+	}
+	for _, d := range p.Methods {
+		if d > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (p TimeoutPolicy) timeout(method string) time.Duration {
+	if d, ok := p.Methods[method]; ok {
+		return d
+	}
+	return p.Default
+}
+
+type TimeoutMetadataQuery struct {
+	policy TimeoutPolicy
+	mq     MetadataQuery
+}
+
+func NewTimeoutMetadataQuery(mq MetadataQuery, policy TimeoutPolicy) *TimeoutMetadataQuery {
+	return &TimeoutMetadataQuery{policy: policy, mq: mq}
+}
+
+// the provider whose calls are timed out
+func (tm *TimeoutMetadataQuery) Unwrap() MetadataQuery {
+	return tm.mq
+}
+
+// the context to make a call to method with
+func (tm *TimeoutMetadataQuery) context(ctx context.Context, method string) (context.Context, context.CancelFunc) {
+	if d := tm.policy.timeout(method); d > 0 {
+		return context.WithTimeout(ctx, d)
+	}
+	return ctx, func() {}
+}
+
+// closing takes no context, so it gets no deadline either
+func (tm *TimeoutMetadataQuery) Close() error {
+	return tm.mq.Close()
+}
+
+// a subscription outlives the call that makes it, so it gets no deadline
+func (tm *TimeoutMetadataQuery) Subscribe(ctx context.Context, where KVList) *Subscription {
+	return tm.mq.Subscribe(ctx, where)
+}
+
+func (tm *TimeoutMetadataQuery) Initialize(ctx context.Context) error {
+	ctx, cancel := tm.context(ctx, "Initialize")
+	defer cancel()
+	return tm.mq.Initialize(ctx)
+}
+
+func (tm *TimeoutMetadataQuery) GetDocumentUnique(ctx context.Context, uuid string) (KVList, error) {
+	ctx, cancel := tm.context(ctx, "GetDocumentUnique")
+	defer cancel()
+	return tm.mq.GetDocumentUnique(ctx, uuid)
+}
+
+func (tm *TimeoutMetadataQuery) GetDocumentSetWhere(ctx context.Context, where KVList) ([]KVList, error) {
+	ctx, cancel := tm.context(ctx, "GetDocumentSetWhere")
+	defer cancel()
+	return tm.mq.GetDocumentSetWhere(ctx, where)
+}
+
+func (tm *TimeoutMetadataQuery) GetUniqueValues(ctx context.Context, key string) ([]interface{}, error) {
+	ctx, cancel := tm.context(ctx, "GetUniqueValues")
+	defer cancel()
+	return tm.mq.GetUniqueValues(ctx, key)
+}
+
+func (tm *TimeoutMetadataQuery) GetDocumentSetValueGlob(ctx context.Context, key, value_glob string) ([]KVList, error) {
+	ctx, cancel := tm.context(ctx, "GetDocumentSetValueGlob")
+	defer cancel()
+	return tm.mq.GetDocumentSetValueGlob(ctx, key, value_glob)
+}
+
+func (tm *TimeoutMetadataQuery) GetKeyGlob(ctx context.Context, key_glob string) ([]string, error) {
+	ctx, cancel := tm.context(ctx, "GetKeyGlob")
+	defer cancel()
+	return tm.mq.GetKeyGlob(ctx, key_glob)
+}
+
+func (tm *TimeoutMetadataQuery) CountWhere(ctx context.Context, where KVList) (int, error) {
+	ctx, cancel := tm.context(ctx, "CountWhere")
+	defer cancel()
+	return tm.mq.CountWhere(ctx, where)
+}
+
+func (tm *TimeoutMetadataQuery) CountValueGlob(ctx context.Context, key, value_glob string) (int, error) {
+	ctx, cancel := tm.context(ctx, "CountValueGlob")
+	defer cancel()
+	return tm.mq.CountValueGlob(ctx, key, value_glob)
+}
+
+func (tm *TimeoutMetadataQuery) ExistsWhere(ctx context.Context, where KVList) (bool, error) {
+	ctx, cancel := tm.context(ctx, "ExistsWhere")
+	defer cancel()
+	return tm.mq.ExistsWhere(ctx, where)
+}
+
+func (tm *TimeoutMetadataQuery) GetUniqueValueCounts(ctx context.Context, key string) (map[string]int, error) {
+	ctx, cancel := tm.context(ctx, "GetUniqueValueCounts")
+	defer cancel()
+	return tm.mq.GetUniqueValueCounts(ctx, key)
+}
+
+func (tm *TimeoutMetadataQuery) InsertDocument(ctx context.Context, docs []KVList) error {
+	ctx, cancel := tm.context(ctx, "InsertDocument")
+	defer cancel()
+	return tm.mq.InsertDocument(ctx, docs)
+}
+
+func (tm *TimeoutMetadataQuery) BulkInsertDocument(ctx context.Context, docs []KVList, batchsize int) ([]DocumentError, error) {
+	ctx, cancel := tm.context(ctx, "BulkInsertDocument")
+	defer cancel()
+	return tm.mq.BulkInsertDocument(ctx, docs, batchsize)
+}
+
+func (tm *TimeoutMetadataQuery) BulkSetKVDocumentUnique(ctx context.Context, updates []DocumentUpdate, batchsize int) ([]DocumentError, error) {
+	ctx, cancel := tm.context(ctx, "BulkSetKVDocumentUnique")
+	defer cancel()
+	return tm.mq.BulkSetKVDocumentUnique(ctx, updates, batchsize)
+}
+
+func (tm *TimeoutMetadataQuery) UpsertDocument(ctx context.Context, doc KVList) error {
+	ctx, cancel := tm.context(ctx, "UpsertDocument")
+	defer cancel()
+	return tm.mq.UpsertDocument(ctx, doc)
+}
+
+func (tm *TimeoutMetadataQuery) SetKVDocumentUnique(ctx context.Context, kv KVList, uuid string) error {
+	ctx, cancel := tm.context(ctx, "SetKVDocumentUnique")
+	defer cancel()
+	return tm.mq.SetKVDocumentUnique(ctx, kv, uuid)
+}
+
+func (tm *TimeoutMetadataQuery) SetKVDocumentWhere(ctx context.Context, kv, where KVList) error {
+	ctx, cancel := tm.context(ctx, "SetKVDocumentWhere")
+	defer cancel()
+	return tm.mq.SetKVDocumentWhere(ctx, kv, where)
+}
+
+func (tm *TimeoutMetadataQuery) SetKVDocumentValueGlob(ctx context.Context, kv KVList, key, value_glob string) error {
+	ctx, cancel := tm.context(ctx, "SetKVDocumentValueGlob")
+	defer cancel()
+	return tm.mq.SetKVDocumentValueGlob(ctx, kv, key, value_glob)
+}
+
+func (tm *TimeoutMetadataQuery) ReplaceDocumentUnique(ctx context.Context, doc KVList, uuid string) error {
+	ctx, cancel := tm.context(ctx, "ReplaceDocumentUnique")
+	defer cancel()
+	return tm.mq.ReplaceDocumentUnique(ctx, doc, uuid)
+}
+
+func (tm *TimeoutMetadataQuery) DeleteKeyDocumentUnique(ctx context.Context, keys []string, uuid string) error {
+	ctx, cancel := tm.context(ctx, "DeleteKeyDocumentUnique")
+	defer cancel()
+	return tm.mq.DeleteKeyDocumentUnique(ctx, keys, uuid)
+}
+
+func (tm *TimeoutMetadataQuery) DeleteKeyDocumentWhere(ctx context.Context, keys []string, where KVList) error {
+	ctx, cancel := tm.context(ctx, "DeleteKeyDocumentWhere")
+	defer cancel()
+	return tm.mq.DeleteKeyDocumentWhere(ctx, keys, where)
+}
+
+func (tm *TimeoutMetadataQuery) DeleteKeyGlobDocumentUnique(ctx context.Context, key_glob, uuid string) error {
+	ctx, cancel := tm.context(ctx, "DeleteKeyGlobDocumentUnique")
+	defer cancel()
+	return tm.mq.DeleteKeyGlobDocumentUnique(ctx, key_glob, uuid)
+}
+
+func (tm *TimeoutMetadataQuery) DeleteKeyGlobDocumentWhere(ctx context.Context, key_glob string, where KVList) error {
+	ctx, cancel := tm.context(ctx, "DeleteKeyGlobDocumentWhere")
+	defer cancel()
+	return tm.mq.DeleteKeyGlobDocumentWhere(ctx, key_glob, where)
+}
+
+func (tm *TimeoutMetadataQuery) DeleteDocumentUnique(ctx context.Context, uuid string) error {
+	ctx, cancel := tm.context(ctx, "DeleteDocumentUnique")
+	defer cancel()
+	return tm.mq.DeleteDocumentUnique(ctx, uuid)
+}
+
+func (tm *TimeoutMetadataQuery) DeleteDocumentsWhere(ctx context.Context, where KVList) error {
+	ctx, cancel := tm.context(ctx, "DeleteDocumentsWhere")
+	defer cancel()
+	return tm.mq.DeleteDocumentsWhere(ctx, where)
+}
+
+func (tm *TimeoutMetadataQuery) ApplyBatch(ctx context.Context, batch *MetadataBatch) (bool, error) {
+	ctx, cancel := tm.context(ctx, "ApplyBatch")
+	defer cancel()
+	return tm.mq.ApplyBatch(ctx, batch)
+}
+
+func (tm *TimeoutMetadataQuery) GetDocumentUniqueAsOf(ctx context.Context, uuid string, t time.Time) (KVList, error) {
+	ctx, cancel := tm.context(ctx, "GetDocumentUniqueAsOf")
+	defer cancel()
+	return tm.mq.GetDocumentUniqueAsOf(ctx, uuid, t)
+}
+
+func (tm *TimeoutMetadataQuery) GetDocumentSetWhereAsOf(ctx context.Context, where KVList, t time.Time) ([]KVList, error) {
+	ctx, cancel := tm.context(ctx, "GetDocumentSetWhereAsOf")
+	defer cancel()
+	return tm.mq.GetDocumentSetWhereAsOf(ctx, where, t)
+}
+
+func (tm *TimeoutMetadataQuery) GetUniqueValuesAsOf(ctx context.Context, key string, t time.Time) ([]interface{}, error) {
+	ctx, cancel := tm.context(ctx, "GetUniqueValuesAsOf")
+	defer cancel()
+	return tm.mq.GetUniqueValuesAsOf(ctx, key, t)
+}
+
+func (tm *TimeoutMetadataQuery) GetDocumentSetValueGlobAsOf(ctx context.Context, key, value_glob string, t time.Time) ([]KVList, error) {
+	ctx, cancel := tm.context(ctx, "GetDocumentSetValueGlobAsOf")
+	defer cancel()
+	return tm.mq.GetDocumentSetValueGlobAsOf(ctx, key, value_glob, t)
+}
+
+func (tm *TimeoutMetadataQuery) GetKeyGlobAsOf(ctx context.Context, key_glob string, t time.Time) ([]string, error) {
+	ctx, cancel := tm.context(ctx, "GetKeyGlobAsOf")
+	defer cancel()
+	return tm.mq.GetKeyGlobAsOf(ctx, key_glob, t)
+}
+
+func (tm *TimeoutMetadataQuery) CountWhereAsOf(ctx context.Context, where KVList, t time.Time) (int, error) {
+	ctx, cancel := tm.context(ctx, "CountWhereAsOf")
+	defer cancel()
+	return tm.mq.CountWhereAsOf(ctx, where, t)
+}
+
+func (tm *TimeoutMetadataQuery) CountValueGlobAsOf(ctx context.Context, key, value_glob string, t time.Time) (int, error) {
+	ctx, cancel := tm.context(ctx, "CountValueGlobAsOf")
+	defer cancel()
+	return tm.mq.CountValueGlobAsOf(ctx, key, value_glob, t)
+}
+
+func (tm *TimeoutMetadataQuery) ExistsWhereAsOf(ctx context.Context, where KVList, t time.Time) (bool, error) {
+	ctx, cancel := tm.context(ctx, "ExistsWhereAsOf")
+	defer cancel()
+	return tm.mq.ExistsWhereAsOf(ctx, where, t)
+}
+
+func (tm *TimeoutMetadataQuery) GetUniqueValueCountsAsOf(ctx context.Context, key string, t time.Time) (map[string]int, error) {
+	ctx, cancel := tm.context(ctx, "GetUniqueValueCountsAsOf")
+	defer cancel()
+	return tm.mq.GetUniqueValueCountsAsOf(ctx, key, t)
+}
+
+func (tm *TimeoutMetadataQuery) GetDocumentHistory(ctx context.Context, uuid string) ([]ChangeEvent, error) {
+	ctx, cancel := tm.context(ctx, "GetDocumentHistory")
+	defer cancel()
+	return tm.mq.GetDocumentHistory(ctx, uuid)
+}
+
+func (tm *TimeoutMetadataQuery) CompactHistory(ctx context.Context) error {
+	ctx, cancel := tm.context(ctx, "CompactHistory")
+	defer cancel()
+	return tm.mq.CompactHistory(ctx)
+}
@@ -7,10 +7,13 @@ import (
 type StringGenerator struct {
 	used     map[string]bool
 	alphabet string
+	rng      *rand.Rand
 }
 
-func NewStringGenerator(alphabet string) *StringGenerator {
-	return &StringGenerator{alphabet: alphabet, used: map[string]bool{}}
+// a generator of strings from alphabet that never repeats a string, drawing
+// from rng so that the same seed generates the same strings
+func NewStringGenerator(alphabet string, rng *rand.Rand) *StringGenerator {
+	return &StringGenerator{alphabet: alphabet, used: map[string]bool{}, rng: rng}
 }
 
 func (sg *StringGenerator) RandomString(length int) string {
@@ -20,7 +23,7 @@ func (sg *StringGenerator) RandomString(length int) string {
 tryagain:
 	b := make([]byte, length)
 	for i := 0; i < length; i++ {
-		b[i] = byte(sg.alphabet[rand.Intn(len(sg.alphabet))])
+		b[i] = byte(sg.alphabet[sg.rng.Intn(len(sg.alphabet))])
 	}
 	if sg.used[string(b)] {
 		goto tryagain
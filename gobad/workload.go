@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A WorkloadSpec describes what a benchmark run does.
+//
+// The RetagBatch phase measures atomic batches, which the Mongo providers can
+// only apply on a replica set or sharded cluster of MongoDB 4.2 or later. A
+// replica set of one member, started with mongod --replSet and rs.initiate(),
+// is enough. On a standalone server the phase is skipped with a log line, and
+// RetagBatch is missing from the results
+type WorkloadSpec struct {
+	// the seed all the data and operations of the workload are drawn from.
+	// 0 picks one from the clock, and the seed picked is recorded in its place
+	Seed int64
+
+	// the documents the workload runs on, one of Datasets
+	Dataset string
+
+	// the dumps the import dataset is loaded from
+	Import []string
+
+	// documents loaded before the phases run
+	Documents int
+
+	// calls each timed phase makes. Phases cycle through the documents if
+	// there are fewer documents than calls
+	Operations int
+
+	// times the whole workload is repeated
+	Runs int
+
+	// untimed operations run on every provider before its phases, after
+	// Initialize and any preload, so the phases don't measure the server
+	// creating collections and filling its caches
+	Warmup int
+
+	// phase iterations more than this many median absolute deviations slower
+	// than the phase's steady state are flagged as outliers
+	OutlierMADs float64
+
+	// dataset sizes to sweep over, each run in turn in place of Documents,
+	// with the size appended to provider names. Operations stays the same at
+	// every size, so phase times grow only with the cost of each call
+	Sizes []int
+
+	// batch sizes tried by the bulk insert and bulk update phases
+	BatchSizes []int
+
+	// index strategies to sweep over. The whole workload is run once per
+	// config on every provider
+	IndexConfigs []IndexConfig
+
+	// each provider is also run behind a MetadataCache of each of these
+	// capacities. A capacity of 0 runs the provider without a cache
+	CacheCapacities []int
+
+	// faults injected into every provider, underneath any cache. The zero
+	// policy injects none. Failed calls are retried as Retry says, and calls
+	// that still fail are counted rather than failing the run. The policy's
+	// own Retry is replaced by Retry
+	Faults FaultPolicy
+
+	// deadlines for every call, by operation. A call that runs past its
+	// deadline fails the run
+	Timeouts TimeoutPolicy
+
+	// how the providers retry calls that fail with transient errors
+	Retry RetryPolicy
+
+	// how the Mongo providers connect. Its write concern is replaced by each
+	// of WriteConcerns in turn
+	Mongo MongoConfig
+
+	// write concerns to sweep over. The whole workload is run once per
+	// write concern on every provider
+	WriteConcerns []WriteConcern
+}
+
+// An IndexConfig is a named set of indexes to build on each provider before
+// the workload runs
+type IndexConfig struct {
+	// appended to the provider name in metrics, so strategies can be told
+	// apart. The empty name leaves provider names as they are
+	Name string
+
+	// drop the indexes the provider builds in Initialize before adding these
+	ReplaceDefaults bool
+
+	// the indexes to add, by provider name, each as an IndexManager key list
+	Indexes map[string][][]string
+}
+
+// the provider's own indexes and nothing else
+var DefaultIndexes = IndexConfig{}
+
+// index strategies for the key/value layout of ProviderMongoExploded, from
+// single-field indexes to a compound (key, value) index that answers where
+// clauses from the index alone
+var ExplodedIndexSweep = []IndexConfig{
+	DefaultIndexes,
+	IndexConfig{
+		Name:            "keyvalue",
+		ReplaceDefaults: true,
+		Indexes: map[string][][]string{
+			"mongoexploded": {{"key", "value"}, {"docid"}},
+		},
+	},
+	IndexConfig{
+		Name:            "keyvaluedocid",
+		ReplaceDefaults: true,
+		Indexes: map[string][][]string{
+			"mongoexploded": {{"key", "value", "docid"}, {"docid", "key"}},
+		},
+	},
+}
+
+var DefaultWorkload = WorkloadSpec{
+	Dataset:         "random",
+	Documents:       FACTOR,
+	Operations:      FACTOR,
+	Runs:            FACTOR / 10,
+	Warmup:          FACTOR / 8,
+	OutlierMADs:     5,
+	BatchSizes:      []int{1, 16, 128, FACTOR},
+	IndexConfigs:    []IndexConfig{DefaultIndexes},
+	CacheCapacities: []int{0},
+	Timeouts: TimeoutPolicy{
+		Default: 30 * time.Second,
+		Methods: map[string]time.Duration{
+			"Initialize": 2 * time.Minute,
+		},
+	},
+	Retry: RetryPolicy{
+		Attempts:   3,
+		Backoff:    100 * time.Millisecond,
+		MaxBackoff: 2 * time.Second,
+	},
+	WriteConcerns: []WriteConcern{SafeWrites},
+}
+
+// the providers NewProvider knows
+var Providers = []string{"mongo", "mongoexploded"}
+
+// a provider by name, uninitialized, set up as spec says
+func NewProvider(name string, spec WorkloadSpec) (MetadataQuery, error) {
+	switch name {
+	case "mongo":
+		return &ProviderMongo{Mongo: spec.Mongo, Retry: spec.Retry}, nil
+	case "mongoexploded":
+		return &ProviderMongoExploded{Mongo: spec.Mongo, Retry: spec.Retry}, nil
+	}
+	return nil, fmt.Errorf("Unknown provider %q", name)
+}
+
+// build the indexes of cfg on a provider
+func applyIndexConfig(ctx context.Context, mq MetadataQuery, provider string, cfg IndexConfig) error {
+	im, ok := mq.(IndexManager)
+	if !ok {
+		if cfg.ReplaceDefaults || len(cfg.Indexes[provider]) > 0 {
+			return fmt.Errorf("Provider %s can't manage indexes for config %q", provider, cfg.Name)
+		}
+		return nil
+	}
+	if cfg.ReplaceDefaults {
+		indexes, err := im.ListIndexes(ctx)
+		if err != nil {
+			return err
+		}
+		for _, keys := range indexes {
+			if err := im.DropIndex(ctx, keys...); err != nil {
+				return err
+			}
+		}
+	}
+	for _, keys := range cfg.Indexes[provider] {
+		if err := im.EnsureIndex(ctx, keys...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the provider name metrics are reported under for an index config
+func indexedProviderName(provider string, cfg IndexConfig) string {
+	if cfg.Name == "" {
+		return provider
+	}
+	return provider + "+" + cfg.Name
+}
+
+// dataset sizes growing by step from from, up to and including to
+func GeometricSizes(from, to int, step float64) []int {
+	sizes := []int{}
+	for f := float64(from); int(f+0.5) <= to; f *= step {
+		sizes = append(sizes, int(f+0.5))
+	}
+	return sizes
+}
+
+// the provider name metrics are reported under when sweeping dataset sizes.
+// It is appended last, so splitSizedProviderName can take it off again
+func sizedProviderName(provider string, documents int) string {
+	return fmt.Sprintf("%s+%ddocs", provider, documents)
+}
+
+// the provider name without its dataset size, and the size, or ok false if
+// the name has none
+func splitSizedProviderName(name string) (provider string, documents int, ok bool) {
+	i := strings.LastIndex(name, "+")
+	if i < 0 || !strings.HasSuffix(name, "docs") {
+		return name, 0, false
+	}
+	documents, err := strconv.Atoi(strings.TrimSuffix(name[i+1:], "docs"))
+	if err != nil {
+		return name, 0, false
+	}
+	return name[:i], documents, true
+}
+
+// the provider name metrics are reported under for a write concern
+func concernedProviderName(provider string, wc WriteConcern) string {
+	if wc.Name == "" {
+		return provider
+	}
+	return provider + "+" + wc.Name
+}
+
+// wrap a provider in a cache of the given capacity, if it isn't 0, and return
+// the name the cached provider is reported under
+func cacheProvider(mq MetadataQuery, provider string, capacity int) (MetadataQuery, string) {
+	if capacity == 0 {
+		return mq, provider
+	}
+	return NewMetadataCache(mq, capacity), fmt.Sprintf("%s+cache%d", provider, capacity)
+}
+
+// wrap a provider in a FaultyMetadataQuery, if the policy injects any faults,
+// and return the name the faulty provider is reported under
+func faultProvider(mq MetadataQuery, provider string, policy FaultPolicy) (MetadataQuery, string) {
+	if !policy.Active() {
+		return mq, provider
+	}
+	return NewFaultyMetadataQuery(mq, policy), provider + "+faults"
+}
+
+// wrap a provider in a TimeoutMetadataQuery, if the policy sets any deadlines
+func timeoutProvider(mq MetadataQuery, policy TimeoutPolicy) MetadataQuery {
+	if !policy.Active() {
+		return mq
+	}
+	return NewTimeoutMetadataQuery(mq, policy)
+}
+
+// a provider wrapped around another, such as a MetadataCache
+type metadataDecorator interface {
+	Unwrap() MetadataQuery
+}
+
+// a provider or decorator that keeps stats of its own
+type statsReporter interface {
+	ReportStats(provider string, run int)
+}
+
+// the provider underneath any decorators
+func baseProvider(mq MetadataQuery) MetadataQuery {
+	for {
+		d, ok := mq.(metadataDecorator)
+		if !ok {
+			return mq
+		}
+		mq = d.Unwrap()
+	}
+}
+
+// the provider under any decorators, but for the deadlines of a
+// TimeoutMetadataQuery among them, for calls that should add to no metric or
+// decorator stats but mustn't hang either
+func untimedProvider(mq MetadataQuery) MetadataQuery {
+	base := baseProvider(mq)
+	for {
+		if tm, ok := mq.(*TimeoutMetadataQuery); ok {
+			return NewTimeoutMetadataQuery(base, tm.policy)
+		}
+		d, ok := mq.(metadataDecorator)
+		if !ok {
+			return base
+		}
+		mq = d.Unwrap()
+	}
+}
+
+// report the stats of every layer of a decorated provider
+func reportDecoratorStats(mq MetadataQuery, provider string, run int) {
+	for {
+		if r, ok := mq.(statsReporter); ok {
+			r.ReportStats(provider, run)
+		}
+		d, ok := mq.(metadataDecorator)
+		if !ok {
+			return
+		}
+		mq = d.Unwrap()
+	}
+}